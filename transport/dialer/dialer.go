@@ -0,0 +1,111 @@
+// Package dialer opens the connections of transports, either directly or through a proxy.
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Dialer opens connections. *net.Dialer and *tls.Dialer implement it, so do the proxies of
+// this package, which allows chaining them.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Direct connects without going through a proxy.
+var Direct Dialer = &net.Dialer{}
+
+// Auth holds the credentials to authenticate with a proxy.
+type Auth struct {
+	Username string
+	Password string
+}
+
+var ErrUnsupportedNetwork = errors.New("network not supported by proxy")
+
+// checkNetwork makes sure a proxy can reach address on network, returning its host and port.
+func checkNetwork(network, address string) (string, uint16, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return "", 0, fmt.Errorf("%w: %s", ErrUnsupportedNetwork, network)
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	return host, uint16(port), nil
+}
+
+// aLongTimeAgo is a deadline in the past, used to unblock pending I/O on a connection.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// handshake runs fn, which talks to a proxy over conn, until ctx is done. ctx's error is
+// returned if that's what stopped it.
+func handshake(ctx context.Context, conn net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	err := fn()
+
+	close(done)
+	<-stopped
+
+	conn.SetDeadline(time.Time{})
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// dialProxy connects to a proxy and runs the handshake that makes it connect to the target.
+func dialProxy(ctx context.Context, forward Dialer, addr string, fn func(net.Conn) (net.Conn, error)) (net.Conn, error) {
+	if forward == nil {
+		forward = Direct
+	}
+
+	conn, err := forward.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy: %w", err)
+	}
+
+	var tunnel net.Conn
+
+	err = handshake(ctx, conn, func() (err error) {
+		tunnel, err = fn(conn)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tunnel, nil
+}
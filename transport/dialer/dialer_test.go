@@ -0,0 +1,288 @@
+package dialer
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listen accepts connections on a random port, handing each one to fn on its own goroutine.
+func listen(t *testing.T, fn func(net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go fn(c)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// listenEcho starts a server that echoes everything it receives.
+func listenEcho(t *testing.T) string {
+	return listen(t, func(c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+}
+
+// pipe connects two connections together until either is closed.
+func pipe(a, b net.Conn) {
+	go io.Copy(a, b)
+	io.Copy(b, a)
+
+	a.Close()
+	b.Close()
+}
+
+// socks5Server is a minimal SOCKS5 proxy that only supports CONNECT, recording the targets it
+// was asked for.
+type socks5Server struct {
+	auth    *Auth
+	targets chan string
+}
+
+func (s *socks5Server) serve(c net.Conn) {
+	defer c.Close()
+
+	var hdr [2]byte
+	io.ReadFull(c, hdr[:])
+	methods := make([]byte, hdr[1])
+	io.ReadFull(c, methods)
+
+	if s.auth == nil {
+		c.Write([]byte{socks5Version, socks5NoAuth})
+	} else {
+		c.Write([]byte{socks5Version, socks5PasswordAuth})
+
+		// Version and username, then the password
+		var l [2]byte
+		io.ReadFull(c, l[:])
+		user := make([]byte, l[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, l[:1])
+		pass := make([]byte, l[0])
+		io.ReadFull(c, pass)
+
+		if string(user) != s.auth.Username || string(pass) != s.auth.Password {
+			c.Write([]byte{socks5PasswordVersion, 1})
+			return
+		}
+		c.Write([]byte{socks5PasswordVersion, 0})
+	}
+
+	var req [4]byte
+	io.ReadFull(c, req[:])
+
+	var host string
+	switch req[3] {
+	case socks5IPv4:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(c, ip)
+		host = net.IP(ip).String()
+	case socks5Domain:
+		var l [1]byte
+		io.ReadFull(c, l[:])
+		name := make([]byte, l[0])
+		io.ReadFull(c, name)
+		host = string(name)
+	}
+
+	var portBytes [2]byte
+	io.ReadFull(c, portBytes[:])
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(portBytes[:])))
+
+	s.targets <- net.JoinHostPort(host, port)
+
+	tc, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		c.Write([]byte{socks5Version, 0x05, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	c.Write([]byte{socks5Version, 0, 0, socks5IPv4, 127, 0, 0, 1, 0, 0})
+	pipe(c, tc)
+}
+
+// exchange writes a message on c and reads it back from an echo server.
+func exchange(t *testing.T, c net.Conn) {
+	_, err := c.Write([]byte("hello"))
+	require.Nil(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestSOCKS5(t *testing.T) {
+	target := listenEcho(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	srv := &socks5Server{targets: make(chan string, 1)}
+	proxy := listen(t, srv.serve)
+
+	d := SOCKS5(proxy, nil, nil)
+
+	c, err := d.DialContext(context.Background(), "tcp", "localhost:"+port)
+	require.Nil(t, err)
+	defer c.Close()
+
+	// Host names are resolved by the proxy
+	assert.Equal(t, "localhost:"+port, <-srv.targets)
+	exchange(t, c)
+}
+
+func TestSOCKS5_Auth(t *testing.T) {
+	target := listenEcho(t)
+
+	srv := &socks5Server{auth: &Auth{"user", "secret"}, targets: make(chan string, 1)}
+	proxy := listen(t, srv.serve)
+
+	c, err := SOCKS5(proxy, &Auth{"user", "secret"}, nil).DialContext(context.Background(), "tcp", target)
+	require.Nil(t, err)
+	defer c.Close()
+
+	assert.Equal(t, target, <-srv.targets)
+	exchange(t, c)
+
+	_, err = SOCKS5(proxy, &Auth{"user", "wrong"}, nil).DialContext(context.Background(), "tcp", target)
+	assert.ErrorIs(t, err, ErrSOCKS5)
+
+	_, err = SOCKS5(proxy, nil, nil).DialContext(context.Background(), "tcp", target)
+	assert.ErrorIs(t, err, ErrSOCKS5)
+}
+
+func TestSOCKS5_Refused(t *testing.T) {
+	srv := &socks5Server{targets: make(chan string, 1)}
+	proxy := listen(t, srv.serve)
+
+	// Nothing listens there anymore
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	l.Close()
+
+	_, err = SOCKS5(proxy, nil, nil).DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.ErrorIs(t, err, ErrSOCKS5)
+	assert.Contains(t, err.Error(), "connection refused")
+}
+
+func TestSOCKS5_UnsupportedNetwork(t *testing.T) {
+	_, err := SOCKS5("127.0.0.1:1080", nil, nil).DialContext(context.Background(), "unix", "/tmp/sock")
+	assert.ErrorIs(t, err, ErrUnsupportedNetwork)
+}
+
+// listenHTTPProxy starts an HTTP proxy that only supports CONNECT.
+func listenHTTPProxy(t *testing.T, auth string) string {
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if auth != "" && r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		tc, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			tc.Close()
+			return
+		}
+
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(c, tc)
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	srv := &http.Server{Handler: proxy}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return l.Addr().String()
+}
+
+func TestHTTPConnect(t *testing.T) {
+	target := listenEcho(t)
+	proxy := listenHTTPProxy(t, "")
+
+	c, err := HTTPConnect(proxy, nil, nil).DialContext(context.Background(), "tcp", target)
+	require.Nil(t, err)
+	defer c.Close()
+
+	exchange(t, c)
+}
+
+func TestHTTPConnect_Auth(t *testing.T) {
+	target := listenEcho(t)
+
+	// "user:secret"
+	proxy := listenHTTPProxy(t, "Basic dXNlcjpzZWNyZXQ=")
+
+	c, err := HTTPConnect(proxy, &Auth{"user", "secret"}, nil).DialContext(context.Background(), "tcp", target)
+	require.Nil(t, err)
+	defer c.Close()
+
+	exchange(t, c)
+
+	_, err = HTTPConnect(proxy, nil, nil).DialContext(context.Background(), "tcp", target)
+	assert.ErrorIs(t, err, ErrHTTPConnect)
+	assert.Contains(t, err.Error(), "407")
+}
+
+func TestHTTPConnect_Chained(t *testing.T) {
+	target := listenEcho(t)
+
+	srv := &socks5Server{targets: make(chan string, 1)}
+	socks := listen(t, srv.serve)
+	proxy := listenHTTPProxy(t, "")
+
+	// The HTTP proxy is reached through the SOCKS5 one
+	c, err := HTTPConnect(proxy, nil, SOCKS5(socks, nil, nil)).DialContext(context.Background(), "tcp", target)
+	require.Nil(t, err)
+	defer c.Close()
+
+	assert.Equal(t, proxy, <-srv.targets)
+	exchange(t, c)
+}
+
+func TestDialContext_Timeout(t *testing.T) {
+	// The proxy accepts connections but never answers
+	proxy := listen(t, func(c net.Conn) {
+		time.Sleep(time.Second)
+		c.Close()
+	})
+
+	for _, d := range []Dialer{SOCKS5(proxy, nil, nil), HTTPConnect(proxy, nil, nil)} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+		_, err := d.DialContext(ctx, "tcp", "127.0.0.1:80")
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		cancel()
+	}
+}
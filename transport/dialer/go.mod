@@ -0,0 +1,5 @@
+module github.com/MouseHatGames/mice-plugins/transport/dialer
+
+go 1.15
+
+require github.com/stretchr/testify v1.7.1
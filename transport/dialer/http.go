@@ -0,0 +1,93 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+var ErrHTTPConnect = errors.New("http proxy error")
+
+type httpConnectDialer struct {
+	addr    string
+	auth    *Auth
+	forward Dialer
+}
+
+// HTTPConnect connects through the HTTP proxy at addr with the CONNECT method, authenticating
+// with basic auth if auth isn't nil. The proxy is reached through forward, or directly if
+// it's nil. Use a *tls.Dialer as forward for proxies that only accept HTTPS.
+func HTTPConnect(addr string, auth *Auth, forward Dialer) Dialer {
+	return &httpConnectDialer{
+		addr:    addr,
+		auth:    auth,
+		forward: forward,
+	}
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if _, _, err := checkNetwork(network, address); err != nil {
+		return nil, err
+	}
+
+	return dialProxy(ctx, d.forward, d.addr, func(conn net.Conn) (net.Conn, error) {
+		return d.connect(conn, address)
+	})
+}
+
+func (d *httpConnectDialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	req, err := http.NewRequest(http.MethodConnect, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Host = address
+	req.URL.Host = address
+
+	if d.auth != nil {
+		creds := base64.StdEncoding.EncodeToString([]byte(d.auth.Username + ":" + d.auth.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("read proxy response: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrHTTPConnect, resp.Status)
+	}
+
+	// The target may have started talking already
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn reads what was buffered while reading the proxy's response before reading
+// from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,200 @@
+package dialer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+var ErrSOCKS5 = errors.New("socks5 proxy error")
+
+// SOCKS5 and RFC 1929 constants.
+const (
+	socks5Version = 0x05
+
+	socks5NoAuth       = 0x00
+	socks5PasswordAuth = 0x02
+	socks5NoAcceptable = 0xff
+
+	socks5PasswordVersion = 0x01
+
+	socks5Connect = 0x01
+
+	socks5IPv4   = 0x01
+	socks5Domain = 0x03
+	socks5IPv6   = 0x04
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+type socks5Dialer struct {
+	addr    string
+	auth    *Auth
+	forward Dialer
+}
+
+// SOCKS5 connects through the SOCKS5 proxy at addr, authenticating with a username and
+// password if auth isn't nil. Host names are resolved by the proxy. The proxy is reached
+// through forward, or directly if it's nil.
+func SOCKS5(addr string, auth *Auth, forward Dialer) Dialer {
+	return &socks5Dialer{
+		addr:    addr,
+		auth:    auth,
+		forward: forward,
+	}
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := checkNetwork(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialProxy(ctx, d.forward, d.addr, func(conn net.Conn) (net.Conn, error) {
+		if err := d.authenticate(conn); err != nil {
+			return nil, err
+		}
+		if err := d.connect(conn, host, port); err != nil {
+			return nil, err
+		}
+
+		return conn, nil
+	})
+}
+
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	greeting := []byte{socks5Version, 1, socks5NoAuth}
+	if d.auth != nil {
+		greeting = []byte{socks5Version, 2, socks5NoAuth, socks5PasswordAuth}
+	}
+
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("%w: unexpected version %d", ErrSOCKS5, reply[0])
+	}
+
+	switch reply[1] {
+	case socks5NoAuth:
+		return nil
+
+	case socks5PasswordAuth:
+		if d.auth == nil {
+			return fmt.Errorf("%w: proxy wants a password", ErrSOCKS5)
+		}
+
+		return d.sendPassword(conn)
+	}
+
+	return fmt.Errorf("%w: no acceptable authentication method", ErrSOCKS5)
+}
+
+func (d *socks5Dialer) sendPassword(conn net.Conn) error {
+	if len(d.auth.Username) > 255 || len(d.auth.Password) > 255 {
+		return fmt.Errorf("%w: username or password too long", ErrSOCKS5)
+	}
+
+	req := []byte{socks5PasswordVersion, byte(len(d.auth.Username))}
+	req = append(req, d.auth.Username...)
+	req = append(req, byte(len(d.auth.Password)))
+	req = append(req, d.auth.Password...)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("%w: authentication failed", ErrSOCKS5)
+	}
+
+	return nil
+}
+
+func (d *socks5Dialer) connect(conn net.Conn, host string, port uint16) error {
+	req := []byte{socks5Version, socks5Connect, 0}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("%w: host name too long", ErrSOCKS5)
+		}
+
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	}
+
+	var portBytes [2]byte
+	binary.BigEndian.PutUint16(portBytes[:], port)
+	req = append(req, portBytes[:]...)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// Version, reply, reserved and the type of the bound address
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("%w: unexpected version %d", ErrSOCKS5, reply[0])
+	}
+	if reply[1] != 0 {
+		reason, ok := socks5Replies[reply[1]]
+		if !ok {
+			reason = fmt.Sprintf("reply %d", reply[1])
+		}
+
+		return fmt.Errorf("%w: %s", ErrSOCKS5, reason)
+	}
+
+	// The bound address isn't of any use, skip it along with the port
+	var size int
+	switch reply[3] {
+	case socks5IPv4:
+		size = net.IPv4len
+	case socks5IPv6:
+		size = net.IPv6len
+	case socks5Domain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		size = int(l[0])
+	default:
+		return fmt.Errorf("%w: unknown address type %d", ErrSOCKS5, reply[3])
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, size+2)); err != nil {
+		return err
+	}
+
+	return nil
+}
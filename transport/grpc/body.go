@@ -0,0 +1,255 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/MouseHatGames/mice-plugins/transport/grpc/internal"
+	"github.com/MouseHatGames/mice/transport"
+)
+
+// A streamed message is sent as a message with its headers followed by messages with pieces
+// of its body, all of them but the last one having More set. gRPC's flow control keeps the
+// sender from getting ahead of the receiver.
+
+// ErrBodyAborted is returned when reading a body the sender gave up on.
+var ErrBodyAborted = errors.New("body aborted by sender")
+
+// maxChunkSize is the largest piece of a body sent in a single message.
+const maxChunkSize = 64 << 10
+
+// StreamSocket is implemented by the sockets of this transport. Type assert a socket to it to
+// send or receive messages without holding their whole body in memory.
+type StreamSocket interface {
+	transport.Socket
+
+	// SendStream sends msg's headers and returns a writer for its body, which starts with
+	// msg.Data. The message is complete once the writer is closed, and no other message can be
+	// sent on the socket until then. The peer must support streaming too, older ones receive
+	// every piece as a separate message.
+	SendStream(ctx context.Context, msg *transport.Message) (BodyWriter, error)
+
+	// ReceiveStream reads the headers of the next message into msg and returns a reader for
+	// its body, leaving msg.Data empty. Messages sent with Send are received this way too. The
+	// reader must be closed before receiving the next message, which skips the rest of the body.
+	ReceiveStream(ctx context.Context, msg *transport.Message) (io.ReadCloser, error)
+}
+
+// BodyWriter writes the body of a streamed message.
+type BodyWriter interface {
+	io.WriteCloser
+
+	// CloseWithError ends the body early, making the receiver fail with ErrBodyAborted.
+	CloseWithError(err error) error
+}
+
+var _ StreamSocket = (*grpcSocket)(nil)
+
+func (s *grpcSocket) SendStream(ctx context.Context, msg *transport.Message) (BodyWriter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.sendMu.Lock()
+
+	done := s.withContext(ctx)
+
+	if err := done(s.str.Send(&internal.Message{Headers: msg.MessageHeaders, More: true, Timeout: s.timeout(ctx)})); err != nil {
+		s.sendMu.Unlock()
+		return nil, err
+	}
+
+	w := &bodyWriter{
+		s:   s,
+		buf: make([]byte, 0, maxChunkSize),
+	}
+
+	if _, err := w.Write(msg.Data); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// bodyWriter cuts a body into messages of up to maxChunkSize bytes.
+type bodyWriter struct {
+	s      *grpcSocket
+	buf    []byte
+	err    error
+	closed bool
+}
+
+func (w *bodyWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// Full chunks are only sent once there's more, so that the last one can end the body
+		if len(w.buf) == maxChunkSize {
+			if w.err = w.s.str.Send(&internal.Message{Data: w.buf, More: true}); w.err != nil {
+				return n, w.err
+			}
+
+			// The message may still be referenced by gRPC
+			w.buf = make([]byte, 0, maxChunkSize)
+		}
+
+		c := copy(w.buf[len(w.buf):maxChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+func (w *bodyWriter) Close() error {
+	return w.end(&internal.Message{Data: w.buf})
+}
+
+func (w *bodyWriter) CloseWithError(err error) error {
+	if err == nil {
+		err = ErrBodyAborted
+	}
+
+	return w.end(&internal.Message{Aborted: err.Error()})
+}
+
+func (w *bodyWriter) end(last *internal.Message) error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+
+	if w.err == nil {
+		w.err = w.s.str.Send(last)
+	}
+
+	w.buf = nil
+	w.s.sendMu.Unlock()
+
+	return w.err
+}
+
+func (s *grpcSocket) ReceiveStream(ctx context.Context, msg *transport.Message) (io.ReadCloser, error) {
+	r, _, err := s.receiveStream(ctx, msg)
+	return r, err
+}
+
+// receiveStream is ReceiveStream, also returning how long the sender waits for the answer, or
+// zero.
+func (s *grpcSocket) receiveStream(ctx context.Context, msg *transport.Message) (io.ReadCloser, time.Duration, error) {
+	s.recvMu.Lock()
+
+	done := s.withContext(ctx)
+
+	rec, err := s.str.Recv()
+	if err = done(err); err != nil {
+		s.recvMu.Unlock()
+		return nil, 0, err
+	}
+
+	msg.MessageHeaders = rec.Headers
+	msg.Data = nil
+
+	timeout := time.Duration(rec.Timeout)
+
+	if !rec.More {
+		s.recvMu.Unlock()
+		return io.NopCloser(bytes.NewReader(rec.Data)), timeout, nil
+	}
+
+	return &body{s: s, release: s.recvMu.Unlock, chunk: rec.Data}, timeout, nil
+}
+
+// body reads the pieces of a streamed body as they arrive.
+type body struct {
+	s *grpcSocket
+
+	// release is called once the whole body has been received, letting the next message through.
+	release func()
+
+	chunk []byte
+	err   error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	for len(b.chunk) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		b.next()
+	}
+
+	n := copy(p, b.chunk)
+	b.chunk = b.chunk[n:]
+
+	return n, nil
+}
+
+// next receives the next piece of the body.
+func (b *body) next() {
+	rec, err := b.s.str.Recv()
+
+	switch {
+	case err != nil:
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		b.finish(err)
+
+	case rec.Aborted != "":
+		b.finish(fmt.Errorf("%w: %s", ErrBodyAborted, rec.Aborted))
+
+	default:
+		b.chunk = rec.Data
+		if !rec.More {
+			b.finish(io.EOF)
+		}
+	}
+}
+
+func (b *body) finish(err error) {
+	b.err = err
+
+	if b.release != nil {
+		b.release()
+		b.release = nil
+	}
+}
+
+// Close skips the rest of the body so that the next message can be received.
+func (b *body) Close() error {
+	b.chunk = nil
+
+	for b.err == nil {
+		b.next()
+		b.chunk = nil
+	}
+
+	b.finish(io.ErrClosedPipe)
+	return nil
+}
+
+// readBody reads the rest of a streamed body into msg.Data.
+func readBody(b *body, msg *transport.Message) error {
+	data, err := io.ReadAll(b)
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+
+	msg.Data = data
+	return nil
+}
@@ -0,0 +1,320 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MouseHatGames/mice/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// clientConns keeps the connections that streams are opened on. Since HTTP/2 multiplexes
+// streams, every address only gets a few connections, which are picked in turn for new streams.
+// Connections stay open for idle once their last stream is closed, so that the next exchange
+// with the same address doesn't have to connect again.
+type clientConns struct {
+	log  logger.Logger
+	size int
+	idle time.Duration
+	dial func(addr string) (*grpc.ClientConn, error)
+
+	// mu guards addrs, next and dialing, which holds a lock per address so that dialing one
+	// doesn't hold up the streams opened to the others.
+	mu      sync.Mutex
+	addrs   map[string][]*clientConn
+	next    map[string]int
+	dialing map[string]*addrLock
+	closed  bool
+}
+
+// addrLock is the lock of an address, along with the number of callers holding or waiting
+// for it.
+type addrLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	// errConnectionLost is returned when checking a stream whose connection dropped since it was opened.
+	errConnectionLost = errors.New("connection lost")
+
+	// errTransportClosed is returned when opening a stream after the transport was closed.
+	errTransportClosed = errors.New("transport closed")
+)
+
+// clientConn is a connection shared by the streams opened on it.
+type clientConn struct {
+	// drops counts how many times the connection went down, ending the streams open at the time.
+	drops uint64
+
+	*grpc.ClientConn
+	addr string
+
+	// streams is the number of open streams on the connection, idle closes it once it has had
+	// none for long enough, idleSeq tells the timers started each time apart. They're guarded
+	// by clientConns.mu.
+	streams int
+	idle    *time.Timer
+	idleSeq uint64
+}
+
+func newClientConns(log logger.Logger, size int, idle time.Duration, dial func(addr string) (*grpc.ClientConn, error)) *clientConns {
+	if size < 1 {
+		size = 1
+	}
+
+	return &clientConns{
+		log:     log,
+		size:    size,
+		idle:    idle,
+		dial:    dial,
+		addrs:   map[string][]*clientConn{},
+		next:    map[string]int{},
+		dialing: map[string]*addrLock{},
+	}
+}
+
+// acquire returns a connection to addr to open a stream on, dialing it if needed. The stream
+// must be handed back to release once it's closed.
+func (cs *clientConns) acquire(addr string) (*clientConn, error) {
+	unlock := cs.lockAddr(addr)
+	defer unlock()
+
+	cs.mu.Lock()
+	if cs.closed {
+		cs.mu.Unlock()
+		return nil, errTransportClosed
+	}
+
+	i := cs.next[addr]
+	cs.next[addr] = (i + 1) % cs.size
+
+	if c := cs.slots(addr)[i]; c != nil {
+		c.streams++
+		if c.idle != nil {
+			c.idle.Stop()
+			c.idle = nil
+		}
+		cs.mu.Unlock()
+		return c, nil
+	}
+
+	cs.mu.Unlock()
+
+	cs.log.Debugf("opening connection %d to %s", i, addr)
+
+	// Dialing doesn't block, the connection is established in the background
+	cc, err := cs.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &clientConn{ClientConn: cc, addr: addr, streams: 1}
+
+	// The slot can't have been filled in the meantime since only the holder of the address's
+	// lock does so, but the slots may have been dropped when another connection was closed.
+	cs.mu.Lock()
+	if cs.closed {
+		cs.mu.Unlock()
+		cc.Close()
+		return nil, errTransportClosed
+	}
+	cs.slots(addr)[i] = c
+	cs.mu.Unlock()
+
+	go cs.watch(c)
+
+	return c, nil
+}
+
+// slots returns the connections to addr, creating them if needed. cs.mu must be held.
+func (cs *clientConns) slots(addr string) []*clientConn {
+	conns, ok := cs.addrs[addr]
+	if !ok {
+		conns = make([]*clientConn, cs.size)
+		cs.addrs[addr] = conns
+	}
+
+	return conns
+}
+
+// lockAddr holds the lock of addr while picking or dialing a connection to it, returning the
+// function that releases it.
+func (cs *clientConns) lockAddr(addr string) (unlock func()) {
+	cs.mu.Lock()
+	l, ok := cs.dialing[addr]
+	if !ok {
+		l = &addrLock{}
+		cs.dialing[addr] = l
+	}
+	l.refs++
+	cs.mu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		cs.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(cs.dialing, addr)
+		}
+		cs.mu.Unlock()
+	}
+}
+
+func (c *clientConn) generation() uint64 {
+	return atomic.LoadUint64(&c.drops)
+}
+
+// check fails if the connection dropped since generation gen, and with it the streams opened then.
+func (c *clientConn) check(gen uint64) error {
+	if c.generation() != gen {
+		return errConnectionLost
+	}
+
+	return nil
+}
+
+// release is called when a stream opened on c is closed. c is closed once it has had no
+// streams for the idle timeout.
+func (cs *clientConns) release(c *clientConn) error {
+	cs.mu.Lock()
+
+	c.streams--
+	if c.streams > 0 {
+		cs.mu.Unlock()
+		return nil
+	}
+
+	if cs.closed {
+		// Closed along with the others already
+		cs.mu.Unlock()
+		return nil
+	}
+
+	if cs.idle > 0 {
+		c.idleSeq++
+		seq := c.idleSeq
+		c.idle = time.AfterFunc(cs.idle, func() { cs.expire(c, seq) })
+		cs.mu.Unlock()
+		return nil
+	}
+
+	cs.remove(c)
+	cs.mu.Unlock()
+
+	cs.log.Debugf("closing connection to %s", c.addr)
+	return c.Close()
+}
+
+// expire closes c if it has stayed unused since the idle timer seq was started.
+func (cs *clientConns) expire(c *clientConn, seq uint64) {
+	cs.mu.Lock()
+	if c.streams > 0 || c.idleSeq != seq || cs.closed {
+		// Picked again in the meantime
+		cs.mu.Unlock()
+		return
+	}
+	cs.remove(c)
+	cs.mu.Unlock()
+
+	cs.log.Debugf("closing idle connection to %s", c.addr)
+	c.Close()
+}
+
+// remove takes c out of the connections to its address. cs.mu must be held.
+func (cs *clientConns) remove(c *clientConn) {
+	conns := cs.addrs[c.addr]
+	used := false
+
+	for i, o := range conns {
+		if o == c {
+			conns[i] = nil
+		} else if o != nil {
+			used = true
+		}
+	}
+
+	if !used {
+		delete(cs.addrs, c.addr)
+		delete(cs.next, c.addr)
+	}
+}
+
+// close closes every connection, ending the streams open on them. No connection can be
+// acquired afterwards.
+func (cs *clientConns) close() error {
+	cs.mu.Lock()
+	cs.closed = true
+
+	var conns []*clientConn
+	for _, slots := range cs.addrs {
+		for _, c := range slots {
+			if c == nil {
+				continue
+			}
+			if c.idle != nil {
+				c.idle.Stop()
+			}
+			conns = append(conns, c)
+		}
+	}
+	cs.addrs = map[string][]*clientConn{}
+	cs.next = map[string]int{}
+	cs.mu.Unlock()
+
+	var err error
+	for _, c := range conns {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// watch logs the state changes of c until it's closed, counting the times it goes down. gRPC
+// reconnects on its own after a failure, but a connection that went idle, e.g. after the server
+// sent GOAWAY, is only brought back up by the next stream. It's reconnected right away instead
+// so that pooled streams don't have to wait for it.
+func (cs *clientConns) watch(c *clientConn) {
+	state := c.GetState()
+	connected := false
+
+	for {
+		switch state {
+		case connectivity.Idle:
+			c.Connect()
+
+		case connectivity.TransientFailure:
+			cs.log.Errorf("connection to %s failed, reconnecting", c.addr)
+
+		case connectivity.Shutdown:
+			return
+		}
+
+		if !c.WaitForStateChange(context.Background(), state) {
+			return
+		}
+
+		prev := state
+		state = c.GetState()
+
+		if prev == connectivity.Ready {
+			atomic.AddUint64(&c.drops, 1)
+		}
+
+		if state == connectivity.Ready && connected {
+			cs.log.Infof("reconnected to %s", c.addr)
+		} else {
+			cs.log.Debugf("connection to %s is %s", c.addr, state)
+		}
+		connected = connected || state == connectivity.Ready
+	}
+}
@@ -0,0 +1,252 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MouseHatGames/mice/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// countingDial returns a dial function for clientConns that connects through dialer,
+// counting the connections it opens.
+func countingDial(dialer grpc.DialOption, dials *int32) func(string) (*grpc.ClientConn, error) {
+	return func(addr string) (*grpc.ClientConn, error) {
+		atomic.AddInt32(dials, 1)
+		return grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), dialer)
+	}
+}
+
+func TestClientConns_Shared(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{})
+	go l.Accept(context.Background(), echo)
+
+	var dials int32
+	cs := newClientConns(logger.NewStdoutLogger(), 1, time.Minute, countingDial(dialer, &dials))
+	defer cs.close()
+
+	a, err := cs.acquire("bufconn")
+	require.Nil(t, err)
+	b, err := cs.acquire("bufconn")
+	require.Nil(t, err)
+
+	assert.Same(t, a, b)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials))
+
+	require.Nil(t, cs.release(a))
+	require.Nil(t, cs.release(b))
+
+	// The connection stays open without streams, and is used by the next one
+	assert.NotEqual(t, connectivity.Shutdown, b.GetState())
+
+	c, err := cs.acquire("bufconn")
+	require.Nil(t, err)
+	defer cs.release(c)
+
+	assert.Same(t, a, c)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials))
+}
+
+func TestClientConns_IdleTimeout(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{})
+	go l.Accept(context.Background(), echo)
+
+	var dials int32
+	cs := newClientConns(logger.NewStdoutLogger(), 1, 50*time.Millisecond, countingDial(dialer, &dials))
+	defer cs.close()
+
+	a, err := cs.acquire("bufconn")
+	require.Nil(t, err)
+	require.Nil(t, cs.release(a))
+
+	require.Eventually(t, func() bool { return a.GetState() == connectivity.Shutdown }, time.Second, 5*time.Millisecond)
+
+	b, err := cs.acquire("bufconn")
+	require.Nil(t, err)
+	defer cs.release(b)
+
+	assert.NotSame(t, a, b)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&dials))
+
+	// Connections with streams aren't closed however long they're used
+	time.Sleep(100 * time.Millisecond)
+	assert.NotEqual(t, connectivity.Shutdown, b.GetState())
+}
+
+func TestClientConns_Close(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{})
+	go l.Accept(context.Background(), echo)
+
+	var dials int32
+	cs := newClientConns(logger.NewStdoutLogger(), 2, time.Minute, countingDial(dialer, &dials))
+
+	a, err := cs.acquire("bufconn")
+	require.Nil(t, err)
+	b, err := cs.acquire("bufconn")
+	require.Nil(t, err)
+	require.Nil(t, cs.release(b))
+
+	require.Nil(t, cs.close())
+
+	assert.Equal(t, connectivity.Shutdown, a.GetState())
+	assert.Equal(t, connectivity.Shutdown, b.GetState())
+	assert.Nil(t, cs.release(a))
+
+	_, err = cs.acquire("bufconn")
+	assert.Equal(t, errTransportClosed, err)
+}
+
+func TestClientConns_RoundRobin(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{})
+	go l.Accept(context.Background(), echo)
+
+	var dials int32
+	cs := newClientConns(logger.NewStdoutLogger(), 2, 0, countingDial(dialer, &dials))
+
+	var conns []*clientConn
+	for i := 0; i < 4; i++ {
+		c, err := cs.acquire("bufconn")
+		require.Nil(t, err)
+		conns = append(conns, c)
+	}
+
+	assert.NotSame(t, conns[0], conns[1])
+	assert.Same(t, conns[0], conns[2])
+	assert.Same(t, conns[1], conns[3])
+	assert.EqualValues(t, 2, atomic.LoadInt32(&dials))
+
+	// closing every stream on one connection leaves the other one up
+	require.Nil(t, cs.release(conns[0]))
+	require.Nil(t, cs.release(conns[2]))
+	assert.Equal(t, connectivity.Shutdown, conns[0].GetState())
+	assert.NotEqual(t, connectivity.Shutdown, conns[1].GetState())
+
+	require.Nil(t, cs.release(conns[1]))
+	require.Nil(t, cs.release(conns[3]))
+	assert.Empty(t, cs.addrs)
+}
+
+func TestClientConns_DialError(t *testing.T) {
+	errDial := errors.New("dial failed")
+
+	var dials int32
+	cs := newClientConns(logger.NewStdoutLogger(), 1, 0, func(string) (*grpc.ClientConn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errDial
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := cs.acquire("bufconn")
+		assert.ErrorIs(t, err, errDial)
+	}
+
+	assert.EqualValues(t, 2, atomic.LoadInt32(&dials), "failed dials aren't kept")
+}
+
+func TestClientConns_Reconnect(t *testing.T) {
+	var current atomic.Value
+
+	serve := func() *grpcListener {
+		lis := bufconn.Listen(1 << 20)
+		l := newTestTransport(&grpcOptions{}).newListener(lis)
+		t.Cleanup(func() { l.Close() })
+
+		go l.Accept(context.Background(), echo)
+		current.Store(lis)
+
+		return l
+	}
+
+	first := serve()
+	dialer := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return current.Load().(*bufconn.Listener).DialContext(ctx)
+	})
+
+	var dials int32
+	cs := newClientConns(logger.NewStdoutLogger(), 1, 0, countingDial(dialer, &dials))
+
+	c, err := cs.acquire("bufconn")
+	require.Nil(t, err)
+	defer cs.release(c)
+
+	require.Eventually(t, func() bool { return c.GetState() == connectivity.Ready }, 5*time.Second, 10*time.Millisecond)
+
+	gen := c.generation()
+	require.Nil(t, c.check(gen))
+
+	serve()
+	first.Close()
+
+	require.Eventually(t, func() bool { return c.check(gen) != nil }, 5*time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, c.check(gen), errConnectionLost)
+
+	// the connection comes back up by itself, without waiting for a stream to be opened on it
+	require.Eventually(t, func() bool { return c.GetState() == connectivity.Ready }, 5*time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials))
+
+	again, err := cs.acquire("bufconn")
+	require.Nil(t, err)
+	defer cs.release(again)
+
+	assert.Same(t, c, again)
+}
+
+func TestClientConns_SlowDialDoesntBlockOthers(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{})
+	go l.Accept(context.Background(), echo)
+
+	var dials int32
+	dial := countingDial(dialer, &dials)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	cs := newClientConns(logger.NewStdoutLogger(), 1, 0, func(addr string) (*grpc.ClientConn, error) {
+		if addr == "slow" {
+			close(started)
+			<-release
+		}
+		return dial(addr)
+	})
+
+	fast, err := cs.acquire("bufconn")
+	require.Nil(t, err)
+	defer cs.release(fast)
+
+	slow := make(chan *clientConn)
+	go func() {
+		c, err := cs.acquire("slow")
+		assert.Nil(t, err)
+		slow <- c
+	}()
+
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		c, err := cs.acquire("bufconn")
+		assert.Nil(t, err)
+		assert.Same(t, fast, c)
+		assert.Nil(t, cs.release(c))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("acquiring a connection to another address waited for the slow dial")
+	}
+
+	close(release)
+
+	c := <-slow
+	assert.Nil(t, cs.release(c))
+}
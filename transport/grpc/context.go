@@ -0,0 +1,95 @@
+package grpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The caller's deadline reaches the server with each exchange. Unary calls are made with the
+// caller's context, which gRPC sends as the grpc-timeout of the call. Streams outlive a single
+// exchange, since they're pooled, so every message sent on them carries how long the caller
+// waits for its answer instead, and the server applies it to the exchange the message starts.
+// A client that gives up while waiting on a stream ends it, cancelling its context on the server
+// too.
+
+// ContextSocket is implemented by the sockets accepted by the listener. Type assert a socket to
+// it to know how long the client is willing to wait and when it gives up.
+type ContextSocket interface {
+	// Context returns the context of the current exchange: the call the socket was accepted for,
+	// or the last message received on its stream. It has the client's deadline for that exchange,
+	// if any, and is done once the client gives up or the socket is closed.
+	Context() context.Context
+}
+
+var (
+	_ ContextSocket = (*grpcServerSocket)(nil)
+	_ ContextSocket = (*unarySocket)(nil)
+)
+
+// timeout returns how long, in nanoseconds, the message sent with ctx waits for its answer, or
+// zero if it has no deadline or the socket doesn't send timeouts.
+func (s *grpcSocket) timeout(ctx context.Context) int64 {
+	deadline, ok := ctx.Deadline()
+	if !s.timeouts || !ok {
+		return 0
+	}
+
+	if d := time.Until(deadline); d > 0 {
+		return int64(d)
+	}
+
+	// Zero would mean no deadline at all
+	return 1
+}
+
+// watchContext calls abort if ctx is done before the returned function is called, and never
+// once it has been. The function reports whether abort was called.
+func watchContext(ctx context.Context, abort func()) func() bool {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	var (
+		mu                sync.Mutex
+		finished, aborted bool
+	)
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !finished {
+				aborted = true
+				abort()
+			}
+			mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	return func() bool {
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+
+		close(stop)
+		return aborted
+	}
+}
+
+// withContext ends the socket's stream if ctx is done before the returned function is called
+// with the result of the operation, since gRPC can't interrupt a single send or receive
+// otherwise. An operation that failed because the stream was ended returns ctx's error instead.
+func (s *grpcSocket) withContext(ctx context.Context) func(error) error {
+	stop := watchContext(ctx, func() { s.abort(ctx.Err()) })
+
+	return func(err error) error {
+		if stop() && err != nil {
+			return ctx.Err()
+		}
+
+		return err
+	}
+}
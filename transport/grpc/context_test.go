@@ -0,0 +1,256 @@
+package grpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// exchangeContexts hands the context of every exchange to ctxs, along with the message received.
+func exchangeContexts(ctxs chan<- context.Context, msgs chan<- *transport.Message) func(transport.Socket) {
+	return func(s transport.Socket) {
+		go func() {
+			defer s.Close()
+
+			for {
+				var msg transport.Message
+				if err := s.Receive(context.Background(), &msg); err != nil {
+					return
+				}
+
+				ctxs <- s.(ContextSocket).Context()
+				msgs <- &msg
+
+				if err := s.Send(context.Background(), &msg); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestContext_Deadline(t *testing.T) {
+	for _, unary := range []bool{false, true} {
+		ctxs, msgs := make(chan context.Context, 1), make(chan *transport.Message, 1)
+
+		l, dialer := listenInProcess(t, &grpcOptions{})
+		go l.Accept(context.Background(), exchangeContexts(ctxs, msgs))
+
+		client := newTestTransport(&grpcOptions{
+			UnaryCalls:         unary,
+			MaxIdleConnections: 1,
+			DialOptions:        []grpc.DialOption{dialer},
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		want, _ := ctx.Deadline()
+
+		s, err := client.Dial(ctx, "bufconn")
+		require.Nil(t, err)
+
+		headers := map[string]string{"a": "1"}
+		require.Nil(t, s.Send(ctx, &transport.Message{MessageHeaders: headers}))
+
+		got, ok := (<-ctxs).Deadline()
+		require.True(t, ok, "unary: %v", unary)
+		assert.WithinDuration(t, want, got, time.Second)
+
+		// The deadline isn't sent as a header
+		assert.Equal(t, map[string]string{"a": "1"}, (<-msgs).MessageHeaders)
+
+		var rec transport.Message
+		require.Nil(t, s.Receive(ctx, &rec))
+		require.Nil(t, s.Close())
+
+		// The stream is pooled all the same
+		if !unary {
+			assert.Equal(t, 1, client.PoolStats()["bufconn"].Idle)
+		}
+
+		// Exchanges without a deadline don't get one, even on the same stream
+		s, err = client.Dial(context.Background(), "bufconn")
+		require.Nil(t, err)
+		defer s.Close()
+
+		require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+
+		_, ok = (<-ctxs).Deadline()
+		assert.False(t, ok, "unary: %v", unary)
+		<-msgs
+	}
+}
+
+func TestContext_DeadlineReusesConnection(t *testing.T) {
+	modes := map[string]*grpcOptions{
+		"Pooled":   {MaxIdleConnections: 1},
+		"Metadata": {MetadataHeaders: true},
+		"Unary":    {UnaryCalls: true},
+	}
+
+	for name, opts := range modes {
+		t.Run(name, func(t *testing.T) {
+			ctxs, msgs := make(chan context.Context, 1), make(chan *transport.Message, 1)
+
+			lis := bufconn.Listen(1 << 20)
+			var calls, streams int32
+			l := newTestTransport(&grpcOptions{ServerOptions: countCalls(&calls, &streams)}).newListener(lis)
+			defer l.Close()
+			go l.Accept(context.Background(), exchangeContexts(ctxs, msgs))
+
+			var dials int32
+			opts.ConnIdleTimeout = DefaultConnectionIdleTimeout
+			opts.DialOptions = []grpc.DialOption{grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				return lis.DialContext(ctx)
+			})}
+
+			client := newTestTransport(opts)
+			defer client.Close()
+
+			for i := 0; i < 10; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+				s, err := client.Dial(ctx, "bufconn")
+				require.Nil(t, err)
+				require.Nil(t, s.Send(ctx, &transport.Message{}))
+
+				_, ok := (<-ctxs).Deadline()
+				assert.True(t, ok)
+				<-msgs
+
+				var rec transport.Message
+				require.Nil(t, s.Receive(ctx, &rec))
+				require.Nil(t, s.Close())
+
+				cancel()
+			}
+
+			assert.EqualValues(t, 1, atomic.LoadInt32(&dials))
+
+			if name == "Pooled" {
+				// Every exchange went through the same stream
+				assert.EqualValues(t, 1, atomic.LoadInt32(&streams))
+			}
+		})
+	}
+}
+
+func TestContext_Cancel(t *testing.T) {
+	ctxs := make(chan context.Context, 1)
+
+	l, dialer := listenInProcess(t, &grpcOptions{})
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		go func() {
+			defer s.Close()
+
+			var msg transport.Message
+			if err := s.Receive(context.Background(), &msg); err != nil {
+				return
+			}
+
+			// Never answer, keeping the stream open until the client gives up
+			ctx := s.(ContextSocket).Context()
+			ctxs <- ctx
+			<-ctx.Done()
+		}()
+	})
+
+	s := dialTestSocket(t, dialer)
+	require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	var rec transport.Message
+	assert.Equal(t, context.Canceled, s.Receive(ctx, &rec))
+
+	// The server sees the client give up
+	select {
+	case <-(<-ctxs).Done():
+	case <-time.After(time.Second):
+		t.Fatal("exchange not cancelled on the server")
+	}
+
+	// The stream can't be pooled anymore
+	assert.Equal(t, errStreamAborted, s.(*grpcClientSocket).check())
+
+	// Sending on a context that's done fails right away
+	assert.Equal(t, context.Canceled, s.Send(ctx, &transport.Message{}))
+}
+
+func TestContext_DialStream(t *testing.T) {
+	// The connection never comes up, so opening a stream waits for it
+	dialer := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	client := newTestTransport(&grpcOptions{DialOptions: []grpc.DialOption{dialer}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Dial(ctx, "bufconn")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("opening a pooled stream ignored the caller's context")
+	}
+}
+
+func TestWatchContext(t *testing.T) {
+	var aborts int32
+	abort := func() { atomic.AddInt32(&aborts, 1) }
+
+	// Nothing is aborted once the operation is over, even if ctx is done right after
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := watchContext(ctx, abort)
+	assert.False(t, stop())
+	cancel()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(&aborts))
+
+	// An operation still going on when ctx is done is aborted
+	ctx, cancel = context.WithCancel(context.Background())
+	stop = watchContext(ctx, abort)
+	cancel()
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&aborts) == 1 }, time.Second, time.Millisecond)
+	assert.True(t, stop())
+}
+
+func TestWithContext_Succeeded(t *testing.T) {
+	aborted := make(chan error, 2)
+
+	s := newSocket(nil)
+	s.abort = func(err error) { aborted <- err }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := s.withContext(ctx)
+	cancel()
+
+	// An operation that went through isn't failed by ctx being done by the time it returns
+	<-aborted
+	assert.Nil(t, done(nil))
+
+	// The ones that failed return ctx's error if the stream was ended because of it
+	done = s.withContext(ctx)
+	<-aborted
+	assert.Equal(t, context.Canceled, done(io.EOF))
+}
@@ -4,9 +4,12 @@ go 1.15
 
 require (
 	github.com/MouseHatGames/mice v1.2.9-0.20230506193607-c7d017a7d2cc
+	github.com/MouseHatGames/mice-plugins/transport/dialer v0.0.0
+	github.com/MouseHatGames/mice-plugins/transport/pool v0.0.0
+	github.com/MouseHatGames/mice-plugins/transport/portmux v0.0.0
 	github.com/golang/protobuf v1.5.2
 	github.com/opentracing/opentracing-go v1.2.0 // indirect
-	github.com/silenceper/pool v1.0.0
+	github.com/stretchr/testify v1.7.1
 	go.opentelemetry.io/otel/exporters/jaeger v1.9.0 // indirect
 	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.9.0 // indirect
 	go.opentelemetry.io/proto/otlp v0.19.0 // indirect
@@ -14,3 +17,9 @@ require (
 	google.golang.org/grpc v1.46.2
 	google.golang.org/protobuf v1.28.1
 )
+
+replace github.com/MouseHatGames/mice-plugins/transport/dialer => ../dialer
+
+replace github.com/MouseHatGames/mice-plugins/transport/pool => ../pool
+
+replace github.com/MouseHatGames/mice-plugins/transport/portmux => ../portmux
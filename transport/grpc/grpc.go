@@ -2,16 +2,24 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/MouseHatGames/mice-plugins/transport/grpc/internal"
+	"github.com/MouseHatGames/mice-plugins/transport/pool"
+	"github.com/MouseHatGames/mice-plugins/transport/portmux"
 	"github.com/MouseHatGames/mice/logger"
 	"github.com/MouseHatGames/mice/options"
 	"github.com/MouseHatGames/mice/transport"
-	"github.com/silenceper/pool"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 type stream interface {
@@ -22,93 +30,251 @@ type stream interface {
 type grpcTransport struct {
 	addr  string
 	log   logger.Logger
-	pools map[string]pool.Pool
+	pools *pool.Pools
+	conns *clientConns
+	opts  *grpcOptions
+
+	// noCalls holds the addresses of servers that don't support unary calls.
+	mu      sync.Mutex
+	noCalls map[string]bool
 }
 
-func Transport() options.Option {
+var _ pool.Observable = (*grpcTransport)(nil)
+
+func Transport(opts ...Option) options.Option {
+	grpcOpts := &grpcOptions{
+		MaxIdleConnections:   DefaultMaxIdleConnections,
+		MaxActiveConnections: DefaultMaxActiveConnections,
+		IdleTimeout:          DefaultIdleTimeout,
+		PingTimeout:          DefaultPingTimeout,
+		PoolEvictAfter:       pool.DefaultEvictAfter,
+		ConnectionsPerAddr:   DefaultConnectionsPerAddress,
+		ConnIdleTimeout:      DefaultConnectionIdleTimeout,
+		DrainTimeout:         DefaultDrainTimeout,
+		UnaryCalls:           true,
+	}
+
+	for _, o := range opts {
+		o(grpcOpts)
+	}
+
 	return func(o *options.Options) {
-		o.Transport = &grpcTransport{
-			log:   o.Logger.GetLogger("grpc"),
-			pools: make(map[string]pool.Pool),
+		t := &grpcTransport{
+			log:  o.Logger.GetLogger("grpc"),
+			opts: grpcOpts,
 		}
+		t.pools = t.newPools()
+		t.conns = newClientConns(t.log, grpcOpts.ConnectionsPerAddr, grpcOpts.ConnIdleTimeout, t.dial)
+
+		o.Transport = t
 	}
 }
 
 func (t *grpcTransport) Listen(ctx context.Context, addr string) (transport.Listener, error) {
-	lis, err := net.Listen("tcp", addr)
+	var lis net.Listener
+	var err error
+
+	if t.opts.SharedPort && t.opts.ServerTLS != nil {
+		// Connections are told apart by their first bytes, which TLS hides
+		return nil, errors.New("a shared port can't be used with tls")
+	}
+
+	if t.opts.SharedPort {
+		lis, err = portmux.Listen("tcp", addr, portmux.GRPC)
+	} else {
+		lis, err = net.Listen("tcp", addr)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to open tcp listener: %w", err)
 	}
 
-	srv := grpc.NewServer()
+	return t.newListener(lis), nil
+}
 
-	t.log.Infof("listening on %s", lis.Addr().String())
+// newListener creates a server that accepts connections from lis once Accept is called.
+func (t *grpcTransport) newListener(lis net.Listener) *grpcListener {
+	var srvOpts []grpc.ServerOption
+	if t.opts.ServerTLS != nil {
+		srvOpts = append(srvOpts, grpc.Creds(credentials.NewTLS(t.opts.ServerTLS)))
+	}
+	srvOpts = append(srvOpts, t.opts.ServerOptions...)
+
+	srv := grpc.NewServer(srvOpts...)
+
+	if t.opts.ServerTLS != nil {
+		t.log.Infof("listening on %s with tls", lis.Addr().String())
+	} else {
+		t.log.Infof("listening on %s", lis.Addr().String())
+	}
 
-	return &grpcListener{
+	l := &grpcListener{
 		srv: srv,
 		tcp: lis,
 		log: t.log,
-	}, nil
+
+		drainTimeout: t.opts.DrainTimeout,
+		draining:     make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+
+	if t.opts.HealthCheck {
+		l.health = health.NewServer()
+		l.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+
+		healthpb.RegisterHealthServer(srv, l.health)
+	}
+
+	if t.opts.Reflection {
+		reflection.Register(srv)
+	}
+
+	return l
 }
 
+// createStream opens a stream to addr, giving up if ctx is done first.
 func (t *grpcTransport) createStream(ctx context.Context, addr string) (*grpcClientSocket, error) {
 	t.log.Debugf("create stream to %s", addr)
 
-	c, err := grpc.DialContext(ctx, addr, grpc.WithInsecure())
+	c, err := t.conns.acquire(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newClientSocket(ctx, c)
+	if err != nil {
+		t.conns.release(c)
+		return nil, err
+	}
+
+	s.release = t.conns.release
+	return s, nil
+}
+
+// openStream returns a socket whose stream is opened once the first message is sent, with its
+// headers as metadata.
+func (t *grpcTransport) openStream(addr string) (*grpcClientSocket, error) {
+	c, err := t.conns.acquire(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMetadataSocket(c, t.conns.release), nil
+}
+
+// dial opens a connection to addr that streams can be opened on.
+func (t *grpcTransport) dial(addr string) (*grpc.ClientConn, error) {
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(t.credentials(addr))}
+
+	if d := t.opts.Dialer; d != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}))
+	}
+
+	dialOpts = append(dialOpts, t.opts.DialOptions...)
+
+	c, err := grpc.Dial(addr, dialOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("grpc dial: %w", err)
 	}
 
-	return newClientSocket(ctx, c, func(o interface{}) error {
-		return t.getPool(addr).Put(o)
-	})
+	return c, nil
 }
 
-func (t *grpcTransport) getPool(addr string) pool.Pool {
-	p, ok := t.pools[addr]
-	if !ok {
-		var err error
-		p, err = pool.NewChannelPool(&pool.Config{
-			InitialCap:  3,
-			MaxIdle:     10,
-			MaxCap:      15,
-			IdleTimeout: 15 * time.Second,
-			Factory: func() (interface{}, error) {
-				t.log.Debugf("pool instantiating stream to %s", addr)
-				return t.createStream(context.Background(), addr)
-			},
-			Close: func(o interface{}) error {
-				t.log.Debugf("pool closing stream to %s", addr)
-				return o.(*grpcClientSocket).CloseConn()
-			},
-			Ping: func(o interface{}) error {
-				_, err := o.(*grpcClientSocket).tr.Ping(context.Background(), &internal.Empty{})
-				if err != nil {
-					t.log.Errorf("ping to %s failed: %s", addr, err)
-				}
-				return err
-			},
-		})
-		if err != nil {
-			panic(err)
-		}
+// credentials returns the transport credentials used to connect to addr.
+func (t *grpcTransport) credentials(addr string) credentials.TransportCredentials {
+	if t.opts.ClientTLS == nil {
+		return insecure.NewCredentials()
+	}
 
-		t.pools[addr] = p
+	cfg := t.opts.ClientTLS
+	if name, ok := t.opts.ServerNames[addr]; ok {
+		cfg = cfg.Clone()
+		cfg.ServerName = name
 	}
 
-	return p
+	return credentials.NewTLS(cfg)
+}
+
+func (t *grpcTransport) newPools() *pool.Pools {
+	return pool.New(pool.Config{
+		MaxIdle:     t.opts.MaxIdleConnections,
+		MaxActive:   t.opts.MaxActiveConnections,
+		IdleTimeout: t.opts.IdleTimeout,
+		EvictAfter:  t.opts.PoolEvictAfter,
+		Dial: func(ctx context.Context, addr string) (interface{}, error) {
+			t.log.Debugf("pool instantiating stream to %s", addr)
+
+			// The stream outlives the call to Dial that created it, only opening it is bounded
+			return t.createStream(ctx, addr)
+		},
+		Close: func(o interface{}) error {
+			t.log.Debugf("pool closing stream to %s", o.(*grpcClientSocket).c.Target())
+			return o.(*grpcClientSocket).CloseConn()
+		},
+		Ping: func(o interface{}) error {
+			s := o.(*grpcClientSocket)
+
+			if err := s.check(); err != nil {
+				t.log.Debugf("stream to %s is gone: %s", s.c.Target(), err)
+				return err
+			}
+
+			ctx := context.Background()
+			if t.opts.PingTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, t.opts.PingTimeout)
+				defer cancel()
+			}
+
+			_, err := s.tr.Ping(ctx, &internal.Empty{})
+			if err != nil {
+				t.log.Errorf("ping to %s failed: %s", s.c.Target(), err)
+			}
+			return err
+		},
+	})
 }
 
 func (t *grpcTransport) Dial(ctx context.Context, addr string) (transport.Socket, error) {
 	t.log.Debugf("dialing %s", addr)
 
-	p := t.getPool(addr)
-	s, err := p.Get()
+	if t.opts.UnaryCalls && t.callable(addr) {
+		return t.newCallSocket(addr)
+	}
+
+	return t.dialStream(ctx, addr)
+}
+
+// dialStream returns a socket with a stream to addr.
+func (t *grpcTransport) dialStream(ctx context.Context, addr string) (*grpcClientSocket, error) {
+	if t.opts.MetadataHeaders {
+		// The headers are sent when the stream is opened, so it can't be reused
+		return t.openStream(addr)
+	}
+
+	p := t.pools.Pool(addr)
+	s, err := p.Get(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("get socket: %w", err)
 	}
 
-	return s.(*grpcClientSocket), nil
+	soc := s.(*grpcClientSocket)
+	soc.pool = p
+
+	return soc, nil
+}
+
+// Close closes the pooled streams and every connection opened to other servers, ending the
+// streams still in use. Dial fails from then on.
+func (t *grpcTransport) Close() error {
+	t.pools.Close()
+	return t.conns.close()
+}
+
+// PoolStats returns the stats of the stream pool of every address that has been dialed.
+func (t *grpcTransport) PoolStats() map[string]pool.Stats {
+	return t.pools.Stats()
 }
 
 type grpcListener struct {
@@ -116,25 +282,88 @@ type grpcListener struct {
 
 	srv *grpc.Server
 	tcp net.Listener
+
+	// health reports whether the server is serving, if enabled with HealthCheck.
+	health *health.Server
+
+	// drainTimeout is how long Close waits for streams to finish before ending them.
+	drainTimeout time.Duration
+
+	// draining is closed when Close starts, closed once it has stopped the server.
+	draining, closed chan struct{}
+	closeOnce        sync.Once
 }
 
+// Close stops accepting connections and waits for the streams that are in the middle of an
+// exchange to finish, up to the drain timeout, before closing the remaining ones.
 func (l *grpcListener) Close() error {
-	l.srv.Stop()
+	l.closeOnce.Do(func() {
+		defer close(l.closed)
+
+		if l.health != nil {
+			l.health.Shutdown()
+		}
+
+		close(l.draining)
+
+		if l.drainTimeout <= 0 {
+			l.srv.Stop()
+			return
+		}
+
+		l.log.Debugf("draining streams")
+
+		stopped := make(chan struct{})
+		go func() {
+			l.srv.GracefulStop()
+			close(stopped)
+		}()
+
+		timer := time.NewTimer(l.drainTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-stopped:
+		case <-timer.C:
+			l.log.Infof("streams still open after %s, closing them", l.drainTimeout)
+			l.srv.Stop()
+			<-stopped
+		}
+	})
+
 	return nil
 }
 
+// Accept serves connections until the listener is closed, which happens when ctx is done too.
 func (l *grpcListener) Accept(ctx context.Context, fn func(transport.Socket)) error {
 	internal.RegisterTransportServer(l.srv, &server{
 		callback: fn,
 		log:      l.log,
+		draining: l.draining,
 	})
 
 	l.log.Debugf("accepting connections")
 
+	l.SetServing(true)
+
+	served := make(chan struct{})
+	defer close(served)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-served:
+		}
+	}()
+
 	if err := l.srv.Serve(l.tcp); err != nil {
 		l.log.Errorf("failed to serve grpc: %w", err)
 		return fmt.Errorf("serve grpc: %w", err)
 	}
+
+	// Serve only returns early once the listener is being closed, wait for the drain
+	<-l.closed
 	return nil
 }
 
@@ -142,6 +371,9 @@ type server struct {
 	internal.UnimplementedTransportServer
 	callback func(transport.Socket)
 	log      logger.Logger
+
+	// draining is closed when the listener starts closing.
+	draining <-chan struct{}
 }
 
 func (*server) Ping(context.Context, *internal.Empty) (*internal.Empty, error) {
@@ -149,11 +381,35 @@ func (*server) Ping(context.Context, *internal.Empty) (*internal.Empty, error) {
 }
 
 func (sv *server) Stream(s internal.Transport_StreamServer) error {
-	soc := newServerSocket(s)
+	soc := newServerSocket(s.Context(), newServerStream(s))
 
 	sv.callback(soc)
 
-	// Don't close the stream until the socket is closed
-	<-soc.done
+	// Don't close the stream until the socket is closed, the client went away, or the listener
+	// is closing and the socket has answered every message it received
+	select {
+	case v := <-soc.done:
+		return streamError(v)
+	case <-s.Context().Done():
+		return nil
+	case <-sv.draining:
+	}
+
+	select {
+	case v := <-soc.done:
+		return streamError(v)
+	case <-s.Context().Done():
+		return nil
+	case <-soc.idle():
+		return nil
+	}
+}
+
+// streamError returns the error a stream ends with for the value its socket was closed with.
+func streamError(v interface{}) error {
+	if err, ok := v.(error); ok && err != nil {
+		return Status(err).Err()
+	}
+
 	return nil
 }
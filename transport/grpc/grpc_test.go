@@ -0,0 +1,178 @@
+package grpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// dialTestSocket opens a socket to the in-process listener.
+func dialTestSocket(t *testing.T, dialer grpc.DialOption) transport.Socket {
+	s, err := newTestTransport(&grpcOptions{DialOptions: []grpc.DialOption{dialer}}).Dial(context.Background(), "bufconn")
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// answerAfter answers every message it receives after waiting for release to be closed.
+func answerAfter(received chan<- struct{}, release <-chan struct{}) func(transport.Socket) {
+	return func(s transport.Socket) {
+		go func() {
+			defer s.Close()
+
+			for {
+				var msg transport.Message
+				if err := s.Receive(context.Background(), &msg); err != nil {
+					return
+				}
+
+				received <- struct{}{}
+				<-release
+
+				if err := s.Send(context.Background(), &msg); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestClose_DrainsInFlightExchanges(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+
+	l, dialer := listenInProcess(t, &grpcOptions{DrainTimeout: 5 * time.Second})
+	go l.Accept(context.Background(), answerAfter(received, release))
+
+	s := dialTestSocket(t, dialer)
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+	<-received
+
+	closed := make(chan struct{})
+	go func() {
+		l.Close()
+		close(closed)
+	}()
+
+	// The listener waits for the answer
+	select {
+	case <-closed:
+		t.Fatal("listener closed before the exchange finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+	assert.Equal(t, []byte("hello"), rec.Data)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("listener not closed once the exchange finished")
+	}
+}
+
+func TestClose_IdleStreams(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{DrainTimeout: 5 * time.Second})
+	go l.Accept(context.Background(), echo)
+
+	// The stream stays open, but doesn't hold up the listener since it's done with its exchange
+	s := dialTestSocket(t, dialer)
+	require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+
+	start := time.Now()
+	l.Close()
+	assert.Less(t, time.Since(start), time.Second)
+
+	assert.NotNil(t, s.Receive(context.Background(), &rec))
+}
+
+func TestClose_DrainTimeout(t *testing.T) {
+	received := make(chan struct{}, 1)
+
+	l, dialer := listenInProcess(t, &grpcOptions{DrainTimeout: 100 * time.Millisecond})
+	go l.Accept(context.Background(), answerAfter(received, make(chan struct{})))
+
+	s := dialTestSocket(t, dialer)
+	require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+	<-received
+
+	start := time.Now()
+	l.Close()
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The stream was ended without an answer
+	var rec transport.Message
+	assert.NotNil(t, s.Receive(context.Background(), &rec))
+}
+
+func TestAccept_ContextDone(t *testing.T) {
+	l, _ := listenInProcess(t, &grpcOptions{DrainTimeout: time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- l.Accept(ctx, echo) }()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Accept didn't return")
+	}
+}
+
+func TestPool_PingTimeout(t *testing.T) {
+	blocked := make(chan struct{})
+	defer close(blocked)
+
+	// Pings are the only unary calls made, the server never answers them
+	l, dialer := listenInProcess(t, &grpcOptions{ServerOptions: []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			select {
+			case <-blocked:
+			case <-ctx.Done():
+			}
+			return handler(ctx, req)
+		}),
+	}})
+	go l.Accept(context.Background(), echo)
+
+	client := newTestTransport(&grpcOptions{
+		MaxIdleConnections: 1,
+		PingTimeout:        50 * time.Millisecond,
+		DialOptions:        []grpc.DialOption{dialer},
+	})
+
+	s, err := client.Dial(context.Background(), "bufconn")
+	require.Nil(t, err)
+	first := s.(*grpcClientSocket)
+	require.Nil(t, s.Close())
+
+	done := make(chan transport.Socket, 1)
+	go func() {
+		s, err := client.Dial(context.Background(), "bufconn")
+		require.Nil(t, err)
+		done <- s
+	}()
+
+	select {
+	case s := <-done:
+		defer s.Close()
+		assert.NotSame(t, first, s)
+	case <-time.After(time.Second):
+		t.Fatal("Dial held up by a ping that isn't answered")
+	}
+}
@@ -0,0 +1,36 @@
+package grpc
+
+import healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+// transportService is the name of the gRPC service messages are exchanged on, as declared in
+// internal/transport.proto.
+const transportService = "Transport"
+
+// HealthReporter is implemented by the listeners of this transport. Type assert a listener to it
+// to change what the health service reports, e.g. while the service is warming up or draining.
+type HealthReporter interface {
+	// SetServing sets whether the server reports itself as serving, both for the server as a
+	// whole and for the service messages are exchanged on. It does nothing unless the
+	// HealthCheck option is enabled.
+	SetServing(serving bool)
+}
+
+var _ HealthReporter = (*grpcListener)(nil)
+
+func (l *grpcListener) SetServing(serving bool) {
+	if l.health == nil {
+		return
+	}
+
+	if serving {
+		l.setStatus(healthpb.HealthCheckResponse_SERVING)
+	} else {
+		l.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+func (l *grpcListener) setStatus(status healthpb.HealthCheckResponse_ServingStatus) {
+	// An empty name stands for the whole server
+	l.health.SetServingStatus("", status)
+	l.health.SetServingStatus(transportService, status)
+}
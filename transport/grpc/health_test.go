@@ -0,0 +1,109 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/MouseHatGames/mice/logger"
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestTransport(opts *grpcOptions) *grpcTransport {
+	t := &grpcTransport{
+		log:  logger.NewStdoutLogger(),
+		opts: opts,
+	}
+	t.pools = t.newPools()
+	t.conns = newClientConns(t.log, 1, opts.ConnIdleTimeout, t.dial)
+
+	return t
+}
+
+// listenInProcess creates a listener that accepts connections through the returned dial option only.
+func listenInProcess(t *testing.T, opts *grpcOptions) (*grpcListener, grpc.DialOption) {
+	lis := bufconn.Listen(1 << 20)
+	l := newTestTransport(opts).newListener(lis)
+	t.Cleanup(func() { l.Close() })
+
+	return l, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})
+}
+
+func dialInProcess(t *testing.T, dialer grpc.DialOption) *grpc.ClientConn {
+	c, err := grpc.Dial("bufconn", grpc.WithTransportCredentials(insecure.NewCredentials()), dialer)
+	require.Nil(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func checkHealth(t *testing.T, c *grpc.ClientConn, service string) healthpb.HealthCheckResponse_ServingStatus {
+	res, err := healthpb.NewHealthClient(c).Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	require.Nil(t, err)
+
+	return res.Status
+}
+
+func TestHealthCheck(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{HealthCheck: true})
+	c := dialInProcess(t, dialer)
+
+	go l.Accept(context.Background(), func(transport.Socket) {})
+
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, checkHealth(t, c, ""))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, checkHealth(t, c, transportService))
+
+	l.SetServing(false)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, checkHealth(t, c, ""))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, checkHealth(t, c, transportService))
+
+	_, err := healthpb.NewHealthClient(c).Check(context.Background(), &healthpb.HealthCheckRequest{Service: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestHealthCheck_Disabled(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{})
+	c := dialInProcess(t, dialer)
+	go l.Accept(context.Background(), func(transport.Socket) {})
+
+	// Does nothing without the health service
+	l.SetServing(false)
+
+	_, err := healthpb.NewHealthClient(c).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestReflection(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{HealthCheck: true, Reflection: true})
+	c := dialInProcess(t, dialer)
+	go l.Accept(context.Background(), func(transport.Socket) {})
+
+	str, err := reflectionpb.NewServerReflectionClient(c).ServerReflectionInfo(context.Background())
+	require.Nil(t, err)
+
+	require.Nil(t, str.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}))
+
+	res, err := str.Recv()
+	require.Nil(t, err)
+
+	var services []string
+	for _, s := range res.GetListServicesResponse().GetService() {
+		services = append(services, s.Name)
+	}
+
+	assert.Contains(t, services, transportService)
+	assert.Contains(t, services, healthpb.Health_ServiceDesc.ServiceName)
+}
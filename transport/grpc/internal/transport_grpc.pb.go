@@ -19,6 +19,8 @@ const _ = grpc.SupportPackageIsVersion7
 type TransportClient interface {
 	Ping(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error)
 	Stream(ctx context.Context, opts ...grpc.CallOption) (Transport_StreamClient, error)
+	// Call sends a single message and returns the answer, for exchanges that don't need a stream.
+	Call(ctx context.Context, in *Message, opts ...grpc.CallOption) (*Message, error)
 }
 
 type transportClient struct {
@@ -69,12 +71,23 @@ func (x *transportStreamClient) Recv() (*Message, error) {
 	return m, nil
 }
 
+func (c *transportClient) Call(ctx context.Context, in *Message, opts ...grpc.CallOption) (*Message, error) {
+	out := new(Message)
+	err := c.cc.Invoke(ctx, "/Transport/Call", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TransportServer is the server API for Transport service.
 // All implementations must embed UnimplementedTransportServer
 // for forward compatibility
 type TransportServer interface {
 	Ping(context.Context, *Empty) (*Empty, error)
 	Stream(Transport_StreamServer) error
+	// Call sends a single message and returns the answer, for exchanges that don't need a stream.
+	Call(context.Context, *Message) (*Message, error)
 	mustEmbedUnimplementedTransportServer()
 }
 
@@ -88,6 +101,9 @@ func (UnimplementedTransportServer) Ping(context.Context, *Empty) (*Empty, error
 func (UnimplementedTransportServer) Stream(Transport_StreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
 }
+func (UnimplementedTransportServer) Call(context.Context, *Message) (*Message, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Call not implemented")
+}
 func (UnimplementedTransportServer) mustEmbedUnimplementedTransportServer() {}
 
 // UnsafeTransportServer may be embedded to opt out of forward compatibility for this service.
@@ -145,6 +161,24 @@ func (x *transportStreamServer) Recv() (*Message, error) {
 	return m, nil
 }
 
+func _Transport_Call_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Message)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransportServer).Call(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Transport/Call",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransportServer).Call(ctx, req.(*Message))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Transport_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "Transport",
 	HandlerType: (*TransportServer)(nil),
@@ -153,6 +187,10 @@ var _Transport_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Ping",
 			Handler:    _Transport_Ping_Handler,
 		},
+		{
+			MethodName: "Call",
+			Handler:    _Transport_Call_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
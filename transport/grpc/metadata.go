@@ -0,0 +1,221 @@
+package grpc
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/MouseHatGames/mice-plugins/transport/grpc/internal"
+	"google.golang.org/grpc/metadata"
+)
+
+// With MetadataHeaders, every socket gets a stream of its own and the headers of the first
+// message sent each way travel as the stream's metadata instead of inside the message, so that
+// proxies and interceptors can see them. The client marks such streams with metadataMarker,
+// servers only answer with metadata when they see it. Headers that aren't valid metadata, and
+// the ones of later messages on the stream, are still sent inside messages.
+
+// metadataMarker is set in the metadata of streams whose first message has its headers in it.
+const metadataMarker = "mice-metadata-headers"
+
+// reservedMetadata holds the metadata keys set by gRPC and HTTP/2 themselves.
+var reservedMetadata = map[string]bool{
+	"content-type": true,
+	"user-agent":   true,
+	"te":           true,
+	metadataMarker: true,
+}
+
+// isMetadataKey returns whether k can be sent as metadata as is, and wouldn't be mistaken for
+// one set by gRPC.
+func isMetadataKey(k string) bool {
+	if k == "" || reservedMetadata[k] || strings.HasPrefix(k, "grpc-") || strings.HasSuffix(k, "-bin") {
+		return false
+	}
+
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isMetadataValue returns whether v can be sent as the value of a metadata key that isn't binary.
+func isMetadataValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splitHeaders returns the metadata holding the headers that can be sent that way, along with
+// the ones that can't.
+func splitHeaders(h map[string]string) (metadata.MD, map[string]string) {
+	md := metadata.Pairs(metadataMarker, "1")
+	var rest map[string]string
+
+	for k, v := range h {
+		if isMetadataKey(k) && isMetadataValue(v) {
+			md.Set(k, v)
+			continue
+		}
+
+		if rest == nil {
+			rest = map[string]string{}
+		}
+		rest[k] = v
+	}
+
+	return md, rest
+}
+
+// mergeMetadata adds the headers sent as metadata to the ones sent inside a message.
+func mergeMetadata(h map[string]string, md metadata.MD) map[string]string {
+	for k, v := range md {
+		if !isMetadataKey(k) || len(v) == 0 {
+			continue
+		}
+
+		if h == nil {
+			h = map[string]string{}
+		}
+		h[k] = v[0]
+	}
+
+	return h
+}
+
+// withHeaders returns a copy of m with other headers.
+func withHeaders(m *internal.Message, h map[string]string) *internal.Message {
+	return &internal.Message{
+		Headers: h,
+		Data:    m.Data,
+		More:    m.More,
+		Aborted: m.Aborted,
+		Timeout: m.Timeout,
+	}
+}
+
+// metadataStream is a client stream that's only opened once the first message is sent, with
+// its headers as metadata.
+type metadataStream struct {
+	ctx context.Context
+	cl  internal.TransportClient
+
+	mu     sync.Mutex
+	str    internal.Transport_StreamClient
+	err    error
+	opened bool
+
+	// received is set once the first message has been received, only used by Recv.
+	received bool
+}
+
+var _ stream = (*metadataStream)(nil)
+
+func newMetadataStream(ctx context.Context, cl internal.TransportClient) *metadataStream {
+	return &metadataStream{ctx: ctx, cl: cl}
+}
+
+// open opens the stream if it isn't already, sending md with it. Must be called with mu held.
+func (s *metadataStream) open(md metadata.MD) {
+	if s.opened {
+		return
+	}
+	s.opened = true
+
+	s.str, s.err = s.cl.Stream(metadata.NewOutgoingContext(s.ctx, md))
+}
+
+func (s *metadataStream) Send(m *internal.Message) error {
+	s.mu.Lock()
+	if !s.opened {
+		md, rest := splitHeaders(m.Headers)
+
+		s.open(md)
+		m = withHeaders(m, rest)
+	}
+	str, err := s.str, s.err
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return str.Send(m)
+}
+
+func (s *metadataStream) Recv() (*internal.Message, error) {
+	s.mu.Lock()
+	s.open(metadata.Pairs(metadataMarker, "1"))
+	str, err := s.str, s.err
+	s.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := str.Recv()
+	if err != nil || s.received {
+		return m, err
+	}
+	s.received = true
+
+	// The headers have been received along with the first message
+	md, err := str.Header()
+	if err == nil && len(md.Get(metadataMarker)) > 0 {
+		m.Headers = mergeMetadata(m.Headers, md)
+	}
+
+	return m, nil
+}
+
+// serverStream is the server end of a stream, which exchanges headers as metadata if the client
+// asked for it.
+type serverStream struct {
+	internal.Transport_StreamServer
+
+	// md is the metadata the stream was opened with, nil unless it holds headers.
+	md metadata.MD
+
+	received, sent bool
+}
+
+func newServerStream(s internal.Transport_StreamServer) stream {
+	md, ok := metadata.FromIncomingContext(s.Context())
+	if !ok || len(md.Get(metadataMarker)) == 0 {
+		return s
+	}
+
+	return &serverStream{Transport_StreamServer: s, md: md}
+}
+
+func (s *serverStream) Recv() (*internal.Message, error) {
+	m, err := s.Transport_StreamServer.Recv()
+	if err != nil || s.received {
+		return m, err
+	}
+	s.received = true
+
+	m.Headers = mergeMetadata(m.Headers, s.md)
+	return m, nil
+}
+
+func (s *serverStream) Send(m *internal.Message) error {
+	if s.sent {
+		return s.Transport_StreamServer.Send(m)
+	}
+	s.sent = true
+
+	md, rest := splitHeaders(m.Headers)
+	if err := s.SendHeader(md); err != nil {
+		return err
+	}
+
+	return s.Transport_StreamServer.Send(withHeaders(m, rest))
+}
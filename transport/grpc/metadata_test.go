@@ -0,0 +1,133 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// echo sends every message it receives back until the socket fails.
+func echo(s transport.Socket) {
+	go func() {
+		defer s.Close()
+
+		for {
+			var msg transport.Message
+			if err := s.Receive(context.Background(), &msg); err != nil {
+				return
+			}
+			if err := s.Send(context.Background(), &msg); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func exchangeInProcess(t *testing.T, dialer grpc.DialOption, opts *grpcOptions, msg *transport.Message) *transport.Message {
+	opts.DialOptions = append(opts.DialOptions, dialer)
+
+	s, err := newTestTransport(opts).Dial(context.Background(), "bufconn")
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), msg))
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+
+	return &rec
+}
+
+func TestMetadataHeaders(t *testing.T) {
+	seen := make(chan metadata.MD, 1)
+
+	l, dialer := listenInProcess(t, &grpcOptions{
+		ServerOptions: []grpc.ServerOption{grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			md, _ := metadata.FromIncomingContext(ss.Context())
+			seen <- md
+			return handler(srv, ss)
+		})},
+	})
+	go l.Accept(context.Background(), echo)
+
+	headers := map[string]string{
+		"trace-id": "abc",
+		"Upper":    "1",
+		"unicode":  "naïve",
+	}
+
+	for _, enabled := range []bool{false, true} {
+		rec := exchangeInProcess(t, dialer, &grpcOptions{MetadataHeaders: enabled}, &transport.Message{
+			MessageHeaders: headers,
+			Data:           []byte("hello"),
+		})
+
+		assert.Equal(t, headers, rec.MessageHeaders, "enabled: %v", enabled)
+		assert.Equal(t, []byte("hello"), rec.Data)
+
+		// Only headers that are valid metadata are sent that way
+		md := <-seen
+		if enabled {
+			assert.Equal(t, []string{"abc"}, md.Get("trace-id"))
+		} else {
+			assert.Empty(t, md.Get("trace-id"))
+		}
+		assert.Empty(t, md.Get("upper"))
+		assert.Empty(t, md.Get("unicode"))
+	}
+}
+
+func TestMergeMetadata_Reserved(t *testing.T) {
+	md := metadata.Pairs("content-type", "application/grpc", "grpc-timeout", "1S", "a-bin", "x", "b", "2")
+
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, mergeMetadata(map[string]string{"a": "1"}, md))
+}
+
+func TestCloseWithError(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{})
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		go func() {
+			var msg transport.Message
+			s.Receive(context.Background(), &msg)
+
+			st, _ := status.New(codes.PermissionDenied, "not allowed").WithDetails(wrapperspb.String("details"))
+			s.(ErrorCloser).CloseWithError(st.Err())
+		}()
+	})
+
+	for _, enabled := range []bool{false, true} {
+		opts := &grpcOptions{MetadataHeaders: enabled, DialOptions: []grpc.DialOption{dialer}}
+
+		s, err := newTestTransport(opts).Dial(context.Background(), "bufconn")
+		require.Nil(t, err)
+
+		require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+
+		var rec transport.Message
+		err = s.Receive(context.Background(), &rec)
+
+		st := Status(err)
+		assert.Equal(t, codes.PermissionDenied, st.Code(), "enabled: %v", enabled)
+		assert.Equal(t, "not allowed", st.Message())
+		require.Len(t, st.Details(), 1)
+		assert.Equal(t, "details", st.Details()[0].(*wrapperspb.StringValue).Value)
+
+		s.Close()
+	}
+}
+
+func TestStatus(t *testing.T) {
+	assert.Equal(t, codes.OK, Status(nil).Code())
+	assert.Equal(t, codes.Canceled, Status(context.Canceled).Code())
+	assert.Equal(t, codes.Unknown, Status(assert.AnError).Code())
+	assert.Equal(t, codes.NotFound, Status(fmt.Errorf("wrapped: %w", status.Error(codes.NotFound, ""))).Code())
+}
@@ -0,0 +1,296 @@
+package grpc
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/MouseHatGames/mice-plugins/transport/dialer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+type Option func(opts *grpcOptions)
+
+type grpcOptions struct {
+	MaxIdleConnections   int
+	MaxActiveConnections int
+	IdleTimeout          time.Duration
+	PingTimeout          time.Duration
+	PoolEvictAfter       time.Duration
+	ConnectionsPerAddr   int
+	ConnIdleTimeout      time.Duration
+	Dialer               dialer.Dialer
+	SharedPort           bool
+	ServerTLS            *tls.Config
+	ClientTLS            *tls.Config
+	ServerNames          map[string]string
+	ServerOptions        []grpc.ServerOption
+	DialOptions          []grpc.DialOption
+	HealthCheck          bool
+	MetadataHeaders      bool
+	DrainTimeout         time.Duration
+	UnaryCalls           bool
+	Reflection           bool
+}
+
+// Pool sizes used unless set otherwise.
+const (
+	DefaultMaxIdleConnections   = 10
+	DefaultMaxActiveConnections = 15
+	DefaultIdleTimeout          = 15 * time.Second
+	DefaultPingTimeout          = 5 * time.Second
+)
+
+// DefaultDrainTimeout is how long closing a listener waits for streams to finish unless set
+// otherwise.
+const DefaultDrainTimeout = 10 * time.Second
+
+// DefaultConnectionsPerAddress is how many connections are opened to every address unless set
+// otherwise.
+const DefaultConnectionsPerAddress = 1
+
+// DefaultConnectionIdleTimeout is how long connections stay open without streams unless set
+// otherwise.
+const DefaultConnectionIdleTimeout = time.Minute
+
+// MaxIdleConnections sets how many idle streams are kept in the pool of each address.
+// Defaults to DefaultMaxIdleConnections.
+func MaxIdleConnections(n int) Option {
+	return func(opts *grpcOptions) {
+		opts.MaxIdleConnections = n
+	}
+}
+
+// MaxActiveConnections limits how many pooled streams may be open to each address. Dial
+// waits for one to be returned once it's reached, zero means no limit. Defaults to
+// DefaultMaxActiveConnections.
+func MaxActiveConnections(n int) Option {
+	return func(opts *grpcOptions) {
+		opts.MaxActiveConnections = n
+	}
+}
+
+// IdleTimeout sets how long pooled streams may stay idle before being closed. Defaults to
+// DefaultIdleTimeout.
+func IdleTimeout(dur time.Duration) Option {
+	return func(opts *grpcOptions) {
+		opts.IdleTimeout = dur
+	}
+}
+
+// PingTimeout sets how long the server has to answer the ping sent before handing out a pooled
+// stream. Streams whose ping times out are closed and replaced. Zero means no limit. Defaults to
+// DefaultPingTimeout.
+func PingTimeout(dur time.Duration) Option {
+	return func(opts *grpcOptions) {
+		opts.PingTimeout = dur
+	}
+}
+
+// EvictPoolsAfter drops the stream pool of an address that hasn't been dialed for this long,
+// e.g. because the service behind it went away. Defaults to pool.DefaultEvictAfter.
+func EvictPoolsAfter(dur time.Duration) Option {
+	return func(opts *grpcOptions) {
+		opts.PoolEvictAfter = dur
+	}
+}
+
+// ConnectionsPerAddress sets how many connections are opened to every address. Pooled streams
+// are spread over them, which may help when a single connection can't keep up with the load.
+// Defaults to DefaultConnectionsPerAddress.
+func ConnectionsPerAddress(n int) Option {
+	return func(opts *grpcOptions) {
+		opts.ConnectionsPerAddr = n
+	}
+}
+
+// ConnectionIdleTimeout sets how long a connection stays open once its last stream is closed,
+// so that the next exchange with the same address doesn't have to connect again. Zero closes
+// it right away. Defaults to DefaultConnectionIdleTimeout.
+func ConnectionIdleTimeout(dur time.Duration) Option {
+	return func(opts *grpcOptions) {
+		opts.ConnIdleTimeout = dur
+	}
+}
+
+// Dialer sets how connections to servers are opened, e.g. through a proxy created with
+// dialer.SOCKS5 or dialer.HTTPConnect. Defaults to connecting directly.
+func Dialer(d dialer.Dialer) Option {
+	return func(opts *grpcOptions) {
+		opts.Dialer = d
+	}
+}
+
+// SharedPort lets the listener share its port with other transports in the same process, such
+// as the tcp one with its own SharedPort option, or with an HTTP server listening through
+// portmux.Listen. Connections are told apart by their first bytes, which doesn't work for those
+// coming through a load balancer that sends a PROXY protocol header first.
+func SharedPort(enabled bool) Option {
+	return func(opts *grpcOptions) {
+		opts.SharedPort = enabled
+	}
+}
+
+// TLS makes both the listener and the dialer use TLS with the given configuration.
+// Use ServerTLS and ClientTLS if each side needs a different configuration, e.g. for mutual TLS.
+func TLS(cfg *tls.Config) Option {
+	return func(opts *grpcOptions) {
+		opts.ServerTLS = cfg
+		opts.ClientTLS = cfg
+	}
+}
+
+// ServerTLS makes the listener accept TLS connections only. Set ClientAuth and ClientCAs on
+// the configuration to require client certificates. Can't be combined with SharedPort.
+func ServerTLS(cfg *tls.Config) Option {
+	return func(opts *grpcOptions) {
+		opts.ServerTLS = cfg
+	}
+}
+
+// ClientTLS makes outgoing connections use TLS. Set Certificates or GetClientCertificate on
+// the configuration to present a client certificate, and RootCAs to trust a custom CA. The
+// server's certificate is checked against ServerName if set, the host being dialed otherwise.
+func ClientTLS(cfg *tls.Config) Option {
+	return func(opts *grpcOptions) {
+		opts.ClientTLS = cfg
+	}
+}
+
+// ServerName sets the name the certificate of the server at addr is checked against when
+// dialing it with TLS, overriding the one in the ClientTLS configuration. Useful when the
+// address is an IP or a load balancer that doesn't match the certificate.
+func ServerName(addr, name string) Option {
+	return func(opts *grpcOptions) {
+		if opts.ServerNames == nil {
+			opts.ServerNames = map[string]string{}
+		}
+
+		opts.ServerNames[addr] = name
+	}
+}
+
+// DrainTimeout sets how long closing the listener waits for the streams that are in the middle
+// of an exchange, i.e. that received a message they haven't answered yet, before closing them.
+// Idle streams are closed right away. Zero closes every stream immediately. Defaults to
+// DefaultDrainTimeout.
+func DrainTimeout(dur time.Duration) Option {
+	return func(opts *grpcOptions) {
+		opts.DrainTimeout = dur
+	}
+}
+
+// HealthCheck registers the standard gRPC health service on the listener, so that tools such as
+// grpc_health_probe or Kubernetes gRPC probes can check it. The server reports itself as
+// serving once Accept is called and until the listener is closed, see HealthReporter to
+// change that in between.
+func HealthCheck(enabled bool) Option {
+	return func(opts *grpcOptions) {
+		opts.HealthCheck = enabled
+	}
+}
+
+// Reflection registers the gRPC server reflection service on the listener, letting tools such as
+// grpcurl list and call its services without their proto files.
+func Reflection(enabled bool) Option {
+	return func(opts *grpcOptions) {
+		opts.Reflection = enabled
+	}
+}
+
+// MetadataHeaders sends message headers as gRPC metadata rather than inside messages, so that
+// proxies, interceptors and tracing tools can see them. Unary calls carry the headers of their
+// message and answer, while sockets that use streams get one of their own, carrying the headers
+// of its first message in each direction, instead of one from the pool.
+// Headers that aren't valid metadata, such as ones with uppercase keys or non-ASCII values, are
+// still sent inside messages. Servers understand both modes whatever this option is set to, but
+// older ones drop the headers, so they must be updated before the clients enable it.
+func MetadataHeaders(enabled bool) Option {
+	return func(opts *grpcOptions) {
+		opts.MetadataHeaders = enabled
+	}
+}
+
+// UnaryCalls sends every message with a unary call that the server answers with the next message
+// its socket sends, rather than over a stream. It saves the frames needed to open and reuse
+// streams and lets HTTP/2 proxies balance each call on its own. Send waits for the answer, which
+// the next Receive returns. Sockets switch to a stream for streamed bodies, to receive without
+// having sent anything, and for servers that don't support unary calls. Servers must answer
+// every message with exactly one, so disable it for conversations where they send more.
+// Defaults to true.
+func UnaryCalls(enabled bool) Option {
+	return func(opts *grpcOptions) {
+		opts.UnaryCalls = enabled
+	}
+}
+
+// ServerOptions passes options to the gRPC server created by Listen, for settings this package
+// has no option for.
+func ServerOptions(o ...grpc.ServerOption) Option {
+	return func(opts *grpcOptions) {
+		opts.ServerOptions = append(opts.ServerOptions, o...)
+	}
+}
+
+// DialOptions passes options to the gRPC connections opened to other servers. They're applied
+// after the ones set by this package, so they take precedence.
+func DialOptions(o ...grpc.DialOption) Option {
+	return func(opts *grpcOptions) {
+		opts.DialOptions = append(opts.DialOptions, o...)
+	}
+}
+
+// MaxMessageSize sets the largest message that can be sent or received, both by the server and
+// by outgoing connections. gRPC only accepts 4 MiB by default, streamed bodies aren't limited
+// since they're sent in pieces.
+func MaxMessageSize(n int) Option {
+	return func(opts *grpcOptions) {
+		opts.ServerOptions = append(opts.ServerOptions, grpc.MaxRecvMsgSize(n), grpc.MaxSendMsgSize(n))
+		opts.DialOptions = append(opts.DialOptions, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(n), grpc.MaxCallSendMsgSize(n)))
+	}
+}
+
+// Keepalive pings the other end of idle connections every interval, closing them if it doesn't
+// answer within timeout. The server is told to accept pings that often, so every process
+// talking to each other should use the same interval.
+func Keepalive(interval, timeout time.Duration) Option {
+	return func(opts *grpcOptions) {
+		opts.ServerOptions = append(opts.ServerOptions,
+			grpc.KeepaliveParams(keepalive.ServerParameters{Time: interval, Timeout: timeout}),
+			grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: interval, PermitWithoutStream: true}),
+		)
+		opts.DialOptions = append(opts.DialOptions, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                interval,
+			Timeout:             timeout,
+			PermitWithoutStream: true,
+		}))
+	}
+}
+
+// WindowSize sets the HTTP/2 flow control windows of every stream and of whole connections,
+// both on the server and on outgoing connections. Larger windows speed up big messages on
+// connections with a high latency. gRPC sizes them dynamically unless set.
+func WindowSize(stream, conn int32) Option {
+	return func(opts *grpcOptions) {
+		opts.ServerOptions = append(opts.ServerOptions, grpc.InitialWindowSize(stream), grpc.InitialConnWindowSize(conn))
+		opts.DialOptions = append(opts.DialOptions, grpc.WithInitialWindowSize(stream), grpc.WithInitialConnWindowSize(conn))
+	}
+}
+
+// ServerInterceptors runs the interceptors around the streams accepted by the server, in the
+// order given. Unary calls go through the ones set with ServerOptions and
+// grpc.ChainUnaryInterceptor instead.
+func ServerInterceptors(i ...grpc.StreamServerInterceptor) Option {
+	return func(opts *grpcOptions) {
+		opts.ServerOptions = append(opts.ServerOptions, grpc.ChainStreamInterceptor(i...))
+	}
+}
+
+// ClientInterceptors runs the interceptors around the streams opened to other servers, in the
+// order given. Unary calls go through the ones set with DialOptions and
+// grpc.WithChainUnaryInterceptor instead.
+func ClientInterceptors(i ...grpc.StreamClientInterceptor) Option {
+	return func(opts *grpcOptions) {
+		opts.DialOptions = append(opts.DialOptions, grpc.WithChainStreamInterceptor(i...))
+	}
+}
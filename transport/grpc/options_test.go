@@ -0,0 +1,118 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func applyOptions(o ...Option) *grpcOptions {
+	opts := &grpcOptions{}
+	for _, apply := range o {
+		apply(opts)
+	}
+	return opts
+}
+
+func listenEcho(t *testing.T, opts *grpcOptions) grpc.DialOption {
+	l, dialer := listenInProcess(t, opts)
+	go l.Accept(context.Background(), echo)
+
+	return dialer
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	const limit = 1 << 10
+
+	small := bytes.Repeat([]byte{'a'}, limit/2)
+	large := bytes.Repeat([]byte{'a'}, 2*limit)
+
+	t.Run("Both", func(t *testing.T) {
+		dialer := listenEcho(t, applyOptions(MaxMessageSize(limit)))
+
+		assert.Nil(t, tryExchange(dialer, applyOptions(MaxMessageSize(limit)), small))
+		assert.NotNil(t, tryExchange(dialer, applyOptions(MaxMessageSize(limit)), large))
+	})
+
+	t.Run("Server", func(t *testing.T) {
+		dialer := listenEcho(t, applyOptions(MaxMessageSize(limit)))
+
+		assert.NotNil(t, tryExchange(dialer, &grpcOptions{}, large))
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		dialer := listenEcho(t, &grpcOptions{})
+
+		assert.NotNil(t, tryExchange(dialer, applyOptions(MaxMessageSize(limit)), large))
+	})
+
+	t.Run("AboveDefault", func(t *testing.T) {
+		// gRPC only accepts 4 MiB unless told otherwise
+		huge := bytes.Repeat([]byte{'a'}, 5<<20)
+		dialer := listenEcho(t, applyOptions(MaxMessageSize(8<<20)))
+
+		assert.Nil(t, tryExchange(dialer, applyOptions(MaxMessageSize(8<<20)), huge))
+	})
+
+	t.Run("UserOptionsTakePrecedence", func(t *testing.T) {
+		dialer := listenEcho(t, applyOptions(
+			MaxMessageSize(limit),
+			ServerOptions(grpc.MaxRecvMsgSize(4*limit), grpc.MaxSendMsgSize(4*limit)),
+		))
+
+		opts := applyOptions(
+			MaxMessageSize(limit),
+			DialOptions(grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(4*limit), grpc.MaxCallSendMsgSize(4*limit))),
+		)
+		assert.Nil(t, tryExchange(dialer, opts, large))
+	})
+}
+
+// recorder keeps the names of the interceptors in the order they're run.
+type recorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *recorder) record(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, name)
+}
+
+func (r *recorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.calls...)
+}
+
+func (r *recorder) server(name string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		r.record(name)
+		return handler(srv, ss)
+	}
+}
+
+func (r *recorder) client(name string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		r.record(name)
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	var srv, cl recorder
+
+	dialer := listenEcho(t, applyOptions(ServerInterceptors(srv.server("first"), srv.server("second"))))
+	require.Nil(t, tryExchange(dialer, applyOptions(ClientInterceptors(cl.client("first"), cl.client("second"))), ping))
+
+	assert.Equal(t, []string{"first", "second"}, srv.recorded())
+	assert.Equal(t, []string{"first", "second"}, cl.recorded())
+}
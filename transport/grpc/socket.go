@@ -2,6 +2,8 @@ package grpc
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/MouseHatGames/mice-plugins/transport/grpc/internal"
 	"github.com/MouseHatGames/mice/transport"
@@ -11,13 +13,25 @@ import (
 // It can wrap a client-server or server-client stream.
 type grpcSocket struct {
 	str stream
+
+	// sendMu and recvMu are held while a streamed body is being sent or received, keeping
+	// other messages out of it.
+	sendMu, recvMu sync.Mutex
+
+	// abort ends the stream, making the calls blocked on it return.
+	abort func(err error)
+
+	// timeouts is set on client sockets, whose messages tell the server how long they wait for
+	// the answer.
+	timeouts bool
 }
 
 var _ transport.Socket = (*grpcSocket)(nil)
 
 func newSocket(s stream) *grpcSocket {
 	sock := &grpcSocket{
-		str: s,
+		str:   s,
+		abort: func(error) {},
 	}
 
 	return sock
@@ -28,19 +42,46 @@ func (s *grpcSocket) Close() error {
 }
 
 func (s *grpcSocket) Send(ctx context.Context, msg *transport.Message) error {
-	return s.str.Send(&internal.Message{
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	done := s.withContext(ctx)
+
+	return done(s.str.Send(&internal.Message{
 		Headers: msg.MessageHeaders,
 		Data:    msg.Data,
-	})
+		Timeout: s.timeout(ctx),
+	}))
 }
 
+// Receive reads the next message from the stream. Streamed bodies are read whole.
 func (s *grpcSocket) Receive(ctx context.Context, msg *transport.Message) error {
+	_, err := s.receive(ctx, msg)
+	return err
+}
+
+// receive is Receive, also returning how long the sender waits for the answer, or zero.
+func (s *grpcSocket) receive(ctx context.Context, msg *transport.Message) (time.Duration, error) {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	done := s.withContext(ctx)
+
 	rec, err := s.str.Recv()
-	if err != nil {
-		return err
+	if err = done(err); err != nil {
+		return 0, err
 	}
 
 	msg.MessageHeaders = rec.Headers
 	msg.Data = rec.Data
-	return nil
+
+	if rec.More {
+		return time.Duration(rec.Timeout), readBody(&body{s: s, chunk: rec.Data}, msg)
+	}
+
+	return time.Duration(rec.Timeout), nil
 }
@@ -2,42 +2,125 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/MouseHatGames/mice-plugins/transport/grpc/internal"
+	"github.com/MouseHatGames/mice-plugins/transport/pool"
 	"github.com/MouseHatGames/mice/transport"
-	"google.golang.org/grpc"
 )
 
+// errStreamAborted is returned when checking a pooled stream that was ended because a caller
+// gave up on it.
+var errStreamAborted = errors.New("stream aborted")
+
 type grpcClientSocket struct {
 	*grpcSocket
-	c       *grpc.ClientConn
-	tr      internal.TransportClient
-	release func(interface{}) error
+
+	// aborted is set once the stream has been ended by a caller's context.
+	aborted int32
+
+	c    *clientConn
+	gen  uint64
+	tr   internal.TransportClient
+	pool *pool.Pool
+
+	// cancel ends the stream, release hands the connection back once it's done.
+	cancel  context.CancelFunc
+	release func(*clientConn) error
+	closed  sync.Once
 }
 
 var _ transport.Socket = (*grpcClientSocket)(nil)
 
-func newClientSocket(ctx context.Context, c *grpc.ClientConn, release func(interface{}) error) (*grpcClientSocket, error) {
+// newClientSocket opens a stream on c, giving up if ctx is done first. The stream lasts until
+// the socket's connection is closed with CloseConn.
+func newClientSocket(ctx context.Context, c *clientConn) (*grpcClientSocket, error) {
+	sctx, cancel := context.WithCancel(context.Background())
+	gen := c.generation()
+
+	stop := watchContext(ctx, cancel)
+
 	cl := internal.NewTransportClient(c)
-	str, err := cl.Stream(ctx)
+	str, err := cl.Stream(sctx)
+	if stop() {
+		err = ctx.Err()
+	}
 	if err != nil {
-		c.Close()
+		cancel()
 		return nil, fmt.Errorf("start stream: %w", err)
 	}
 
-	return &grpcClientSocket{
+	s := &grpcClientSocket{
 		grpcSocket: newSocket(str),
 		c:          c,
+		gen:        gen,
+		tr:         cl,
+		cancel:     cancel,
+	}
+	s.grpcSocket.abort = s.abort
+	s.grpcSocket.timeouts = true
+
+	return s, nil
+}
+
+// newMetadataSocket returns a socket whose stream is opened on c by the first message sent.
+func newMetadataSocket(c *clientConn, release func(*clientConn) error) *grpcClientSocket {
+	ctx, cancel := context.WithCancel(context.Background())
+	cl := internal.NewTransportClient(c)
+
+	s := &grpcClientSocket{
+		grpcSocket: newSocket(newMetadataStream(ctx, cl)),
+		c:          c,
+		gen:        c.generation(),
 		tr:         cl,
+		cancel:     cancel,
 		release:    release,
-	}, nil
+	}
+	s.grpcSocket.abort = s.abort
+	s.grpcSocket.timeouts = true
+
+	return s
+}
+
+// abort ends the stream when a caller gives up on it, the server sees the exchange cancelled.
+func (s *grpcClientSocket) abort(error) {
+	atomic.StoreInt32(&s.aborted, 1)
+	s.cancel()
+}
+
+// check fails if the stream can't be used anymore.
+func (s *grpcClientSocket) check() error {
+	if atomic.LoadInt32(&s.aborted) != 0 {
+		return errStreamAborted
+	}
+
+	// The connection may have come back up, but the stream didn't
+	return s.c.check(s.gen)
 }
 
 func (s *grpcClientSocket) Close() error {
-	return s.release(s)
+	if s.pool == nil {
+		// Not pooled
+		return s.CloseConn()
+	}
+
+	return s.pool.Put(s)
 }
 
+// CloseConn ends the stream, closing the connection it was opened on if no other stream uses it.
 func (s *grpcClientSocket) CloseConn() error {
-	return s.c.Close()
+	var err error
+
+	s.closed.Do(func() {
+		s.cancel()
+
+		if s.release != nil {
+			err = s.release(s.c)
+		}
+	})
+
+	return err
 }
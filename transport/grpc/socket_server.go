@@ -1,22 +1,184 @@
 package grpc
 
-import "github.com/MouseHatGames/mice/transport"
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/MouseHatGames/mice/transport"
+)
 
 type grpcServerSocket struct {
 	*grpcSocket
 	done chan interface{}
+
+	// pending counts the messages received that haven't been answered yet, so that the stream
+	// can be ended as soon as it's idle when the listener is closing.
+	mu      sync.Mutex
+	pending int
+	idleCh  chan struct{}
+
+	// ctx is the context of the stream, cancelled once the socket is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// exchange is the context of the last message received, with the deadline it was sent with.
+	// endExchange releases it.
+	exchange    context.Context
+	endExchange context.CancelFunc
 }
 
-var _ transport.Socket = (*grpcServerSocket)(nil)
+var (
+	_ transport.Socket = (*grpcServerSocket)(nil)
+	_ StreamSocket     = (*grpcServerSocket)(nil)
+	_ ErrorCloser      = (*grpcServerSocket)(nil)
+)
 
-func newServerSocket(s stream) *grpcServerSocket {
-	return &grpcServerSocket{
-		grpcSocket: newSocket(s),
-		done:       make(chan interface{}, 1),
+// newServerSocket returns a socket for the stream s, whose context is ctx.
+func newServerSocket(ctx context.Context, s stream) *grpcServerSocket {
+	ctx, cancel := context.WithCancel(ctx)
+
+	sock := &grpcServerSocket{
+		grpcSocket:  newSocket(s),
+		done:        make(chan interface{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+		exchange:    ctx,
+		endExchange: func() {},
 	}
+	sock.grpcSocket.abort = func(err error) { sock.CloseWithError(err) }
+
+	return sock
 }
 
 func (s *grpcServerSocket) Close() error {
-	s.done <- nil
+	return s.CloseWithError(nil)
+}
+
+// CloseWithError implements ErrorCloser.
+func (s *grpcServerSocket) CloseWithError(err error) error {
+	// Only the first call ends the stream
+	select {
+	case s.done <- err:
+	default:
+	}
+
+	s.cancel()
+
 	return nil
 }
+
+// Context implements ContextSocket. It's the context of the exchange started by the last
+// message received.
+func (s *grpcServerSocket) Context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.exchange
+}
+
+func (s *grpcServerSocket) Receive(ctx context.Context, msg *transport.Message) error {
+	timeout, err := s.grpcSocket.receive(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	s.received(timeout)
+	return nil
+}
+
+func (s *grpcServerSocket) ReceiveStream(ctx context.Context, msg *transport.Message) (io.ReadCloser, error) {
+	body, timeout, err := s.grpcSocket.receiveStream(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.received(timeout)
+	return body, nil
+}
+
+func (s *grpcServerSocket) Send(ctx context.Context, msg *transport.Message) error {
+	defer s.answered()
+	return s.grpcSocket.Send(ctx, msg)
+}
+
+func (s *grpcServerSocket) SendStream(ctx context.Context, msg *transport.Message) (BodyWriter, error) {
+	w, err := s.grpcSocket.SendStream(ctx, msg)
+	if err != nil {
+		s.answered()
+		return nil, err
+	}
+
+	return &answerWriter{BodyWriter: w, s: s}, nil
+}
+
+// received starts the exchange of a message that was sent with timeout, or without a deadline
+// if it's zero.
+func (s *grpcServerSocket) received(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The previous exchange is over if it has been answered, otherwise its context is released
+	// by its deadline or by the end of the stream
+	if s.pending == 0 {
+		s.endExchange()
+	}
+	s.pending++
+
+	if timeout > 0 {
+		s.exchange, s.endExchange = context.WithTimeout(s.ctx, timeout)
+	} else {
+		s.exchange, s.endExchange = s.ctx, func() {}
+	}
+}
+
+// answered is called once a message has been sent, answering one of the received ones if any.
+func (s *grpcServerSocket) answered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == 0 {
+		return
+	}
+
+	s.pending--
+	if s.pending == 0 && s.idleCh != nil {
+		close(s.idleCh)
+		s.idleCh = nil
+	}
+}
+
+// idle returns a channel that's closed once every message received has been answered.
+func (s *grpcServerSocket) idle() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == 0 {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+
+	if s.idleCh == nil {
+		s.idleCh = make(chan struct{})
+	}
+	return s.idleCh
+}
+
+// answerWriter counts a streamed message as answering a received one once its body is done.
+type answerWriter struct {
+	BodyWriter
+	s    *grpcServerSocket
+	once sync.Once
+}
+
+func (w *answerWriter) Close() error {
+	defer w.once.Do(w.s.answered)
+	return w.BodyWriter.Close()
+}
+
+func (w *answerWriter) CloseWithError(err error) error {
+	defer w.once.Do(w.s.answered)
+	return w.BodyWriter.CloseWithError(err)
+}
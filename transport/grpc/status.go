@@ -0,0 +1,34 @@
+package grpc
+
+import (
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorCloser is implemented by the sockets accepted by the listener. Type assert a socket to
+// it to end its stream with an error, which the client gets back as a gRPC status.
+type ErrorCloser interface {
+	// CloseWithError closes the socket like Close, ending the stream with the status of err.
+	// Create err with status.New(...).Err(), adding details with WithDetails, to choose its
+	// code. Context errors become Canceled or DeadlineExceeded, others Unknown.
+	CloseWithError(err error) error
+}
+
+// Status returns the gRPC status of an error returned by a socket, e.g. the one the server
+// closed its socket with. Errors that don't hold a status get codes.Unknown, nil gets codes.OK.
+// Since a stream can't fail while sending, Send may only return io.EOF while the status comes
+// out of the next Receive.
+func Status(err error) *status.Status {
+	if err == nil {
+		return status.New(codes.OK, "")
+	}
+
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus()
+	}
+
+	return status.FromContextError(err)
+}
@@ -0,0 +1,183 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// newTestCert creates a certificate for name signed by parent, or a CA if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+// tryExchange dials the in-process listener and sends data through an echoing handler,
+// returning the first error.
+func tryExchange(dialer grpc.DialOption, opts *grpcOptions, data []byte) error {
+	opts.DialOptions = append(opts.DialOptions, dialer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := newTestTransport(opts).Dial(ctx, "bufconn")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.Send(ctx, &transport.Message{Data: data}); err != nil {
+		return err
+	}
+
+	var msg transport.Message
+	if err := s.Receive(ctx, &msg); err != nil {
+		return err
+	}
+	if !bytes.Equal(msg.Data, data) {
+		return assert.AnError
+	}
+
+	return nil
+}
+
+var ping = []byte("ping")
+
+func listenTLS(t *testing.T, cfg *tls.Config) grpc.DialOption {
+	l, dialer := listenInProcess(t, &grpcOptions{ServerTLS: cfg})
+	go l.Accept(context.Background(), echo)
+
+	return dialer
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "bufconn", ca)
+
+	dialer := listenTLS(t, &tls.Config{Certificates: []tls.Certificate{server.tls()}})
+
+	assert.Nil(t, tryExchange(dialer, &grpcOptions{ClientTLS: &tls.Config{RootCAs: ca.pool()}}, ping))
+
+	t.Run("UntrustedServer", func(t *testing.T) {
+		other := newTestCert(t, "other", nil)
+		assert.NotNil(t, tryExchange(dialer, &grpcOptions{ClientTLS: &tls.Config{RootCAs: other.pool()}}, ping))
+	})
+
+	t.Run("Plaintext", func(t *testing.T) {
+		assert.NotNil(t, tryExchange(dialer, &grpcOptions{}, ping))
+	})
+}
+
+func TestTLS_Mutual(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "bufconn", ca)
+	client := newTestCert(t, "client", ca)
+
+	dialer := listenTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{server.tls()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	})
+
+	t.Run("WithoutClientCert", func(t *testing.T) {
+		assert.NotNil(t, tryExchange(dialer, &grpcOptions{ClientTLS: &tls.Config{RootCAs: ca.pool()}}, ping))
+	})
+
+	t.Run("UntrustedClientCert", func(t *testing.T) {
+		other := newTestCert(t, "client", newTestCert(t, "other", nil))
+		assert.NotNil(t, tryExchange(dialer, &grpcOptions{ClientTLS: &tls.Config{
+			RootCAs:      ca.pool(),
+			Certificates: []tls.Certificate{other.tls()},
+		}}, ping))
+	})
+
+	t.Run("WithClientCert", func(t *testing.T) {
+		assert.Nil(t, tryExchange(dialer, &grpcOptions{ClientTLS: &tls.Config{
+			RootCAs:      ca.pool(),
+			Certificates: []tls.Certificate{client.tls()},
+		}}, ping))
+	})
+}
+
+func TestTLS_ServerName(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "svc.internal", ca)
+
+	dialer := listenTLS(t, &tls.Config{Certificates: []tls.Certificate{server.tls()}})
+
+	// the certificate doesn't match the address being dialed
+	assert.NotNil(t, tryExchange(dialer, &grpcOptions{ClientTLS: &tls.Config{RootCAs: ca.pool()}}, ping))
+
+	t.Run("Override", func(t *testing.T) {
+		opts := &grpcOptions{ClientTLS: &tls.Config{RootCAs: ca.pool(), ServerName: "wrong"}}
+		ServerName("bufconn", "svc.internal")(opts)
+
+		assert.Nil(t, tryExchange(dialer, opts, ping))
+		assert.Equal(t, "wrong", opts.ClientTLS.ServerName, "the shared configuration is left untouched")
+	})
+
+	t.Run("OtherAddress", func(t *testing.T) {
+		opts := &grpcOptions{ClientTLS: &tls.Config{RootCAs: ca.pool()}}
+		ServerName("elsewhere", "svc.internal")(opts)
+
+		assert.NotNil(t, tryExchange(dialer, opts, ping))
+	})
+}
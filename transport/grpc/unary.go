@@ -0,0 +1,499 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/MouseHatGames/mice-plugins/transport/grpc/internal"
+	"github.com/MouseHatGames/mice/transport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// With UnaryCalls, every message sent by a client socket is a call to the Call method, which
+// the server answers with the next message its socket sends. Exchanges that don't fit, such as
+// streamed bodies or messages the server sends on its own, switch the socket to a stream.
+
+var (
+	// errAnswered is returned when a socket accepted for a unary call sends a second message.
+	errAnswered = errors.New("unary call already answered")
+
+	// errNotAnswered ends a unary call whose socket was closed without answering it.
+	errNotAnswered = status.Error(codes.Aborted, "socket closed without answering")
+)
+
+// callable returns whether messages to addr may be sent with unary calls.
+func (t *grpcTransport) callable(addr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return !t.noCalls[addr]
+}
+
+// noCallsTo remembers that the server at addr doesn't support unary calls.
+func (t *grpcTransport) noCallsTo(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.noCalls == nil {
+		t.noCalls = map[string]bool{}
+	}
+	t.noCalls[addr] = true
+}
+
+// unknownCall returns whether err is the one gRPC servers fail calls to methods they don't have
+// with, before any interceptor or handler runs. Servers from before unary calls were added
+// return it, and so resending the message on a stream doesn't handle it twice. Handlers and
+// interceptors are free to return Unimplemented themselves, which is left to the caller.
+func unknownCall(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Unimplemented {
+		return false
+	}
+
+	return st.Message() == "unknown method Call for service Transport"
+}
+
+// callSocket is a client socket that sends messages with unary calls, queuing their answers to
+// be received in order.
+type callSocket struct {
+	t    *grpcTransport
+	addr string
+	c    *clientConn
+	tr   internal.TransportClient
+
+	// sendMu keeps the answers in the order the messages were sent.
+	sendMu sync.Mutex
+
+	mu      sync.Mutex
+	answers []callAnswer
+	calling int
+	str     *grpcClientSocket
+
+	// answered is signaled when an answer is queued.
+	answered chan struct{}
+	closed   sync.Once
+}
+
+type callAnswer struct {
+	msg *internal.Message
+	err error
+}
+
+var _ StreamSocket = (*callSocket)(nil)
+
+func (t *grpcTransport) newCallSocket(addr string) (*callSocket, error) {
+	c, err := t.conns.acquire(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &callSocket{
+		t:        t,
+		addr:     addr,
+		c:        c,
+		tr:       internal.NewTransportClient(c),
+		answered: make(chan struct{}, 1),
+	}, nil
+}
+
+// Send makes a call with msg, waiting for its answer. Errors meaning the server didn't get the
+// message are returned right away, the others by the Receive that would have got the answer.
+func (s *callSocket) Send(ctx context.Context, msg *transport.Message) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if str := s.stream(); str != nil {
+		return str.Send(ctx, msg)
+	}
+
+	s.mu.Lock()
+	s.calling++
+	s.mu.Unlock()
+
+	rec, err := s.call(ctx, msg)
+
+	s.mu.Lock()
+	s.calling--
+
+	switch {
+	case unknownCall(err):
+		s.mu.Unlock()
+		s.t.log.Debugf("%s doesn't support unary calls, using streams", s.addr)
+		s.t.noCallsTo(s.addr)
+
+		str, err := s.switchToStream(ctx)
+		if err != nil {
+			return err
+		}
+		return str.Send(ctx, msg)
+
+	case ctx.Err() != nil, status.Code(err) == codes.Unavailable:
+		s.mu.Unlock()
+		s.signal()
+		return err
+	}
+
+	s.answers = append(s.answers, callAnswer{rec, err})
+	s.mu.Unlock()
+	s.signal()
+
+	return nil
+}
+
+func (s *callSocket) call(ctx context.Context, msg *transport.Message) (*internal.Message, error) {
+	m := &internal.Message{Headers: msg.MessageHeaders, Data: msg.Data}
+
+	var opts []grpc.CallOption
+	var header metadata.MD
+
+	if s.t.opts.MetadataHeaders {
+		md, rest := splitHeaders(m.Headers)
+
+		ctx = metadata.NewOutgoingContext(ctx, md)
+		m.Headers = rest
+		opts = append(opts, grpc.Header(&header))
+	}
+
+	rec, err := s.tr.Call(ctx, m, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(header.Get(metadataMarker)) > 0 {
+		rec.Headers = mergeMetadata(rec.Headers, header)
+	}
+
+	return rec, nil
+}
+
+func (s *callSocket) signal() {
+	select {
+	case s.answered <- struct{}{}:
+	default:
+	}
+}
+
+// SendStream switches the socket to a stream, since calls can't carry a body in pieces.
+func (s *callSocket) SendStream(ctx context.Context, msg *transport.Message) (BodyWriter, error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	str, err := s.switchToStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return str.SendStream(ctx, msg)
+}
+
+// Receive returns the answer to the oldest message sent. If there's none, it waits on a stream
+// for a message the server sends on its own.
+func (s *callSocket) Receive(ctx context.Context, msg *transport.Message) error {
+	ans, str, err := s.next(ctx)
+	if err != nil {
+		return err
+	}
+	if str != nil {
+		return str.Receive(ctx, msg)
+	}
+
+	return ans.read(msg)
+}
+
+// ReceiveStream implements StreamSocket, answers are always received whole.
+func (s *callSocket) ReceiveStream(ctx context.Context, msg *transport.Message) (io.ReadCloser, error) {
+	ans, str, err := s.next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if str != nil {
+		return str.ReceiveStream(ctx, msg)
+	}
+
+	if err := ans.read(msg); err != nil {
+		return nil, err
+	}
+
+	data := msg.Data
+	msg.Data = nil
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// next waits for the next answer, or returns the stream to receive from if none is coming.
+func (s *callSocket) next(ctx context.Context) (callAnswer, *grpcClientSocket, error) {
+	for {
+		s.mu.Lock()
+
+		if len(s.answers) > 0 {
+			ans := s.answers[0]
+			s.answers = s.answers[1:]
+			s.mu.Unlock()
+
+			return ans, nil, nil
+		}
+
+		if s.calling == 0 {
+			s.mu.Unlock()
+
+			str, err := s.switchToStream(ctx)
+			return callAnswer{}, str, err
+		}
+
+		s.mu.Unlock()
+
+		select {
+		case <-s.answered:
+		case <-ctx.Done():
+			return callAnswer{}, nil, ctx.Err()
+		}
+	}
+}
+
+func (a callAnswer) read(msg *transport.Message) error {
+	if a.err != nil {
+		return a.err
+	}
+
+	msg.MessageHeaders = a.msg.Headers
+	msg.Data = a.msg.Data
+
+	if a.msg.Aborted != "" {
+		return fmt.Errorf("%w: %s", ErrBodyAborted, a.msg.Aborted)
+	}
+
+	return nil
+}
+
+func (s *callSocket) stream() *grpcClientSocket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.str
+}
+
+// switchToStream returns the stream the socket uses from now on, getting one if needed.
+func (s *callSocket) switchToStream(ctx context.Context) (*grpcClientSocket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.str != nil {
+		return s.str, nil
+	}
+
+	str, err := s.t.dialStream(ctx, s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.str = str
+	return str, nil
+}
+
+// Close hands the stream back if the socket switched to one. Messages sent have already been
+// answered, so there's nothing to wait for.
+func (s *callSocket) Close() error {
+	var err error
+
+	s.closed.Do(func() {
+		if str := s.stream(); str != nil {
+			err = str.Close()
+		}
+
+		if rerr := s.t.conns.release(s.c); err == nil {
+			err = rerr
+		}
+	})
+
+	return err
+}
+
+// Call handles a unary call, passing a socket that receives the message and answers it.
+func (sv *server) Call(ctx context.Context, m *internal.Message) (*internal.Message, error) {
+	soc := newUnarySocket(ctx, m)
+
+	sv.callback(soc)
+
+	select {
+	case v := <-soc.done:
+		if rep, ok := v.(*internal.Message); ok {
+			return rep, nil
+		}
+		if err := streamError(v); err != nil {
+			return nil, err
+		}
+		return nil, errNotAnswered
+
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// unarySocket is a server socket that receives the message of a unary call and sends its answer.
+type unarySocket struct {
+	ctx context.Context
+
+	// md is the metadata of the call, nil unless it holds headers.
+	md metadata.MD
+
+	mu       sync.Mutex
+	req      *internal.Message
+	answered bool
+
+	// done gets the answer or the error the socket was closed with, whichever comes first.
+	done chan interface{}
+}
+
+var (
+	_ StreamSocket = (*unarySocket)(nil)
+	_ ErrorCloser  = (*unarySocket)(nil)
+)
+
+func newUnarySocket(ctx context.Context, req *internal.Message) *unarySocket {
+	s := &unarySocket{
+		ctx:  ctx,
+		req:  req,
+		done: make(chan interface{}, 1),
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(metadataMarker)) > 0 {
+		s.md = md
+	}
+
+	return s
+}
+
+// Receive returns the message of the call the first time, io.EOF afterwards.
+func (s *unarySocket) Receive(ctx context.Context, msg *transport.Message) error {
+	s.mu.Lock()
+	req := s.req
+	s.req = nil
+	s.mu.Unlock()
+
+	if req == nil {
+		return io.EOF
+	}
+
+	msg.MessageHeaders = req.Headers
+	msg.Data = req.Data
+
+	if s.md != nil {
+		msg.MessageHeaders = mergeMetadata(msg.MessageHeaders, s.md)
+	}
+
+	return nil
+}
+
+func (s *unarySocket) ReceiveStream(ctx context.Context, msg *transport.Message) (io.ReadCloser, error) {
+	if err := s.Receive(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	data := msg.Data
+	msg.Data = nil
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Send answers the call, only one message can be sent.
+func (s *unarySocket) Send(ctx context.Context, msg *transport.Message) error {
+	return s.answer(&internal.Message{Headers: msg.MessageHeaders, Data: msg.Data})
+}
+
+// SendStream answers the call with a message whose body is sent whole once the writer is closed.
+func (s *unarySocket) SendStream(ctx context.Context, msg *transport.Message) (BodyWriter, error) {
+	w := &answerBody{s: s, headers: msg.MessageHeaders}
+	w.buf.Write(msg.Data)
+
+	return w, nil
+}
+
+func (s *unarySocket) answer(rep *internal.Message) error {
+	s.mu.Lock()
+	if s.answered {
+		s.mu.Unlock()
+		return errAnswered
+	}
+	s.answered = true
+	s.mu.Unlock()
+
+	if s.md != nil {
+		md, rest := splitHeaders(rep.Headers)
+		if err := grpc.SetHeader(s.ctx, md); err != nil {
+			return err
+		}
+
+		rep.Headers = rest
+	}
+
+	select {
+	case s.done <- rep:
+		return nil
+	default:
+		return io.ErrClosedPipe
+	}
+}
+
+// Context implements ContextSocket, it returns the context of the call.
+func (s *unarySocket) Context() context.Context {
+	return s.ctx
+}
+
+func (s *unarySocket) Close() error {
+	return s.CloseWithError(nil)
+}
+
+// CloseWithError implements ErrorCloser, it ends the call with err unless it has been answered.
+func (s *unarySocket) CloseWithError(err error) error {
+	select {
+	case s.done <- err:
+	default:
+	}
+
+	return nil
+}
+
+// answerBody collects the body of an answer.
+type answerBody struct {
+	s       *unarySocket
+	headers map[string]string
+	buf     bytes.Buffer
+	closed  bool
+}
+
+func (w *answerBody) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	return w.buf.Write(p)
+}
+
+func (w *answerBody) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.s.answer(&internal.Message{Headers: w.headers, Data: w.buf.Bytes()})
+}
+
+func (w *answerBody) CloseWithError(err error) error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if err == nil {
+		err = ErrBodyAborted
+	}
+
+	return w.s.answer(&internal.Message{Headers: w.headers, Aborted: err.Error()})
+}
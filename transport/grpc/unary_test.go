@@ -0,0 +1,338 @@
+package grpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MouseHatGames/mice-plugins/transport/grpc/internal"
+	"github.com/MouseHatGames/mice/logger"
+	"github.com/MouseHatGames/mice/options"
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// countCalls returns server options counting the unary calls and streams handled by the server.
+func countCalls(calls, streams *int32) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			atomic.AddInt32(calls, 1)
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			atomic.AddInt32(streams, 1)
+			return handler(srv, ss)
+		}),
+	}
+}
+
+func dialUnary(t *testing.T, dialer grpc.DialOption, opts *grpcOptions) (*grpcTransport, transport.Socket) {
+	opts.UnaryCalls = true
+	opts.DialOptions = append(opts.DialOptions, dialer)
+
+	client := newTestTransport(opts)
+
+	s, err := client.Dial(context.Background(), "bufconn")
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return client, s
+}
+
+func TestUnaryCalls(t *testing.T) {
+	var calls, streams int32
+
+	l, dialer := listenInProcess(t, &grpcOptions{ServerOptions: countCalls(&calls, &streams)})
+	go l.Accept(context.Background(), echo)
+
+	_, s := dialUnary(t, dialer, &grpcOptions{})
+
+	// Messages can be sent ahead of receiving their answers
+	for _, data := range []string{"a", "b"} {
+		require.Nil(t, s.Send(context.Background(), &transport.Message{
+			MessageHeaders: map[string]string{"data": data},
+			Data:           []byte(data),
+		}))
+	}
+
+	for _, data := range []string{"a", "b"} {
+		var rec transport.Message
+		require.Nil(t, s.Receive(context.Background(), &rec))
+
+		assert.Equal(t, map[string]string{"data": data}, rec.MessageHeaders)
+		assert.Equal(t, []byte(data), rec.Data)
+	}
+
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	assert.Zero(t, atomic.LoadInt32(&streams))
+}
+
+func TestUnaryCalls_SwitchToStream(t *testing.T) {
+	var calls, streams int32
+
+	l, dialer := listenInProcess(t, &grpcOptions{ServerOptions: countCalls(&calls, &streams)})
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		if _, ok := s.(*grpcServerSocket); ok {
+			// Streams start with a message from the server
+			s.Send(context.Background(), &transport.Message{Data: []byte("hello")})
+		}
+		echo(s)
+	})
+
+	_, s := dialUnary(t, dialer, &grpcOptions{})
+
+	// Nothing was sent, so the message can only come from a stream
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+	assert.Equal(t, []byte("hello"), rec.Data)
+
+	// The socket keeps using it
+	w, err := s.(StreamSocket).SendStream(context.Background(), &transport.Message{})
+	require.Nil(t, err)
+	w.Write([]byte("body"))
+	require.Nil(t, w.Close())
+
+	require.Nil(t, s.Receive(context.Background(), &rec))
+	assert.Equal(t, []byte("body"), rec.Data)
+
+	assert.Zero(t, atomic.LoadInt32(&calls))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&streams))
+}
+
+// streamOnlyServer is the Transport service of servers from before unary calls were added,
+// which gRPC knows no Call method for.
+var streamOnlyServer = grpc.ServiceDesc{
+	ServiceName: "Transport",
+	HandlerType: (*internal.TransportServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Stream",
+		Handler: func(srv interface{}, ss grpc.ServerStream) error {
+			return srv.(internal.TransportServer).Stream(&oldServerStream{ss})
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+	Metadata: "transport.proto",
+}
+
+type oldServerStream struct {
+	grpc.ServerStream
+}
+
+func (s *oldServerStream) Send(m *internal.Message) error {
+	return s.SendMsg(m)
+}
+
+func (s *oldServerStream) Recv() (*internal.Message, error) {
+	m := new(internal.Message)
+	if err := s.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// serveWithoutCalls serves sv the way servers from before unary calls were added do.
+func serveWithoutCalls(t *testing.T, sv *server) grpc.DialOption {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	srv.RegisterService(&streamOnlyServer, sv)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})
+}
+
+func TestUnaryCalls_Unsupported(t *testing.T) {
+	var handled int32
+
+	dialer := serveWithoutCalls(t, &server{
+		callback: func(s transport.Socket) {
+			atomic.AddInt32(&handled, 1)
+			echo(s)
+		},
+		log:      logger.NewStdoutLogger(),
+		draining: make(chan struct{}),
+	})
+
+	client, s := dialUnary(t, dialer, &grpcOptions{})
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+	assert.Equal(t, []byte("hello"), rec.Data)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&handled))
+
+	// Streams are used right away from then on
+	assert.False(t, client.callable("bufconn"))
+}
+
+func TestUnaryCalls_UnimplementedByHandler(t *testing.T) {
+	var calls, streams, handled int32
+
+	opts := countCalls(&calls, &streams)
+	opts = append(opts, grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if string(req.(*internal.Message).Data) == "intercepted" {
+			return nil, status.Error(codes.Unimplemented, "rejected by an interceptor")
+		}
+		return handler(ctx, req)
+	}))
+
+	l, dialer := listenInProcess(t, &grpcOptions{ServerOptions: opts})
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		atomic.AddInt32(&handled, 1)
+		s.(ErrorCloser).CloseWithError(status.Error(codes.Unimplemented, "not supported by the handler"))
+	})
+
+	client, s := dialUnary(t, dialer, &grpcOptions{})
+
+	for _, data := range []string{"handled", "intercepted"} {
+		require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte(data)}))
+
+		// The caller gets the error, the message isn't sent again on a stream
+		var rec transport.Message
+		err := s.Receive(context.Background(), &rec)
+		assert.Equal(t, codes.Unimplemented, Status(err).Code(), data)
+	}
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&handled))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	assert.Zero(t, atomic.LoadInt32(&streams))
+	assert.True(t, client.callable("bufconn"))
+}
+
+func TestUnaryCalls_Errors(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{})
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		var msg transport.Message
+		s.Receive(context.Background(), &msg)
+
+		// Only one answer can be sent
+		if string(msg.Data) == "twice" {
+			s.Send(context.Background(), &msg)
+			assert.Equal(t, errAnswered, s.Send(context.Background(), &msg))
+			assert.Equal(t, io.EOF, s.Receive(context.Background(), &msg))
+		}
+
+		if string(msg.Data) == "fail" {
+			s.(ErrorCloser).CloseWithError(status.Error(codes.PermissionDenied, "not allowed"))
+		}
+		s.Close()
+	})
+
+	_, s := dialUnary(t, dialer, &grpcOptions{})
+
+	for data, code := range map[string]codes.Code{
+		"twice":  codes.OK,
+		"fail":   codes.PermissionDenied,
+		"ignore": codes.Aborted,
+	} {
+		require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte(data)}))
+
+		var rec transport.Message
+		err := s.Receive(context.Background(), &rec)
+		assert.Equal(t, code, Status(err).Code(), data)
+	}
+}
+
+func TestUnaryCalls_MetadataHeaders(t *testing.T) {
+	seen := make(chan metadata.MD, 1)
+
+	l, dialer := listenInProcess(t, &grpcOptions{
+		ServerOptions: []grpc.ServerOption{grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			seen <- md
+			return handler(ctx, req)
+		})},
+	})
+	go l.Accept(context.Background(), echo)
+
+	_, s := dialUnary(t, dialer, &grpcOptions{MetadataHeaders: true})
+
+	headers := map[string]string{"trace-id": "abc", "Upper": "1"}
+	require.Nil(t, s.Send(context.Background(), &transport.Message{MessageHeaders: headers}))
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+	assert.Equal(t, headers, rec.MessageHeaders)
+
+	md := <-seen
+	assert.Equal(t, []string{"abc"}, md.Get("trace-id"))
+	assert.Empty(t, md.Get("upper"))
+}
+
+// dialDefault dials addr with a transport that has the default options.
+func dialDefault(t *testing.T, ctx context.Context, addr string, opts ...Option) transport.Socket {
+	o := &options.Options{Logger: logger.NewStdoutLogger()}
+	Transport(opts...)(o)
+
+	s, err := o.Transport.Dial(ctx, addr)
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestUnaryCalls_EnabledByDefault(t *testing.T) {
+	var calls, streams int32
+
+	l, dialer := listenInProcess(t, &grpcOptions{ServerOptions: countCalls(&calls, &streams)})
+	go l.Accept(context.Background(), echo)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s := dialDefault(t, ctx, "bufconn", DialOptions(dialer))
+	require.Nil(t, s.Send(ctx, &transport.Message{Data: []byte("ping")}))
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(ctx, &rec))
+	assert.Equal(t, []byte("ping"), rec.Data)
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	assert.Zero(t, atomic.LoadInt32(&streams))
+}
+
+func TestUnaryCalls_Disabled(t *testing.T) {
+	l, dialer := listenInProcess(t, &grpcOptions{})
+
+	// The handler answers twice, which unary calls can't carry
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		go func() {
+			defer s.Close()
+
+			var msg transport.Message
+			if err := s.Receive(context.Background(), &msg); err != nil {
+				return
+			}
+			for _, data := range []string{"first", "second"} {
+				if err := s.Send(context.Background(), &transport.Message{Data: []byte(data)}); err != nil {
+					return
+				}
+			}
+		}()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s := dialDefault(t, ctx, "bufconn", DialOptions(dialer), UnaryCalls(false))
+	require.Nil(t, s.Send(ctx, &transport.Message{Data: []byte("ping")}))
+
+	for _, data := range []string{"first", "second"} {
+		var rec transport.Message
+		require.Nil(t, s.Receive(ctx, &rec))
+		assert.Equal(t, []byte(data), rec.Data)
+	}
+}
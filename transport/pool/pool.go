@@ -0,0 +1,518 @@
+// Package pool keeps connections to many addresses open so that transports can reuse them.
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("pool closed")
+
+// Defaults used by transports unless configured otherwise.
+const (
+	DefaultMaxIdle     = 10
+	DefaultMaxActive   = 20
+	DefaultIdleTimeout = 1 * time.Minute
+	DefaultEvictAfter  = 10 * time.Minute
+)
+
+// Config describes how connections are pooled. Dial and Close are required.
+type Config struct {
+	// MaxIdle is how many idle connections are kept for each address.
+	MaxIdle int
+
+	// MaxActive limits how many connections to an address may be open at once, idle or not.
+	// Get waits for a connection to be returned once it's reached. Zero means no limit.
+	MaxActive int
+
+	// IdleTimeout closes connections that have been idle for longer. Zero keeps them open.
+	IdleTimeout time.Duration
+
+	// EvictAfter drops the pool of an address that hasn't been used for this long, e.g.
+	// because the service behind it went away. Zero keeps pools forever.
+	EvictAfter time.Duration
+
+	Dial  func(ctx context.Context, addr string) (interface{}, error)
+	Close func(conn interface{}) error
+
+	// Ping checks an idle connection before Get hands it out. Connections that fail it are
+	// closed and replaced.
+	Ping func(conn interface{}) error
+
+	// KeepAlive is called on connections that have been idle for KeepAliveInterval, and then
+	// again every KeepAliveInterval. Connections that fail it are closed. Unlike Ping, it may
+	// take a while, e.g. to exchange messages with the peer. Connections are counted as active
+	// while being checked.
+	KeepAlive         func(conn interface{}) error
+	KeepAliveInterval time.Duration
+}
+
+// Stats is a snapshot of the connections to an address.
+type Stats struct {
+	// Active is the number of connections handed out by Get that haven't been returned yet.
+	Active int
+	Idle   int
+
+	// Waits counts the calls to Get that had to wait for a connection because MaxActive was reached.
+	Waits uint64
+
+	DialErrors uint64
+}
+
+// Observable is implemented by transports that pool their connections.
+type Observable interface {
+	PoolStats() map[string]Stats
+}
+
+// Pools holds a Pool for every address that has been dialed.
+type Pools struct {
+	cfg Config
+
+	mu     sync.Mutex
+	pools  map[string]*Pool
+	closed bool
+	stop   chan struct{}
+}
+
+func New(cfg Config) *Pools {
+	ps := &Pools{
+		cfg:   cfg,
+		pools: map[string]*Pool{},
+		stop:  make(chan struct{}),
+	}
+
+	if interval := cleanupInterval(cfg); interval > 0 {
+		go ps.cleanup(interval)
+	}
+
+	return ps
+}
+
+func cleanupInterval(cfg Config) time.Duration {
+	interval := cfg.IdleTimeout
+	if cfg.EvictAfter > 0 && (interval == 0 || cfg.EvictAfter < interval) {
+		interval = cfg.EvictAfter
+	}
+	if cfg.KeepAlive != nil && cfg.KeepAliveInterval > 0 && (interval == 0 || cfg.KeepAliveInterval < interval) {
+		interval = cfg.KeepAliveInterval
+	}
+
+	return interval / 2
+}
+
+// Pool returns the pool of connections to addr, creating it if needed.
+func (ps *Pools) Pool(addr string) *Pool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, ok := ps.pools[addr]
+	if !ok {
+		p = &Pool{
+			addr: addr,
+			cfg:  &ps.cfg,
+		}
+
+		if ps.closed {
+			p.closed = true
+		} else {
+			ps.pools[addr] = p
+		}
+	}
+
+	p.touch()
+
+	return p
+}
+
+// Get takes a connection to addr from its pool.
+func (ps *Pools) Get(ctx context.Context, addr string) (interface{}, error) {
+	return ps.Pool(addr).Get(ctx)
+}
+
+// Stats returns the stats of every address with a pool.
+func (ps *Pools) Stats() map[string]Stats {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	stats := make(map[string]Stats, len(ps.pools))
+	for addr, p := range ps.pools {
+		stats[addr] = p.Stats()
+	}
+
+	return stats
+}
+
+// Remove closes the pool of addr. Connections that are in use get closed once returned.
+func (ps *Pools) Remove(addr string) {
+	ps.mu.Lock()
+	p, ok := ps.pools[addr]
+	delete(ps.pools, addr)
+	ps.mu.Unlock()
+
+	if ok {
+		p.Close()
+	}
+}
+
+// Close closes every pool.
+func (ps *Pools) Close() {
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		return
+	}
+
+	ps.closed = true
+	close(ps.stop)
+
+	pools := ps.pools
+	ps.pools = map[string]*Pool{}
+	ps.mu.Unlock()
+
+	for _, p := range pools {
+		p.Close()
+	}
+}
+
+// cleanup periodically closes connections that have been idle for too long, checks the others
+// with KeepAlive, and drops the pools that haven't been used in a while.
+func (ps *Pools) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ps.stop:
+			return
+		case now := <-ticker.C:
+			var evicted []*Pool
+
+			ps.mu.Lock()
+			for addr, p := range ps.pools {
+				if p.unused(now) {
+					delete(ps.pools, addr)
+					evicted = append(evicted, p)
+				}
+			}
+			pools := make([]*Pool, 0, len(ps.pools))
+			for _, p := range ps.pools {
+				pools = append(pools, p)
+			}
+			ps.mu.Unlock()
+
+			for _, p := range evicted {
+				p.Close()
+			}
+			for _, p := range pools {
+				p.closeExpired(now)
+				p.keepAlive(now)
+			}
+		}
+	}
+}
+
+// Pool holds the connections to a single address.
+type Pool struct {
+	addr string
+	cfg  *Config
+
+	mu       sync.Mutex
+	idle     []idleConn
+	active   int
+	waiters  []chan grant
+	lastUsed time.Time
+	closed   bool
+
+	waits, dialErrors uint64
+}
+
+type idleConn struct {
+	conn  interface{}
+	since time.Time
+
+	// checked is when KeepAlive was last called on the connection.
+	checked time.Time
+}
+
+// grant is handed to a waiting Get, either with a returned connection or with the permission
+// to dial a new one if conn is nil.
+type grant struct {
+	conn interface{}
+	err  error
+}
+
+// Get returns an idle connection, or dials a new one if there's none. Once MaxActive is
+// reached it waits for a connection to be returned until ctx is done.
+func (p *Pool) Get(ctx context.Context) (interface{}, error) {
+	c, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if c != nil {
+		if p.cfg.Ping == nil || p.cfg.Ping(c) == nil {
+			return c, nil
+		}
+
+		// The connection is replaced by a new one, which takes its place in the count
+		p.cfg.Close(c)
+	}
+
+	c, err = p.cfg.Dial(ctx, p.addr)
+	if err != nil {
+		p.mu.Lock()
+		p.dialErrors++
+		p.release()
+		p.mu.Unlock()
+
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// acquire counts a new active connection, returning an idle one if there's any. A nil
+// connection means a new one must be dialed.
+func (p *Pool) acquire(ctx context.Context) (interface{}, error) {
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+
+	p.lastUsed = time.Now()
+
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1].conn
+		p.idle[n-1] = idleConn{}
+		p.idle = p.idle[:n-1]
+		p.active++
+		p.mu.Unlock()
+
+		return c, nil
+	}
+
+	if p.cfg.MaxActive <= 0 || p.active < p.cfg.MaxActive {
+		p.active++
+		p.mu.Unlock()
+
+		return nil, nil
+	}
+
+	req := make(chan grant, 1)
+	p.waiters = append(p.waiters, req)
+	p.waits++
+	p.mu.Unlock()
+
+	select {
+	case g := <-req:
+		return g.conn, g.err
+
+	case <-ctx.Done():
+		p.mu.Lock()
+		waiting := p.removeWaiter(req)
+		p.mu.Unlock()
+
+		if !waiting {
+			// Something was granted in the meantime, pass it on
+			if g := <-req; g.err == nil {
+				if g.conn != nil {
+					p.Put(g.conn)
+				} else {
+					p.mu.Lock()
+					p.release()
+					p.mu.Unlock()
+				}
+			}
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Pool) removeWaiter(req chan grant) bool {
+	for i, w := range p.waiters {
+		if w == req {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// release gives up an active connection that has been closed, letting the first waiter dial
+// a new one instead. Must be called with mu held.
+func (p *Pool) release() {
+	if len(p.waiters) > 0 {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		w <- grant{}
+		return
+	}
+
+	p.active--
+}
+
+// Put returns a connection to the pool, closing it if there are enough idle ones already.
+func (p *Pool) Put(c interface{}) error {
+	now := time.Now()
+	return p.put(idleConn{conn: c, since: now, checked: now})
+}
+
+func (p *Pool) put(ic idleConn) error {
+	c := ic.conn
+
+	p.mu.Lock()
+
+	if len(p.waiters) > 0 && !p.closed {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.mu.Unlock()
+
+		w <- grant{conn: c}
+		return nil
+	}
+
+	p.active--
+
+	if p.closed || len(p.idle) >= p.cfg.MaxIdle {
+		p.mu.Unlock()
+		return p.cfg.Close(c)
+	}
+
+	// Keep the stack sorted by idle time, connections that went through KeepAlive may be older
+	i := len(p.idle)
+	for i > 0 && p.idle[i-1].since.After(ic.since) {
+		i--
+	}
+	p.idle = append(p.idle, idleConn{})
+	copy(p.idle[i+1:], p.idle[i:])
+	p.idle[i] = ic
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Discard closes a connection taken from the pool that can't be reused.
+func (p *Pool) Discard(c interface{}) error {
+	err := p.cfg.Close(c)
+
+	p.mu.Lock()
+	p.release()
+	p.mu.Unlock()
+
+	return err
+}
+
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return Stats{
+		Active:     p.active,
+		Idle:       len(p.idle),
+		Waits:      p.waits,
+		DialErrors: p.dialErrors,
+	}
+}
+
+// Close closes the idle connections and makes Get fail from now on.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+
+	idle := p.idle
+	p.idle = nil
+
+	waiters := p.waiters
+	p.waiters = nil
+	p.mu.Unlock()
+
+	for _, w := range waiters {
+		w <- grant{err: ErrClosed}
+	}
+	for _, c := range idle {
+		p.cfg.Close(c.conn)
+	}
+}
+
+func (p *Pool) touch() {
+	p.mu.Lock()
+	p.lastUsed = time.Now()
+	p.mu.Unlock()
+}
+
+// unused returns whether the pool can be evicted.
+func (p *Pool) unused(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.cfg.EvictAfter > 0 && p.active == 0 && now.Sub(p.lastUsed) > p.cfg.EvictAfter
+}
+
+func (p *Pool) closeExpired(now time.Time) {
+	if p.cfg.IdleTimeout <= 0 {
+		return
+	}
+
+	var expired []idleConn
+
+	p.mu.Lock()
+	// The oldest connections are at the bottom of the stack
+	n := 0
+	for n < len(p.idle) && now.Sub(p.idle[n].since) > p.cfg.IdleTimeout {
+		n++
+	}
+
+	expired = append(expired, p.idle[:n]...)
+	p.idle = append(p.idle[:0], p.idle[n:]...)
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		p.cfg.Close(c.conn)
+	}
+}
+
+// keepAlive checks the connections that are due for it with KeepAlive. They are taken out of
+// the idle ones meanwhile, and put back where they were if they pass.
+func (p *Pool) keepAlive(now time.Time) {
+	if p.cfg.KeepAlive == nil || p.cfg.KeepAliveInterval <= 0 {
+		return
+	}
+
+	var due []idleConn
+
+	p.mu.Lock()
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if now.Sub(c.checked) >= p.cfg.KeepAliveInterval {
+			due = append(due, c)
+		} else {
+			idle = append(idle, c)
+		}
+	}
+	for i := len(idle); i < len(p.idle); i++ {
+		p.idle[i] = idleConn{}
+	}
+	p.idle = idle
+	p.active += len(due)
+	p.mu.Unlock()
+
+	for _, c := range due {
+		go p.check(c)
+	}
+}
+
+func (p *Pool) check(c idleConn) {
+	if err := p.cfg.KeepAlive(c.conn); err != nil {
+		p.Discard(c.conn)
+		return
+	}
+
+	c.checked = time.Now()
+	p.put(c)
+}
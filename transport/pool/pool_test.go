@@ -0,0 +1,332 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConn struct {
+	id     int
+	closed bool
+}
+
+// testDialer creates numbered connections and keeps track of the ones that were closed.
+type testDialer struct {
+	mu     sync.Mutex
+	dialed int
+	err    error
+}
+
+func (d *testDialer) config() Config {
+	return Config{
+		MaxIdle: 2,
+		Dial: func(ctx context.Context, addr string) (interface{}, error) {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+
+			if d.err != nil {
+				return nil, d.err
+			}
+
+			d.dialed++
+			return &testConn{id: d.dialed}, nil
+		},
+		Close: func(c interface{}) error {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+
+			c.(*testConn).closed = true
+			return nil
+		},
+	}
+}
+
+func TestPool_Reuse(t *testing.T) {
+	var d testDialer
+	ps := New(d.config())
+	defer ps.Close()
+
+	p := ps.Pool("a")
+
+	c1, err := p.Get(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, Stats{Active: 1}, p.Stats())
+
+	require.Nil(t, p.Put(c1))
+	assert.Equal(t, Stats{Idle: 1}, p.Stats())
+
+	c2, err := p.Get(context.Background())
+	require.Nil(t, err)
+	assert.Same(t, c1, c2)
+	assert.Equal(t, 1, d.dialed)
+}
+
+func TestPool_MaxIdle(t *testing.T) {
+	var d testDialer
+	ps := New(d.config())
+	defer ps.Close()
+
+	p := ps.Pool("a")
+
+	var conns []interface{}
+	for i := 0; i < 3; i++ {
+		c, err := p.Get(context.Background())
+		require.Nil(t, err)
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		p.Put(c)
+	}
+
+	assert.Equal(t, Stats{Idle: 2}, p.Stats())
+	assert.True(t, conns[2].(*testConn).closed)
+}
+
+func TestPool_MaxActive(t *testing.T) {
+	var d testDialer
+	cfg := d.config()
+	cfg.MaxActive = 1
+
+	ps := New(cfg)
+	defer ps.Close()
+
+	p := ps.Pool("a")
+
+	c1, err := p.Get(context.Background())
+	require.Nil(t, err)
+
+	got := make(chan interface{})
+	go func() {
+		c, _ := p.Get(context.Background())
+		got <- c
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	p.Put(c1)
+
+	assert.Same(t, c1, <-got)
+	assert.Equal(t, Stats{Active: 1, Waits: 1}, p.Stats())
+}
+
+func TestPool_MaxActive_Cancelled(t *testing.T) {
+	var d testDialer
+	cfg := d.config()
+	cfg.MaxActive = 1
+
+	ps := New(cfg)
+	defer ps.Close()
+
+	p := ps.Pool("a")
+
+	_, err := p.Get(context.Background())
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = p.Get(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, Stats{Active: 1, Waits: 1}, p.Stats())
+}
+
+func TestPool_DiscardLetsWaiterDial(t *testing.T) {
+	var d testDialer
+	cfg := d.config()
+	cfg.MaxActive = 1
+
+	ps := New(cfg)
+	defer ps.Close()
+
+	p := ps.Pool("a")
+
+	c1, err := p.Get(context.Background())
+	require.Nil(t, err)
+
+	got := make(chan interface{})
+	go func() {
+		c, _ := p.Get(context.Background())
+		got <- c
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	p.Discard(c1)
+
+	c2 := <-got
+	assert.True(t, c1.(*testConn).closed)
+	assert.Equal(t, 2, c2.(*testConn).id)
+	assert.Equal(t, 1, p.Stats().Active)
+}
+
+func TestPool_DialError(t *testing.T) {
+	d := testDialer{err: errors.New("refused")}
+	ps := New(d.config())
+	defer ps.Close()
+
+	_, err := ps.Get(context.Background(), "a")
+	assert.Equal(t, d.err, err)
+
+	assert.Equal(t, map[string]Stats{"a": {DialErrors: 1}}, ps.Stats())
+}
+
+func TestPool_Ping(t *testing.T) {
+	var d testDialer
+	cfg := d.config()
+	cfg.Ping = func(c interface{}) error {
+		if c.(*testConn).id == 1 {
+			return errors.New("dead")
+		}
+		return nil
+	}
+
+	ps := New(cfg)
+	defer ps.Close()
+
+	p := ps.Pool("a")
+
+	c1, err := p.Get(context.Background())
+	require.Nil(t, err)
+	p.Put(c1)
+
+	c2, err := p.Get(context.Background())
+	require.Nil(t, err)
+
+	assert.True(t, c1.(*testConn).closed)
+	assert.Equal(t, 2, c2.(*testConn).id)
+	assert.Equal(t, Stats{Active: 1}, p.Stats())
+}
+
+func TestPools_IdleTimeout(t *testing.T) {
+	var d testDialer
+	cfg := d.config()
+	cfg.IdleTimeout = 20 * time.Millisecond
+
+	ps := New(cfg)
+	defer ps.Close()
+
+	c, err := ps.Get(context.Background(), "a")
+	require.Nil(t, err)
+	ps.Pool("a").Put(c)
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, map[string]Stats{"a": {}}, ps.Stats())
+	assert.True(t, c.(*testConn).closed)
+}
+
+func TestPools_Evict(t *testing.T) {
+	var d testDialer
+	cfg := d.config()
+	cfg.EvictAfter = 20 * time.Millisecond
+
+	ps := New(cfg)
+	defer ps.Close()
+
+	c, err := ps.Get(context.Background(), "a")
+	require.Nil(t, err)
+
+	_, err = ps.Get(context.Background(), "b")
+	require.Nil(t, err)
+
+	ps.Pool("a").Put(c)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Pools with connections in use are kept
+	assert.Equal(t, map[string]Stats{"b": {Active: 1}}, ps.Stats())
+	assert.True(t, c.(*testConn).closed)
+}
+
+func TestPools_Close(t *testing.T) {
+	var d testDialer
+	ps := New(d.config())
+
+	p := ps.Pool("a")
+
+	c, err := p.Get(context.Background())
+	require.Nil(t, err)
+
+	ps.Close()
+
+	_, err = p.Get(context.Background())
+	assert.Equal(t, ErrClosed, err)
+
+	_, err = ps.Get(context.Background(), "b")
+	assert.Equal(t, ErrClosed, err)
+
+	p.Put(c)
+	assert.True(t, c.(*testConn).closed)
+}
+
+func TestPools_KeepAlive(t *testing.T) {
+	var d testDialer
+	cfg := d.config()
+	cfg.KeepAliveInterval = 20 * time.Millisecond
+
+	var mu sync.Mutex
+	checks := map[int]int{}
+	cfg.KeepAlive = func(c interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		id := c.(*testConn).id
+		checks[id]++
+
+		if id == 1 {
+			return errors.New("dead")
+		}
+		return nil
+	}
+
+	ps := New(cfg)
+	defer ps.Close()
+
+	p := ps.Pool("a")
+
+	c1, err := p.Get(context.Background())
+	require.Nil(t, err)
+	c2, err := p.Get(context.Background())
+	require.Nil(t, err)
+
+	p.Put(c1)
+	p.Put(c2)
+
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, 1, checks[1])
+	assert.Greater(t, checks[2], 1)
+	mu.Unlock()
+
+	assert.True(t, c1.(*testConn).closed)
+	assert.False(t, c2.(*testConn).closed)
+
+	stats := p.Stats()
+	assert.Equal(t, 1, stats.Idle+stats.Active)
+}
+
+func TestPools_KeepAliveKeepsIdleTimeout(t *testing.T) {
+	var d testDialer
+	cfg := d.config()
+	cfg.IdleTimeout = 60 * time.Millisecond
+	cfg.KeepAliveInterval = 10 * time.Millisecond
+	cfg.KeepAlive = func(c interface{}) error { return nil }
+
+	ps := New(cfg)
+	defer ps.Close()
+
+	c, err := ps.Get(context.Background(), "a")
+	require.Nil(t, err)
+	ps.Pool("a").Put(c)
+
+	time.Sleep(150 * time.Millisecond)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	assert.True(t, c.(*testConn).closed)
+}
@@ -0,0 +1,5 @@
+module github.com/MouseHatGames/mice-plugins/transport/portmux
+
+go 1.16
+
+require github.com/stretchr/testify v1.7.1
@@ -0,0 +1,319 @@
+// Package portmux lets several transports share a port. It looks at the first bytes of each
+// connection to tell which protocol it speaks and hands it to the listener of that protocol.
+package portmux
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Protocol is a kind of connection that can be told apart from the others by its first bytes.
+type Protocol int
+
+const (
+	// TCP gets the connections that don't match any other protocol, such as those of the tcp
+	// transport.
+	TCP Protocol = iota
+
+	// GRPC gets HTTP/2 connections without TLS, which is what the grpc transport uses.
+	GRPC
+
+	// HTTP gets HTTP/1.x connections, e.g. for health checks.
+	HTTP
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case TCP:
+		return "tcp"
+	case GRPC:
+		return "grpc"
+	case HTTP:
+		return "http"
+	}
+
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+var ErrProtocolTaken = errors.New("protocol already has a listener on this address")
+
+// sniffTimeout is how long a new connection has to send enough bytes to tell its protocol.
+var sniffTimeout = 10 * time.Second
+
+// http2Preface is sent by HTTP/2 clients before anything else.
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// httpMethods start the request line of HTTP/1.x requests.
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("PATCH "),
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]*mux{}
+)
+
+// Listen returns a listener for the connections speaking p that arrive at address. The first
+// call for an address starts listening on it, later ones with the same address share it. The
+// port is closed once every listener on it has been closed.
+//
+// Connections are only told apart by their first bytes, so protocols wrapped in TLS can't
+// share a port with each other. For the same reason, connections starting with a PROXY
+// protocol header, as sent by some load balancers, always go to TCP. Connections of a protocol
+// nobody listens for are closed, and so are those that don't send enough bytes to tell their
+// protocol within 10 seconds.
+func Listen(network, address string, p Protocol) (net.Listener, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	m, ok := registry[network+" "+address]
+	if !ok {
+		l, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		m = &mux{
+			l:            l,
+			keys:         []string{network + " " + l.Addr().String()},
+			subs:         map[Protocol]*listener{},
+			sniffTimeout: sniffTimeout,
+		}
+
+		// Asking for any port twice shouldn't get the same one
+		if _, port, err := net.SplitHostPort(address); err != nil || port != "0" {
+			m.keys = append(m.keys, network+" "+address)
+		}
+
+		for _, k := range m.keys {
+			registry[k] = m
+		}
+
+		go m.serve()
+	}
+
+	return m.add(p)
+}
+
+// mux routes the connections accepted on a port to the listener of their protocol.
+type mux struct {
+	l    net.Listener
+	keys []string
+
+	sniffTimeout time.Duration
+
+	mu   sync.Mutex
+	subs map[Protocol]*listener
+	err  error
+}
+
+func (m *mux) add(p Protocol) (*listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	if _, ok := m.subs[p]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrProtocolTaken, p)
+	}
+
+	sub := &listener{
+		m:     m,
+		p:     p,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	m.subs[p] = sub
+
+	return sub, nil
+}
+
+// remove stops routing connections to sub, closing the port if it was the last listener.
+func (m *mux) remove(sub *listener) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	m.mu.Lock()
+	if m.subs[sub.p] != sub {
+		m.mu.Unlock()
+		return
+	}
+
+	delete(m.subs, sub.p)
+	last := len(m.subs) == 0
+	m.mu.Unlock()
+
+	if last {
+		for _, k := range m.keys {
+			if registry[k] == m {
+				delete(registry, k)
+			}
+		}
+
+		m.l.Close()
+	}
+}
+
+func (m *mux) serve() {
+	for {
+		c, err := m.l.Accept()
+		if err != nil {
+			m.fail(err)
+			return
+		}
+
+		go m.route(c)
+	}
+}
+
+// fail makes every listener return err from Accept.
+func (m *mux) fail(err error) {
+	m.mu.Lock()
+	m.err = err
+	subs := make([]*listener, 0, len(m.subs))
+	for _, sub := range m.subs {
+		subs = append(subs, sub)
+	}
+	m.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.fail(err)
+	}
+}
+
+func (m *mux) route(c net.Conn) {
+	// Connections that don't send anything would otherwise be kept open forever
+	if err := c.SetReadDeadline(time.Now().Add(m.sniffTimeout)); err != nil {
+		c.Close()
+		return
+	}
+
+	r := bufio.NewReader(c)
+
+	p, err := sniff(r)
+	if err == nil {
+		err = c.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	m.mu.Lock()
+	sub := m.subs[p]
+	m.mu.Unlock()
+
+	if sub == nil {
+		c.Close()
+		return
+	}
+
+	sub.deliver(&conn{Conn: c, r: r})
+}
+
+// sniff reads as many bytes as needed to tell which protocol a connection speaks, leaving
+// them in r.
+func sniff(r *bufio.Reader) (Protocol, error) {
+	candidates := make([][]byte, 0, len(httpMethods)+1)
+	candidates = append(candidates, http2Preface)
+	candidates = append(candidates, httpMethods...)
+
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return 0, err
+		}
+
+		remaining := candidates[:0]
+		for _, c := range candidates {
+			if !bytes.HasPrefix(c, b) {
+				continue
+			}
+			if len(c) == n {
+				if bytes.Equal(c, http2Preface) {
+					return GRPC, nil
+				}
+				return HTTP, nil
+			}
+
+			remaining = append(remaining, c)
+		}
+
+		if len(remaining) == 0 {
+			return TCP, nil
+		}
+		candidates = remaining
+	}
+}
+
+// listener accepts the connections of a single protocol.
+type listener struct {
+	m     *mux
+	p     Protocol
+	conns chan net.Conn
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func (l *listener) deliver(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *listener) fail(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *listener) Close() error {
+	l.fail(net.ErrClosed)
+	l.m.remove(l)
+
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.m.l.Addr()
+}
+
+// conn gives back the bytes that were read to find out its protocol.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,206 @@
+package portmux
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		input string
+		p     Protocol
+	}{
+		{"MICE\x01\x00\x00\x00\x00", TCP},
+		{"\x05\x00\x00\x00hello", TCP},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", TCP},
+		{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", GRPC},
+		{"GET /health HTTP/1.1\r\n", HTTP},
+		{"POST / HTTP/1.1\r\n", HTTP},
+		{"PUT / HTTP/1.1\r\n", HTTP},
+	}
+
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.input))
+
+		p, err := sniff(r)
+		require.Nil(t, err, "%q", tt.input)
+		assert.Equal(t, tt.p, p, "%q", tt.input)
+
+		// Nothing is consumed
+		rest, _ := r.Peek(len(tt.input))
+		assert.Equal(t, tt.input, string(rest))
+	}
+}
+
+// accept reads the first line sent on the next connection accepted by l.
+func accept(l net.Listener) <-chan string {
+	lines := make(chan string, 1)
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(lines)
+			return
+		}
+		defer c.Close()
+
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		lines <- line
+	}()
+
+	return lines
+}
+
+func send(t *testing.T, addr, data string) {
+	c, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte(data))
+	require.Nil(t, err)
+}
+
+func TestListen_Routes(t *testing.T) {
+	tcp, err := Listen("tcp", "127.0.0.1:0", TCP)
+	require.Nil(t, err)
+	defer tcp.Close()
+
+	addr := tcp.Addr().String()
+
+	grpc, err := Listen("tcp", addr, GRPC)
+	require.Nil(t, err)
+	defer grpc.Close()
+
+	_, err = Listen("tcp", addr, GRPC)
+	assert.ErrorIs(t, err, ErrProtocolTaken)
+
+	tcpLines, grpcLines := accept(tcp), accept(grpc)
+
+	send(t, addr, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	send(t, addr, "MICE\n")
+
+	assert.Equal(t, "PRI * HTTP/2.0\r\n", <-grpcLines)
+	assert.Equal(t, "MICE\n", <-tcpLines)
+}
+
+func TestListen_NoListenerForProtocol(t *testing.T) {
+	tcp, err := Listen("tcp", "127.0.0.1:0", TCP)
+	require.Nil(t, err)
+	defer tcp.Close()
+
+	c, err := net.Dial("tcp", tcp.Addr().String())
+	require.Nil(t, err)
+	defer c.Close()
+
+	c.Write([]byte("GET / HTTP/1.1\r\n"))
+	c.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = c.Read(make([]byte, 1))
+	assert.NotNil(t, err, "connection should have been closed")
+}
+
+func TestListen_HTTP(t *testing.T) {
+	tcp, err := Listen("tcp", "127.0.0.1:0", TCP)
+	require.Nil(t, err)
+	defer tcp.Close()
+
+	addr := tcp.Addr().String()
+
+	hl, err := Listen("tcp", addr, HTTP)
+	require.Nil(t, err)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go srv.Serve(hl)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + addr + "/health")
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestListen_CloseLast(t *testing.T) {
+	tcp, err := Listen("tcp", "127.0.0.1:0", TCP)
+	require.Nil(t, err)
+
+	addr := tcp.Addr().String()
+
+	grpc, err := Listen("tcp", addr, GRPC)
+	require.Nil(t, err)
+
+	require.Nil(t, tcp.Close())
+
+	_, err = tcp.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	// The port stays open while a listener is left
+	c, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	c.Close()
+
+	require.Nil(t, grpc.Close())
+
+	// Listening again opens the port anew
+	l, err := Listen("tcp", addr, TCP)
+	require.Nil(t, err)
+	l.Close()
+}
+
+func TestListen_SniffTimeout(t *testing.T) {
+	defer func(d time.Duration) { sniffTimeout = d }(sniffTimeout)
+	sniffTimeout = 50 * time.Millisecond
+
+	tcp, err := Listen("tcp", "127.0.0.1:0", TCP)
+	require.Nil(t, err)
+	defer tcp.Close()
+
+	for _, prefix := range []string{"", "P", "GE"} {
+		c, err := net.Dial("tcp", tcp.Addr().String())
+		require.Nil(t, err)
+		defer c.Close()
+
+		c.Write([]byte(prefix))
+		c.SetReadDeadline(time.Now().Add(time.Second))
+
+		// The connection is closed by the server rather than timing out here
+		_, err = c.Read(make([]byte, 1))
+		var nerr net.Error
+		if errors.As(err, &nerr) {
+			assert.False(t, nerr.Timeout(), "%q: connection should have been closed", prefix)
+		}
+		assert.NotNil(t, err, "%q", prefix)
+	}
+}
+
+func TestListen_DeadlineClearedOnceRouted(t *testing.T) {
+	defer func(d time.Duration) { sniffTimeout = d }(sniffTimeout)
+	sniffTimeout = 50 * time.Millisecond
+
+	tcp, err := Listen("tcp", "127.0.0.1:0", TCP)
+	require.Nil(t, err)
+	defer tcp.Close()
+
+	lines := accept(tcp)
+
+	c, err := net.Dial("tcp", tcp.Addr().String())
+	require.Nil(t, err)
+	defer c.Close()
+
+	// The rest of the line comes after the sniff timeout
+	c.Write([]byte("x"))
+	time.Sleep(100 * time.Millisecond)
+	c.Write([]byte("yz\n"))
+
+	assert.Equal(t, "xyz\n", <-lines)
+}
@@ -0,0 +1,356 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+
+	"github.com/MouseHatGames/mice/transport"
+)
+
+// Connections that negotiated featureStreaming can send a message as a data frame with
+// flagStream that only holds its headers, followed by chunk frames carrying its body. The
+// last chunk has flagEndStream set, or flagAbort if the sender gave up on the body, in which
+// case its payload is the reason.
+//
+// On plain connections bodies are read straight from the connection, so TCP's own flow control
+// keeps the sender from getting too far ahead. On multiplexed ones every stream may only have
+// streamWindow bytes of chunks in flight, the receiver handing out more with window frames as
+// the body is read.
+
+var (
+	ErrStreamingUnsupported = errors.New("peer does not support streaming")
+
+	// ErrBodyAborted is returned when reading a body the sender gave up on.
+	ErrBodyAborted = errors.New("body aborted by sender")
+)
+
+const (
+	// flagStream marks a data frame whose body follows in chunk frames.
+	flagStream byte = 1 << 1
+
+	// flagEndStream marks the last chunk of a body.
+	flagEndStream byte = 1 << 2
+
+	// flagAbort marks a chunk that ends a body early, its payload is the reason.
+	flagAbort byte = 1 << 3
+)
+
+// maxChunkSize is the largest piece of a body sent in a single frame.
+const maxChunkSize = 32 << 10
+
+// streamWindow is how many body bytes a multiplexed stream may send before the receiver has
+// read them.
+const streamWindow = 256 << 10
+
+// StreamSocket is implemented by the sockets of this transport. Type assert a socket to it to
+// send or receive messages without holding their whole body in memory.
+type StreamSocket interface {
+	transport.Socket
+
+	// SendStream sends msg's headers and returns a writer for its body, which starts with
+	// msg.Data. The message is complete once the writer is closed, and no other message can be
+	// sent on the socket until then. It fails with ErrStreamingUnsupported unless both ends
+	// speak protocol v1.
+	SendStream(ctx context.Context, msg *transport.Message) (BodyWriter, error)
+
+	// ReceiveStream reads the headers of the next message into msg and returns a reader for
+	// its body, leaving msg.Data empty. Messages sent with Send are received this way too. The
+	// reader must be closed before receiving the next message, and closing it before the end
+	// of the body closes plain connections since they can't be used for anything else.
+	ReceiveStream(ctx context.Context, msg *transport.Message) (io.ReadCloser, error)
+}
+
+// BodyWriter writes the body of a streamed message. ctx of the call that returned it applies
+// to every write.
+type BodyWriter interface {
+	io.WriteCloser
+
+	// CloseWithError ends the body early, making the receiver fail with ErrBodyAborted.
+	CloseWithError(err error) error
+}
+
+var (
+	_ StreamSocket = (*tcpSocket)(nil)
+	_ StreamSocket = (*muxStream)(nil)
+)
+
+// bodyWriter cuts a body into chunks and sends them with send.
+type bodyWriter struct {
+	ctx  context.Context
+	send func(ctx context.Context, flags byte, chunk []byte) error
+
+	// release is called once the body is done, letting other messages through.
+	release func()
+
+	buf    *[]byte
+	err    error
+	closed bool
+}
+
+// startBody returns a writer for a body that starts with data.
+func startBody(ctx context.Context, data []byte, send func(context.Context, byte, []byte) error, release func()) (BodyWriter, error) {
+	buf := getBuffer()
+	*buf = slices.Grow(*buf, maxChunkSize)
+
+	w := &bodyWriter{
+		ctx:     ctx,
+		send:    send,
+		release: release,
+		buf:     buf,
+	}
+
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *bodyWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// Full chunks are only sent once there's more, so that the last one can end the body
+		if len(*w.buf) == maxChunkSize {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy((*w.buf)[len(*w.buf):maxChunkSize], p)
+		*w.buf = (*w.buf)[:len(*w.buf)+c]
+
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+func (w *bodyWriter) flush() error {
+	w.err = w.send(w.ctx, 0, *w.buf)
+	*w.buf = (*w.buf)[:0]
+
+	return w.err
+}
+
+func (w *bodyWriter) Close() error {
+	return w.end(flagEndStream, *w.buf)
+}
+
+func (w *bodyWriter) CloseWithError(err error) error {
+	if err == nil {
+		err = ErrBodyAborted
+	}
+
+	return w.end(flagAbort, []byte(err.Error()))
+}
+
+func (w *bodyWriter) end(flags byte, payload []byte) error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+
+	if w.err == nil {
+		w.err = w.send(w.ctx, flags, payload)
+	}
+
+	putBuffer(w.buf)
+	w.release()
+
+	return w.err
+}
+
+// readBody reads a whole streamed body into msg.Data, for receivers that didn't ask for a stream.
+func readBody(body io.ReadCloser, msg *transport.Message, max int) error {
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, int64(max)+1))
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+	if len(data) > max {
+		return fmt.Errorf("%w: streamed body is larger than %d bytes", ErrMessageTooLarge, max)
+	}
+
+	msg.Data = data
+	return nil
+}
+
+// SendStream implements StreamSocket.
+func (s *tcpSocket) SendStream(ctx context.Context, msg *transport.Message) (BodyWriter, error) {
+	if !s.proto.features.has(featureStreaming) {
+		return nil, ErrStreamingUnsupported
+	}
+
+	s.mb.Lock()
+
+	err := s.sendMessage(ctx, frameHeader{typ: frameData, flags: flagStream}, &transport.Message{MessageHeaders: msg.MessageHeaders})
+	if err != nil {
+		s.mb.Unlock()
+		return nil, err
+	}
+
+	return startBody(ctx, msg.Data, func(ctx context.Context, flags byte, chunk []byte) error {
+		return s.sendChunk(ctx, frameHeader{typ: frameChunk, flags: flags}, chunk)
+	}, s.mb.Unlock)
+}
+
+// sendChunk writes a frame with a piece of a body. Since the body can't be finished after an
+// error, the connection is closed if that happens.
+func (s *tcpSocket) sendChunk(ctx context.Context, h frameHeader, chunk []byte) error {
+	s.ms.Lock()
+	defer s.ms.Unlock()
+
+	done := withContext(ctx, s.conn, net.Conn.SetWriteDeadline)
+
+	err := done(s.writeChunk(h, chunk))
+	if err != nil {
+		s.breakConn()
+	}
+
+	return err
+}
+
+func (s *tcpSocket) writeChunk(h frameHeader, chunk []byte) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if c := s.proto.compression(); c != NoCompression && h.flags&flagAbort == 0 && len(chunk) >= s.compressMin {
+		out := getBuffer()
+		defer putBuffer(out)
+
+		compressed, err := compress(c, *out, chunk)
+		if err != nil {
+			return fmt.Errorf("compress chunk: %w", err)
+		}
+		*out = compressed
+
+		if len(compressed) < len(chunk) {
+			chunk = compressed
+			h.flags |= flagCompressed
+		}
+	}
+
+	h.length = uint32(len(chunk))
+
+	if err := s.writeFrame(buf, s.proto.appendFrameHeader(*buf, h), chunk); err != nil {
+		return fmt.Errorf("write frame: %w", err)
+	}
+
+	return nil
+}
+
+// ReceiveStream implements StreamSocket. The socket can't receive anything else until the
+// body has been read or closed.
+func (s *tcpSocket) ReceiveStream(ctx context.Context, msg *transport.Message) (io.ReadCloser, error) {
+	s.mr.Lock()
+
+	h, err := s.receive(ctx, msg)
+	if err != nil {
+		s.mr.Unlock()
+		return nil, err
+	}
+
+	if h.flags&flagStream == 0 {
+		s.mr.Unlock()
+
+		data := msg.Data
+		msg.Data = nil
+
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	msg.Data = nil
+	return &socketBody{s: s, ctx: ctx, release: s.mr.Unlock}, nil
+}
+
+// socketBody reads a streamed body straight from a plain connection.
+type socketBody struct {
+	s   *tcpSocket
+	ctx context.Context
+
+	// release is called once the body has been read, letting the next message through.
+	release func()
+
+	chunk []byte
+	err   error
+}
+
+func (b *socketBody) Read(p []byte) (int, error) {
+	for len(b.chunk) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		b.next()
+	}
+
+	n := copy(p, b.chunk)
+	b.chunk = b.chunk[n:]
+
+	return n, nil
+}
+
+// next reads the next chunk of the body.
+func (b *socketBody) next() {
+	s := b.s
+
+	done := withContext(b.ctx, s.conn, net.Conn.SetReadDeadline)
+
+	h, payload, err := s.readAnsweringPings(s.readFrame)
+	if err = done(err); err == nil && h.typ != frameChunk {
+		err = fmt.Errorf("%w: unexpected frame type %d in body", ErrMalformedFrame, h.typ)
+	}
+	if err != nil {
+		s.breakConn()
+		b.finish(err)
+		return
+	}
+
+	switch {
+	case h.flags&flagAbort != 0:
+		b.finish(fmt.Errorf("%w: %s", ErrBodyAborted, payload))
+
+	case h.flags&flagEndStream != 0:
+		b.chunk = payload
+		b.finish(io.EOF)
+
+	default:
+		b.chunk = payload
+	}
+}
+
+func (b *socketBody) finish(err error) {
+	b.err = err
+
+	if b.release != nil {
+		b.release()
+		b.release = nil
+	}
+}
+
+func (b *socketBody) Close() error {
+	if b.err == nil {
+		// The rest of the body is still on its way
+		b.s.breakConn()
+	}
+
+	b.chunk = nil
+	b.finish(io.ErrClosedPipe)
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenStreams starts a server that hands every socket to fn.
+func listenStreams(t *testing.T, opts *tcpOptions, fn func(StreamSocket)) string {
+	server := newTestTransport(opts)
+
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		defer s.Close()
+		fn(s.(StreamSocket))
+	})
+
+	return l.(*tcpListener).Addr().String()
+}
+
+// echoStream sends every message it receives back as a streamed body.
+func echoStream(s StreamSocket) {
+	for {
+		var msg transport.Message
+
+		body, err := s.ReceiveStream(context.Background(), &msg)
+		if err != nil {
+			return
+		}
+
+		w, err := s.SendStream(context.Background(), &msg)
+		if err != nil {
+			return
+		}
+
+		if _, err := io.Copy(w, body); err != nil {
+			w.CloseWithError(err)
+		} else {
+			w.Close()
+		}
+		body.Close()
+	}
+}
+
+func dialStream(t *testing.T, opts *tcpOptions, addr string) StreamSocket {
+	s, err := newTestTransport(opts).Dial(context.Background(), addr)
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s.(StreamSocket)
+}
+
+func TestStream_RoundTrip(t *testing.T) {
+	data := batchPayload(3 << 20)
+
+	for _, opts := range []*tcpOptions{
+		{ProtocolVersion: ProtocolV1},
+		{UseMultiplexing: true},
+		{Compression: Zstd},
+	} {
+		addr := listenStreams(t, &tcpOptions{}, echoStream)
+		s := dialStream(t, opts, addr)
+
+		w, err := s.SendStream(context.Background(), &transport.Message{
+			MessageHeaders: map[string]string{"a": "1"},
+			Data:           data[:10],
+		})
+		require.Nil(t, err)
+
+		// The echo only finishes once the whole body has been read, so read it as it comes
+		done := make(chan error, 1)
+		go func() {
+			_, err := w.Write(data[10:])
+			if err == nil {
+				err = w.Close()
+			}
+			done <- err
+		}()
+
+		var rec transport.Message
+		body, err := s.ReceiveStream(context.Background(), &rec)
+		require.Nil(t, err)
+
+		got, err := io.ReadAll(body)
+		require.Nil(t, err)
+		require.Nil(t, body.Close())
+		require.Nil(t, <-done)
+
+		assert.Equal(t, map[string]string{"a": "1"}, rec.MessageHeaders)
+		assert.Nil(t, rec.Data)
+		assert.True(t, bytes.Equal(data, got), "body differs")
+
+		// The socket can still be used for regular messages
+		require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+		require.Nil(t, s.Receive(context.Background(), &rec))
+		assert.Equal(t, []byte("hello"), rec.Data)
+	}
+}
+
+func TestStream_Abort(t *testing.T) {
+	for _, mux := range []bool{false, true} {
+		addr := listenStreams(t, &tcpOptions{}, echoStream)
+		s := dialStream(t, &tcpOptions{ProtocolVersion: ProtocolV1, UseMultiplexing: mux}, addr)
+
+		w, err := s.SendStream(context.Background(), &transport.Message{Data: []byte("partial")})
+		require.Nil(t, err)
+		require.Nil(t, w.CloseWithError(io.ErrShortWrite))
+
+		var rec transport.Message
+		body, err := s.ReceiveStream(context.Background(), &rec)
+		require.Nil(t, err)
+
+		_, err = io.ReadAll(body)
+		assert.ErrorIs(t, err, ErrBodyAborted, "mux: %v", mux)
+		assert.Contains(t, err.Error(), io.ErrShortWrite.Error())
+		body.Close()
+	}
+}
+
+func TestStream_ReceiveWhole(t *testing.T) {
+	for _, mux := range []bool{false, true} {
+		received := make(chan *transport.Message, 1)
+		addr := listenStreams(t, &tcpOptions{MaxMessageSize: 1 << 20}, func(s StreamSocket) {
+			for {
+				var msg transport.Message
+				if err := s.Receive(context.Background(), &msg); err != nil {
+					return
+				}
+				received <- &msg
+			}
+		})
+		s := dialStream(t, &tcpOptions{ProtocolVersion: ProtocolV1, UseMultiplexing: mux}, addr)
+
+		data := batchPayload(100 << 10)
+
+		w, err := s.SendStream(context.Background(), &transport.Message{})
+		require.Nil(t, err)
+		_, err = w.Write(data)
+		require.Nil(t, err)
+		require.Nil(t, w.Close())
+
+		msg := <-received
+		assert.Equal(t, data, msg.Data, "mux: %v", mux)
+	}
+}
+
+func TestStream_ReceiveWhole_TooLarge(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	p := protocol{version: ProtocolV1, features: featureStreaming}
+	sender, receiver := newSocket(c1), newSocket(c2)
+	sender.proto, receiver.proto = p, p
+	receiver.maxMessage = 100 << 10
+
+	go func() {
+		w, err := sender.SendStream(context.Background(), &transport.Message{})
+		if err != nil {
+			return
+		}
+
+		w.Write(batchPayload(200 << 10))
+		w.Close()
+	}()
+
+	var msg transport.Message
+	err := receiver.Receive(context.Background(), &msg)
+
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	assert.NotZero(t, receiver.broken)
+}
+
+func TestStream_ReceivePlainMessage(t *testing.T) {
+	addr := listenStreams(t, &tcpOptions{}, func(s StreamSocket) { echoAll(s) })
+	s := dialStream(t, &tcpOptions{}, addr)
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+
+	var rec transport.Message
+	body, err := s.ReceiveStream(context.Background(), &rec)
+	require.Nil(t, err)
+	defer body.Close()
+
+	got, err := io.ReadAll(body)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("hello"), got)
+}
+
+func TestStream_Unsupported(t *testing.T) {
+	addr := listenStreams(t, &tcpOptions{}, func(s StreamSocket) { echoAll(s) })
+	s := dialStream(t, &tcpOptions{ProtocolVersion: ProtocolV0}, addr)
+
+	_, err := s.SendStream(context.Background(), &transport.Message{})
+	assert.Equal(t, ErrStreamingUnsupported, err)
+}
+
+// countingWriter counts the bytes written to a BodyWriter.
+type countingWriter struct {
+	BodyWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.BodyWriter.Write(p)
+	atomic.AddInt64(&w.n, int64(n))
+	return n, err
+}
+
+func TestMultiplexing_StreamFlowControl(t *testing.T) {
+	bodies := make(chan io.ReadCloser)
+	addr := listenStreams(t, &tcpOptions{}, func(s StreamSocket) {
+		var msg transport.Message
+		body, err := s.ReceiveStream(context.Background(), &msg)
+		if err != nil {
+			return
+		}
+
+		if _, ok := msg.MessageHeaders["first"]; ok {
+			// Let the test decide when to read the body, keeping the stream open until then
+			bodies <- body
+			echoAll(s)
+			return
+		}
+
+		msg.Data, _ = io.ReadAll(body)
+		body.Close()
+		s.Send(context.Background(), &msg)
+	})
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	bw, err := s.(StreamSocket).SendStream(context.Background(), &transport.Message{MessageHeaders: map[string]string{"first": ""}})
+	require.Nil(t, err)
+
+	w := &countingWriter{BodyWriter: bw}
+	data := batchPayload(2 << 20)
+
+	done := make(chan error, 1)
+	go func() {
+		for p := data; len(p) > 0; p = p[4096:] {
+			if _, err := w.Write(p[:4096]); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- w.Close()
+	}()
+
+	body := <-bodies
+
+	// The writer stalls once the window is used up, since nobody reads the body
+	time.Sleep(100 * time.Millisecond)
+	n := atomic.LoadInt64(&w.n)
+	assert.Greater(t, n, int64(0))
+	assert.LessOrEqual(t, n, int64(streamWindow+maxChunkSize))
+
+	// Other streams on the connection aren't held up by it
+	other, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer other.Close()
+
+	require.Nil(t, other.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+
+	var rec transport.Message
+	require.Nil(t, other.Receive(context.Background(), &rec))
+	assert.Equal(t, []byte("hello"), rec.Data)
+
+	got, err := io.ReadAll(body)
+	require.Nil(t, err)
+	require.Nil(t, body.Close())
+	require.Nil(t, <-done)
+
+	assert.True(t, bytes.Equal(data, got), "body differs")
+}
@@ -0,0 +1,29 @@
+package tcp
+
+import "sync"
+
+// Frames are encoded into pooled buffers so that sending a message doesn't allocate. Sockets
+// that reuse their receive buffer take one from the pool too, and give it back once closed.
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// maxPooledBuffer is the capacity above which buffers aren't returned to the pool, so that a
+// few large messages don't keep lots of memory around.
+const maxPooledBuffer = 1 << 20
+
+func getBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+
+	*b = (*b)[:0]
+	buffers.Put(b)
+}
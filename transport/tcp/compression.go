@@ -0,0 +1,186 @@
+package tcp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an algorithm used to compress message payloads on the wire.
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	Gzip
+	Zstd
+	Snappy
+)
+
+// DefaultCompressionThreshold is the payload size from which messages get compressed if no
+// other threshold is set. Smaller payloads rarely shrink enough to be worth the CPU time.
+const DefaultCompressionThreshold = 1024
+
+// flagCompressed marks a frame whose payload is compressed with the algorithm negotiated
+// for the connection.
+const flagCompressed byte = 1 << 0
+
+const compressionFeatures = featureGzip | featureZstd | featureSnappy
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Snappy:
+		return "snappy"
+	}
+
+	return fmt.Sprintf("Compression(%d)", c)
+}
+
+func (c Compression) feature() feature {
+	switch c {
+	case Gzip:
+		return featureGzip
+	case Zstd:
+		return featureZstd
+	case Snappy:
+		return featureSnappy
+	}
+
+	return 0
+}
+
+// compression returns the algorithm negotiated for the connection. Clients only ever
+// propose one.
+func (p protocol) compression() Compression {
+	for _, c := range []Compression{Zstd, Snappy, Gzip} {
+		if p.features.has(c.feature()) {
+			return c
+		}
+	}
+
+	return NoCompression
+}
+
+var (
+	gzipWriters = sync.Pool{
+		New: func() interface{} {
+			return gzip.NewWriter(nil)
+		},
+	}
+
+	zstdDecoders = sync.Pool{
+		New: func() interface{} {
+			// Decoding happens on the calling goroutine with a concurrency of 1
+			d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			return d
+		},
+	}
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+)
+
+func initZstd() {
+	// Can't fail without options
+	zstdEncoder, _ = zstd.NewWriter(nil)
+}
+
+// compress appends the compressed form of src to dst.
+func compress(c Compression, dst, src []byte) ([]byte, error) {
+	switch c {
+	case Gzip:
+		buf := bytes.NewBuffer(dst)
+
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+
+		w.Reset(buf)
+		if _, err := w.Write(src); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+
+	case Zstd:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(src, dst), nil
+
+	case Snappy:
+		n := len(dst)
+		dst = slices.Grow(dst, snappy.MaxEncodedLen(len(src)))
+
+		// Encodes in place since dst has enough room
+		out := snappy.Encode(dst[n:cap(dst)], src)
+		return dst[:n+len(out)], nil
+	}
+
+	return nil, fmt.Errorf("unknown compression %s", c)
+}
+
+// decompress decodes src, failing with ErrMessageTooLarge as soon as the output grows past max
+// bytes so that small frames can't be used to exhaust memory.
+func decompress(c Compression, src []byte, max int) ([]byte, error) {
+	switch c {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMalformedFrame, err)
+		}
+
+		return readLimited(r, max)
+
+	case Zstd:
+		d := zstdDecoders.Get().(*zstd.Decoder)
+		defer zstdDecoders.Put(d)
+
+		if err := d.Reset(bytes.NewReader(src)); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMalformedFrame, err)
+		}
+
+		return readLimited(d, max)
+
+	case Snappy:
+		n, err := snappy.DecodedLen(src)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMalformedFrame, err)
+		}
+		if n > max {
+			return nil, fmt.Errorf("%w: decompresses to %d bytes, limit is %d", ErrMessageTooLarge, n, max)
+		}
+
+		out, err := snappy.Decode(nil, src)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMalformedFrame, err)
+		}
+
+		return out, nil
+	}
+
+	return nil, fmt.Errorf("unknown compression %s", c)
+}
+
+func readLimited(r io.Reader, max int) ([]byte, error) {
+	out, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedFrame, err)
+	}
+	if len(out) > max {
+		return nil, fmt.Errorf("%w: decompresses to more than %d bytes", ErrMessageTooLarge, max)
+	}
+
+	return out, nil
+}
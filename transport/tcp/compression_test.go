@@ -0,0 +1,229 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var compressions = []Compression{Gzip, Zstd, Snappy}
+
+// batchPayload builds something resembling a batch of encoded protobuf records.
+func batchPayload(size int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	buf := &bytes.Buffer{}
+
+	for i := 0; buf.Len() < size; i++ {
+		var id [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(id[:], uint64(rnd.Int63n(1<<40)))
+
+		buf.WriteByte(0x08)
+		buf.Write(id[:n])
+		fmt.Fprintf(buf, "\x12\x0cplayer-%05d\x1a\x07lobby-%d\x20%c", i%5000, i%7, byte(rnd.Intn(128)))
+	}
+
+	return buf.Bytes()[:size]
+}
+
+func TestCompression(t *testing.T) {
+	data := batchPayload(64 * 1024)
+
+	for _, c := range compressions {
+		for _, mux := range []bool{false, true} {
+			client := newTestTransport(&tcpOptions{Compression: c, UseMultiplexing: mux})
+			server := newTestTransport(&tcpOptions{})
+
+			rec, err := exchangeData(client, server, data)
+
+			require.Nil(t, err, "%s", c)
+			assert.Equal(t, data, rec.Data, "%s", c)
+		}
+	}
+}
+
+func TestCompression_Negotiation(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	client, server := newSocket(c1), newSocket(c2)
+
+	go server.serverHandshake(compressionFeatures)
+	require.Nil(t, client.clientHandshake(ProtocolV1, featureSnappy))
+
+	assert.Equal(t, Snappy, client.proto.compression())
+}
+
+func TestSendCompressed(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	p := protocol{version: ProtocolV1, features: featureZstd}
+	sender, receiver := newSocket(c1), newSocket(c2)
+	sender.proto, receiver.proto = p, p
+	sender.compressMin = 100
+
+	small := &transport.Message{Data: []byte("tiny")}
+	big := &transport.Message{Data: batchPayload(4096)}
+
+	for _, msg := range []*transport.Message{small, big} {
+		go sender.Send(context.Background(), msg)
+
+		h, err := p.readFrameHeader(receiver.r)
+		require.Nil(t, err)
+
+		payload := make([]byte, h.length)
+		_, err = io.ReadFull(receiver.r, payload)
+		require.Nil(t, err)
+
+		if msg == big {
+			assert.NotZero(t, h.flags&flagCompressed)
+			assert.Less(t, int(h.length), messageSize(msg))
+		} else {
+			assert.Zero(t, h.flags&flagCompressed)
+			assert.Equal(t, messageSize(msg), int(h.length))
+		}
+	}
+}
+
+func TestReadFrame_UnexpectedCompression(t *testing.T) {
+	b := &bytes.Buffer{}
+	p := protocol{version: ProtocolV1}
+
+	p.writeFrameHeader(b, frameHeader{typ: frameData, flags: flagCompressed, length: 1})
+	b.WriteByte(0)
+
+	s := newSocket(nil)
+	s.r.Reset(b)
+	s.proto = p
+
+	_, _, err := s.readFrame()
+	assert.NotNil(t, err)
+}
+
+func exchangeData(client, server *tcpTransport, data []byte) (*transport.Message, error) {
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	go l.Accept(context.Background(), echo)
+
+	s, err := client.Dial(context.Background(), l.(*tcpListener).Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	if err := s.Send(context.Background(), &transport.Message{Data: data}); err != nil {
+		return nil, err
+	}
+
+	var rec transport.Message
+	if err := s.Receive(context.Background(), &rec); err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+func BenchmarkCompress(b *testing.B) {
+	data := batchPayload(256 * 1024)
+
+	for _, c := range compressions {
+		b.Run(c.String(), func(b *testing.B) {
+			var out []byte
+
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				out, _ = compress(c, nil, data)
+			}
+
+			b.ReportMetric(float64(len(out))/float64(len(data)), "ratio")
+		})
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	data := batchPayload(256 * 1024)
+
+	for _, c := range compressions {
+		b.Run(c.String(), func(b *testing.B) {
+			compressed, _ := compress(c, nil, data)
+
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				decompress(c, compressed, len(data))
+			}
+		})
+	}
+}
+
+// BenchmarkExchange measures a full round trip over loopback, reporting how many bytes the
+// client puts on the wire per message.
+func BenchmarkExchange(b *testing.B) {
+	data := batchPayload(256 * 1024)
+
+	for _, c := range append([]Compression{NoCompression}, compressions...) {
+		b.Run(c.String(), func(b *testing.B) {
+			server := newTestTransport(&tcpOptions{})
+
+			l, err := server.Listen(context.Background(), "127.0.0.1:0")
+			require.Nil(b, err)
+			defer l.Close()
+
+			go l.Accept(context.Background(), func(s transport.Socket) {
+				defer s.Close()
+
+				var msg transport.Message
+				for s.Receive(context.Background(), &msg) == nil {
+					if s.Send(context.Background(), &msg) != nil {
+						return
+					}
+				}
+			})
+
+			conn, err := net.Dial("tcp", l.(*tcpListener).Addr().String())
+			require.Nil(b, err)
+
+			counter := &countingConn{Conn: conn}
+			s := newSocket(counter)
+			require.Nil(b, s.clientHandshake(ProtocolV1, c.feature()))
+			defer s.Close()
+
+			msg := &transport.Message{Data: data}
+			var rec transport.Message
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				s.Send(context.Background(), msg)
+				s.Receive(context.Background(), &rec)
+			}
+
+			b.ReportMetric(float64(counter.written)/float64(b.N), "wire-B/msg")
+		})
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	written int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.written += len(p)
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,50 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd || solaris || illumos
+
+package tcp
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"syscall"
+)
+
+// connCheck returns an error if the peer has closed conn, without blocking or consuming any
+// data from it.
+func connCheck(conn net.Conn) error {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var checkErr error
+
+	err = raw.Read(func(fd uintptr) bool {
+		var buf [1]byte
+
+		// Sockets are non-blocking, so this fails with EAGAIN if there's nothing to read
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK)
+		switch {
+		case n == 0 && err == nil:
+			checkErr = io.EOF
+		case err != nil && err != syscall.EAGAIN && err != syscall.EWOULDBLOCK:
+			checkErr = err
+		}
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return checkErr
+}
@@ -0,0 +1,36 @@
+package tcp
+
+import "errors"
+
+var ErrHandlersBusy = errors.New("too many connections being handled")
+
+// Dispatcher runs serve, which handles a new connection, without blocking the listener for
+// long. If it returns an error, the connection is closed instead.
+type Dispatcher func(serve func()) error
+
+// goDispatch serves every connection on its own goroutine.
+func goDispatch(serve func()) error {
+	go serve()
+	return nil
+}
+
+// LimitHandlers returns a Dispatcher that serves up to n connections at once, each on its own
+// goroutine. New connections are closed with ErrHandlersBusy while that many are being served.
+func LimitHandlers(n int) Dispatcher {
+	slots := make(chan struct{}, n)
+
+	return func(serve func()) error {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return ErrHandlersBusy
+		}
+
+		go func() {
+			defer func() { <-slots }()
+			serve()
+		}()
+
+		return nil
+	}
+}
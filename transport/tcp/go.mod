@@ -1,15 +1,24 @@
 module github.com/MouseHatGames/mice-plugins/transport/tcp
 
-go 1.15
+go 1.22
 
 require (
 	github.com/MouseHatGames/mice v1.2.9-0.20230506193607-c7d017a7d2cc
+	github.com/MouseHatGames/mice-plugins/transport/dialer v0.0.0
+	github.com/MouseHatGames/mice-plugins/transport/pool v0.0.0
+	github.com/MouseHatGames/mice-plugins/transport/portmux v0.0.0
+	github.com/klauspost/compress v1.18.0
 	github.com/opentracing/opentracing-go v1.2.0 // indirect
-	github.com/pipe01/pool v1.0.2
 	github.com/stretchr/testify v1.7.1
 	go.opentelemetry.io/otel/exporters/jaeger v1.9.0 // indirect
 	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.9.0 // indirect
 	go.opentelemetry.io/proto/otlp v0.19.0 // indirect
-	golang.org/x/sys v0.0.0-20220818161305-2296e01440c6 // indirect
+	golang.org/x/sys v0.0.0-20220818161305-2296e01440c6
 	google.golang.org/protobuf v1.28.1 // indirect
 )
+
+replace github.com/MouseHatGames/mice-plugins/transport/dialer => ../dialer
+
+replace github.com/MouseHatGames/mice-plugins/transport/pool => ../pool
+
+replace github.com/MouseHatGames/mice-plugins/transport/portmux => ../portmux
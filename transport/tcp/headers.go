@@ -0,0 +1,300 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/MouseHatGames/mice/transport"
+)
+
+// Connections that negotiated featureExtendedHeaders encode headers as a list of key and value
+// pairs, all prefixed with their length as a uvarint, instead of the legacy format which is
+// limited to 255 headers and to 32 KiB per key or value. Values may hold any bytes and a key
+// may appear more than once.
+//
+// Since a message's headers are a map, the extra values of a key are stored in it under the
+// key followed by a NUL byte and their index, see AddHeader and HeaderValues. Keys can't
+// contain NUL bytes otherwise.
+
+// ErrInvalidHeader is returned when sending headers in the extended format that hold a key with a
+// NUL byte which isn't one of the extra values of another key, see AddHeader.
+var ErrInvalidHeader = errors.New("invalid header key")
+
+// maxLegacyString is the longest key or value the legacy format can encode.
+const maxLegacyString = math.MaxInt16
+
+// headerSeparator separates a key from the index of one of its extra values in a header map.
+const headerSeparator = "\x00"
+
+func extraValueKey(key string, i int) string {
+	return key + headerSeparator + strconv.Itoa(i)
+}
+
+// AddHeader adds a value to a message header, keeping the values it already has. Peers that
+// negotiated extended headers receive them as repeated keys, others as separate entries that
+// HeaderValues puts back together.
+func AddHeader(msg *transport.Message, key, value string) {
+	if msg.MessageHeaders == nil {
+		msg.MessageHeaders = map[string]string{}
+	}
+
+	if _, ok := msg.MessageHeaders[key]; !ok {
+		msg.MessageHeaders[key] = value
+		return
+	}
+
+	i := 1
+	for {
+		k := extraValueKey(key, i)
+		if _, ok := msg.MessageHeaders[k]; !ok {
+			msg.MessageHeaders[k] = value
+			return
+		}
+		i++
+	}
+}
+
+// HeaderValues returns every value of a message header, in the order they were added.
+func HeaderValues(msg *transport.Message, key string) []string {
+	v, ok := msg.MessageHeaders[key]
+	if !ok {
+		return nil
+	}
+
+	values := []string{v}
+	for i := 1; ; i++ {
+		v, ok := msg.MessageHeaders[extraValueKey(key, i)]
+		if !ok {
+			return values
+		}
+
+		values = append(values, v)
+	}
+}
+
+// checkHeaders makes sure the headers can be encoded in the format used on the connection.
+func (p protocol) checkHeaders(m map[string]string) error {
+	if p.features.has(featureExtendedHeaders) {
+		return checkExtraValues(m)
+	}
+
+	if len(m) > maxHeaderCount {
+		return transport.ErrTooManyHeaders
+	}
+
+	for k, v := range m {
+		if len(k) > maxLegacyString || len(v) > maxLegacyString {
+			return fmt.Errorf("%w: header %.32q is longer than the %d bytes the peer supports", ErrHeaderTooLarge, k, maxLegacyString)
+		}
+	}
+
+	return nil
+}
+
+// checkExtraValues makes sure every key with a NUL byte is an extra value that gets sent along
+// with its key, which is the case if the key and the extra values before it are all there.
+// Others would be counted in the frame without being written.
+func checkExtraValues(m map[string]string) error {
+	for k := range m {
+		i := strings.Index(k, headerSeparator)
+		if i < 0 {
+			continue
+		}
+
+		base := k[:i]
+		n, err := strconv.Atoi(k[i+1:])
+		if err != nil || n < 1 || k != extraValueKey(base, n) {
+			return fmt.Errorf("%w: %q", ErrInvalidHeader, k)
+		}
+
+		prev := base
+		if n > 1 {
+			prev = extraValueKey(base, n-1)
+		}
+		if _, ok := m[prev]; !ok {
+			return fmt.Errorf("%w: %q has no previous value", ErrInvalidHeader, k)
+		}
+	}
+
+	return nil
+}
+
+// messageSize returns the size of the payload of a message frame.
+func (p protocol) messageSize(msg *transport.Message) int {
+	if !p.features.has(featureExtendedHeaders) {
+		return messageSize(msg)
+	}
+
+	size := len(msg.Data) + uvarintSize(uint64(len(msg.MessageHeaders)))
+	for k, v := range msg.MessageHeaders {
+		if i := strings.Index(k, headerSeparator); i >= 0 {
+			k = k[:i]
+		}
+
+		size += uvarintSize(uint64(len(k))) + len(k)
+		size += uvarintSize(uint64(len(v))) + len(v)
+	}
+
+	return size
+}
+
+func (p protocol) appendHeaders(b []byte, m map[string]string) []byte {
+	if p.features.has(featureExtendedHeaders) {
+		return appendHeaderList(b, m)
+	}
+
+	return appendMap(b, m)
+}
+
+func (p protocol) decodePayload(payload []byte, msg *transport.Message) error {
+	if !p.features.has(featureExtendedHeaders) {
+		return decodePayload(payload, msg)
+	}
+
+	msg.Data = nil
+
+	header, n, err := decodeHeaderList(payload)
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+
+	msg.MessageHeaders = header
+	msg.Data = payload[n:]
+
+	return nil
+}
+
+// headerSize returns how many bytes the headers at the start of payload take up.
+func (p protocol) headerSize(payload []byte) (int, error) {
+	decode, off := decodeString, 1
+	var count uint64
+
+	if p.features.has(featureExtendedHeaders) {
+		decode = decodeVarString
+
+		count, off = binary.Uvarint(payload)
+		if off <= 0 {
+			return 0, errHeaderOverrun
+		}
+	} else {
+		if len(payload) < 1 {
+			return 0, errHeaderOverrun
+		}
+		count = uint64(payload[0])
+	}
+
+	// Every header is a key followed by a value
+	for i := uint64(0); i < 2*count; i++ {
+		_, n, err := decode(payload[off:])
+		if err != nil {
+			return 0, err
+		}
+		off += n
+	}
+
+	return off, nil
+}
+
+func uvarintSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+
+	return n
+}
+
+// appendHeaderList encodes m in the extended format at the end of b. The extra values of a
+// key are written right after it, so that they're decoded in the same order.
+func appendHeaderList(b []byte, m map[string]string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(m)))
+
+	for k, v := range m {
+		if strings.Contains(k, headerSeparator) {
+			continue
+		}
+
+		b = appendVarString(b, k)
+		b = appendVarString(b, v)
+
+		for i := 1; ; i++ {
+			v, ok := m[extraValueKey(k, i)]
+			if !ok {
+				break
+			}
+
+			b = appendVarString(b, k)
+			b = appendVarString(b, v)
+		}
+	}
+
+	return b
+}
+
+func appendVarString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decodeHeaderList decodes headers in the extended format from the start of p, returning how
+// many bytes they took up. Like decodeMap, the strings point into p.
+func decodeHeaderList(p []byte) (map[string]string, int, error) {
+	count, off := binary.Uvarint(p)
+	if off <= 0 {
+		return nil, 0, errHeaderOverrun
+	}
+
+	// Every header takes at least two bytes, don't trust the count any further than that
+	if count > uint64(len(p)-off)/2 {
+		return nil, 0, errHeaderOverrun
+	}
+
+	m := make(map[string]string, count)
+	seen := map[string]int{}
+
+	for i := uint64(0); i < count; i++ {
+		k, n, err := decodeVarString(p[off:])
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+
+		v, n, err := decodeVarString(p[off:])
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+
+		if strings.Contains(k, headerSeparator) {
+			return nil, 0, fmt.Errorf("%w: header key contains a NUL byte", ErrMalformedFrame)
+		}
+
+		if _, ok := m[k]; !ok {
+			m[k] = v
+			continue
+		}
+
+		seen[k]++
+		m[extraValueKey(k, seen[k])] = v
+	}
+
+	return m, off, nil
+}
+
+func decodeVarString(p []byte) (string, int, error) {
+	l, n := binary.Uvarint(p)
+	if n <= 0 || l > uint64(len(p)-n) {
+		return "", 0, errHeaderOverrun
+	}
+
+	buf := p[n : n+int(l)]
+	str := *(*string)(unsafe.Pointer(&buf))
+
+	return str, n + int(l), nil
+}
@@ -0,0 +1,163 @@
+package tcp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var extendedProto = protocol{version: ProtocolV1, features: featureExtendedHeaders}
+
+func TestHeaderList_RoundTrip(t *testing.T) {
+	msg := &transport.Message{
+		MessageHeaders: map[string]string{
+			"binary": "\x00\xff\x00",
+			"big":    strings.Repeat("x", 40<<10),
+		},
+		Data: []byte("hello"),
+	}
+	for i := 0; i < 300; i++ {
+		msg.MessageHeaders[strconv.Itoa(i)] = strconv.Itoa(i)
+	}
+	AddHeader(msg, "multi", "1")
+	AddHeader(msg, "multi", "2")
+	AddHeader(msg, "multi", "3")
+
+	b := extendedProto.appendHeaders(nil, msg.MessageHeaders)
+	b = append(b, msg.Data...)
+	assert.Equal(t, extendedProto.messageSize(msg), len(b))
+
+	var rec transport.Message
+	require.Nil(t, extendedProto.decodePayload(b, &rec))
+
+	assert.Equal(t, msg.MessageHeaders, rec.MessageHeaders)
+	assert.Equal(t, []string{"1", "2", "3"}, HeaderValues(&rec, "multi"))
+	assert.Equal(t, msg.Data, rec.Data)
+}
+
+func TestDecodeHeaderList_Malformed(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":         {},
+		"huge count":    {0xff, 0xff, 0xff, 0xff, 0x0f, 0, 0},
+		"key overrun":   {1, 5, 'a'},
+		"value overrun": {1, 1, 'a', 3, 'b'},
+		"nul in key":    {1, 2, 'a', 0, 0},
+	}
+
+	for name, payload := range tests {
+		var msg transport.Message
+		err := extendedProto.decodePayload(payload, &msg)
+
+		assert.ErrorIs(t, err, ErrMalformedFrame, name)
+	}
+}
+
+func TestHeaderValues_Legacy(t *testing.T) {
+	msg := &transport.Message{}
+	AddHeader(msg, "a", "1")
+	AddHeader(msg, "a", "2")
+
+	// The extra values travel as separate keys when the peer doesn't support repeating them
+	var rec transport.Message
+	require.Nil(t, decodePayload(appendMap(nil, msg.MessageHeaders), &rec))
+
+	assert.Equal(t, []string{"1", "2"}, HeaderValues(&rec, "a"))
+	assert.Nil(t, HeaderValues(&rec, "b"))
+}
+
+func TestSend_LegacyHeaderTooLarge(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	s := newSocket(c1)
+	err := s.Send(context.Background(), &transport.Message{
+		MessageHeaders: map[string]string{"a": strings.Repeat("x", maxLegacyString+1)},
+	})
+
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+	assert.Zero(t, s.broken)
+}
+
+func TestExtendedHeaders(t *testing.T) {
+	headers := map[string]string{"big": strings.Repeat("x", 40<<10)}
+	for i := 0; i < 300; i++ {
+		headers[strconv.Itoa(i)] = ""
+	}
+
+	for _, mux := range []bool{false, true} {
+		client := newTestTransport(&tcpOptions{ProtocolVersion: ProtocolV1, UseMultiplexing: mux})
+		server := newTestTransport(&tcpOptions{})
+
+		l, err := server.Listen(context.Background(), "127.0.0.1:0")
+		require.Nil(t, err)
+
+		go l.Accept(context.Background(), echoAll)
+
+		s, err := client.Dial(context.Background(), l.(*tcpListener).Addr().String())
+		require.Nil(t, err)
+
+		require.Nil(t, s.Send(context.Background(), &transport.Message{MessageHeaders: headers}))
+
+		var rec transport.Message
+		require.Nil(t, s.Receive(context.Background(), &rec))
+		assert.Equal(t, headers, rec.MessageHeaders, "mux: %v", mux)
+
+		s.Close()
+		l.Close()
+	}
+}
+
+func TestSend_OrphanedExtraValue(t *testing.T) {
+	for name, headers := range map[string]map[string]string{
+		"orphan":    {"a\x001": "1"},
+		"gap":       {"a": "1", "a\x001": "2", "a\x003": "4"},
+		"not index": {"a": "1", "a\x00b": "2"},
+		"zero":      {"a": "1", "a\x000": "2"},
+		"padded":    {"a": "1", "a\x0001": "2"},
+	} {
+		c1, c2 := net.Pipe()
+
+		s := newSocket(c1)
+		s.proto = extendedProto
+
+		err := s.Send(context.Background(), &transport.Message{MessageHeaders: headers})
+
+		// Nothing is written, so the connection is still at a frame boundary
+		assert.ErrorIs(t, err, ErrInvalidHeader, name)
+		assert.Zero(t, s.broken, name)
+
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestSend_ExtraValuesAfterOrphanedOne(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	sender, receiver := newSocket(c1), newSocket(c2)
+	sender.proto, receiver.proto = extendedProto, extendedProto
+
+	// The frame after a rejected one is received as sent
+	go func() {
+		sender.Send(context.Background(), &transport.Message{MessageHeaders: map[string]string{"a\x001": "x"}})
+		sender.Send(context.Background(), &transport.Message{
+			MessageHeaders: map[string]string{"a": "1", "a\x001": "2"},
+			Data:           []byte("hello"),
+		})
+	}()
+
+	var rec transport.Message
+	require.Nil(t, receiver.Receive(context.Background(), &rec))
+
+	assert.Equal(t, []string{"1", "2"}, HeaderValues(&rec, "a"))
+	assert.Equal(t, "hello", string(rec.Data))
+}
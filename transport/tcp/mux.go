@@ -0,0 +1,939 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/MouseHatGames/mice/logger"
+	"github.com/MouseHatGames/mice/transport"
+)
+
+var (
+	ErrStreamClosed            = errors.New("stream closed")
+	ErrMultiplexingUnsupported = errors.New("server does not support multiplexing")
+
+	errStreamsExhausted = errors.New("no stream IDs left on connection")
+	errGoingAway        = errors.New("peer is going away")
+	errTooManyStreams   = errors.New("too many concurrent streams")
+	errHeartbeatTimeout = errors.New("peer didn't answer heartbeat")
+)
+
+// StreamError is returned by the operations on a multiplexed stream the peer has reset.
+type StreamError struct {
+	Reason string
+}
+
+func (e *StreamError) Error() string {
+	return "stream reset by peer: " + e.Reason
+}
+
+// Clients open streams with odd IDs, counting up. A connection that runs out of IDs stops
+// accepting new streams and is closed once the last one is done.
+const maxStreamID = 1<<32 - 1
+
+// Streams opened at the same time may send their first message out of order, so the server
+// remembers the IDs it skipped until their first frame arrives. maxSkippedStreams bounds how
+// many it remembers when the number of concurrent streams isn't limited.
+const maxSkippedStreams = 1 << 16
+
+// muxSession carries many streams over a single connection that negotiated featureMultiplex.
+type muxSession struct {
+	sock *tcpSocket
+	log  logger.Logger
+
+	// accept is called with every stream the peer opens, it's nil on the client side.
+	accept func(transport.Socket)
+
+	// maxStreams limits how many streams the peer may have open at once, zero means no limit.
+	maxStreams int
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+
+	// lastID is the highest ID of the streams opened by the peer, skipped holds the lower ones
+	// the peer hasn't sent anything on yet.
+	lastID  uint32
+	skipped map[uint32]struct{}
+
+	// draining is set to the reason why no new streams may be opened. The connection is closed
+	// once the last stream is done.
+	draining error
+
+	// refusing is set to the reason why new streams opened by the peer are reset.
+	refusing error
+
+	// done is closed once the session fails.
+	done chan struct{}
+
+	// pongs receives the payload of the pong frames sent by the peer.
+	pongs chan []byte
+}
+
+func newMuxSession(sock *tcpSocket, log logger.Logger, accept func(transport.Socket)) *muxSession {
+	// Messages are queued on their streams, they can't share a buffer
+	sock.reuseRecv = false
+
+	return &muxSession{
+		sock:    sock,
+		log:     log,
+		accept:  accept,
+		streams: map[uint32]*muxStream{},
+		skipped: map[uint32]struct{}{},
+		nextID:  1,
+		done:    make(chan struct{}),
+		pongs:   make(chan []byte, 1),
+	}
+}
+
+// run reads frames from the connection and routes them to their streams until the
+// connection fails.
+func (m *muxSession) run() {
+	for {
+		h, payload, err := m.sock.readFrame()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				m.log.Debugf("multiplexed connection to %s lost: %s", m.sock.conn.RemoteAddr(), err)
+			}
+
+			m.fail(err)
+			return
+		}
+
+		if err := m.dispatch(h, payload); err != nil {
+			m.log.Errorf("closing multiplexed connection to %s: %s", m.sock.conn.RemoteAddr(), err)
+
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *muxSession) dispatch(h frameHeader, payload []byte) error {
+	switch h.typ {
+	case frameData:
+		msg := &transport.Message{}
+		if err := m.sock.decode(payload, msg); err != nil {
+			return err
+		}
+
+		streamed := h.flags&flagStream != 0
+		if streamed && !m.sock.proto.features.has(featureStreaming) {
+			return fmt.Errorf("%w: streamed body without streaming", ErrMalformedFrame)
+		}
+
+		st, opened, refused := m.stream(h.stream)
+		if refused != nil {
+			m.log.Debugf("refusing stream %d from %s: %s", h.stream, m.sock.conn.RemoteAddr(), refused)
+			return m.sendControl(frameHeader{typ: frameReset, stream: h.stream}, []byte(refused.Error()))
+		}
+		if st == nil {
+			// The stream was closed on our side, let the peer know nobody is listening
+			return m.sendControl(frameHeader{typ: frameReset, stream: h.stream}, []byte(ErrStreamClosed.Error()))
+		}
+
+		if err := st.deliver(msg, streamed); err != nil {
+			return err
+		}
+
+		if opened {
+			go m.accept(st)
+		}
+
+	case frameChunk:
+		// Chunks for streams closed on our side are dropped, the peer has been told
+		if st, _ := m.lookup(h.stream); st != nil {
+			return st.receiveChunk(h.flags, payload)
+		}
+
+	case frameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("%w: window frame of %d bytes", ErrMalformedFrame, len(payload))
+		}
+
+		if st, _ := m.lookup(h.stream); st != nil {
+			st.addCredit(int(binary.LittleEndian.Uint32(payload)))
+		}
+
+	case frameClose:
+		if st, _ := m.lookup(h.stream); st != nil {
+			st.remoteClose(io.EOF)
+		} else {
+			m.forget(h.stream)
+		}
+
+	case frameReset:
+		if st, _ := m.lookup(h.stream); st != nil {
+			st.remoteClose(&StreamError{Reason: string(payload)})
+		} else {
+			m.forget(h.stream)
+		}
+
+	case frameGoAway:
+		m.drain(errGoingAway)
+
+	case framePing:
+		if !m.sock.proto.features.has(featureHeartbeat) {
+			return fmt.Errorf("%w: ping without heartbeats", ErrMalformedFrame)
+		}
+
+		return m.sendControl(frameHeader{typ: framePong}, payload)
+
+	case framePong:
+		select {
+		case m.pongs <- payload:
+		default:
+		}
+
+	default:
+		return fmt.Errorf("%w: unexpected frame type %d", ErrMalformedFrame, h.typ)
+	}
+
+	return nil
+}
+
+func (m *muxSession) lookup(id uint32) (*muxStream, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st, ok := m.streams[id]
+	return st, ok
+}
+
+// stream returns the stream a data frame belongs to. On the server side, frames with IDs
+// that haven't been seen yet open a new stream, unless the session refuses it.
+func (m *muxSession) stream(id uint32) (st *muxStream, opened bool, refused error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if st, ok := m.streams[id]; ok {
+		return st, false, nil
+	}
+	if m.accept == nil || m.err != nil {
+		return nil, false, nil
+	}
+
+	if _, ok := m.skipped[id]; ok {
+		delete(m.skipped, id)
+	} else if id > m.lastID {
+		limit := m.maxStreams
+		if limit <= 0 {
+			limit = maxSkippedStreams
+		}
+		if int((id-m.lastID-1)/2) > limit-len(m.skipped) {
+			return nil, false, errTooManyStreams
+		}
+
+		for skip := id - 2; skip > m.lastID && skip < id; skip -= 2 {
+			m.skipped[skip] = struct{}{}
+		}
+		m.lastID = id
+	} else {
+		// Closed already
+		return nil, false, nil
+	}
+
+	if m.refusing != nil {
+		return nil, false, m.refusing
+	}
+	if m.maxStreams > 0 && len(m.streams) >= m.maxStreams {
+		return nil, false, errTooManyStreams
+	}
+
+	st = newMuxStream(id, m)
+	m.streams[id] = st
+
+	return st, true, nil
+}
+
+// forget drops a stream that the peer closed without sending anything on it.
+func (m *muxSession) forget(id uint32) {
+	m.mu.Lock()
+	delete(m.skipped, id)
+	m.mu.Unlock()
+}
+
+// open starts a new stream from the client side. The peer only learns about it once the
+// first message is sent.
+func (m *muxSession) open() (*muxStream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.draining == nil && m.nextID >= maxStreamID-1 {
+		m.draining = errStreamsExhausted
+	}
+	if m.draining != nil {
+		return nil, m.draining
+	}
+
+	st := newMuxStream(m.nextID, m)
+	m.streams[st.id] = st
+	m.nextID += 2
+
+	return st, nil
+}
+
+// usable returns whether new streams can be opened on the session.
+func (m *muxSession) usable() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err == nil && m.draining == nil
+}
+
+func (m *muxSession) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	reason := m.draining
+	done := reason != nil && len(m.streams) == 0
+	m.mu.Unlock()
+
+	if done {
+		m.fail(reason)
+	}
+}
+
+// drain stops new streams from being opened and closes the connection once the open ones
+// are done.
+func (m *muxSession) drain(reason error) {
+	m.mu.Lock()
+	if m.draining == nil {
+		m.draining = reason
+	}
+	done := len(m.streams) == 0
+	m.mu.Unlock()
+
+	if done {
+		m.fail(reason)
+	}
+}
+
+// goAway asks the peer to stop opening streams, letting it close the connection once the
+// streams it has open are done. Streams it opens anyway, e.g. because the frame crossed the
+// GOAWAY, are reset.
+func (m *muxSession) goAway() {
+	m.mu.Lock()
+	m.refusing = errGoingAway
+	m.mu.Unlock()
+
+	if err := m.sendControl(frameHeader{typ: frameGoAway}, nil); err != nil {
+		m.fail(err)
+	}
+}
+
+// heartbeat pings the peer every interval until the session fails, failing it if the peer
+// doesn't answer within timeout.
+func (m *muxSession) heartbeat(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pings uint64
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+
+		pings++
+		if err := m.ping(pings, timeout); err != nil {
+			m.log.Errorf("closing multiplexed connection to %s: %s", m.sock.conn.RemoteAddr(), err)
+
+			m.fail(err)
+			return
+		}
+	}
+}
+
+// ping sends a ping frame with the given number and waits for the matching pong.
+func (m *muxSession) ping(n uint64, timeout time.Duration) error {
+	var payload [8]byte
+	binary.LittleEndian.PutUint64(payload[:], n)
+
+	if err := m.sendControl(frameHeader{typ: framePing}, payload[:]); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case pong := <-m.pongs:
+			// Ignore pongs that don't answer this ping
+			if bytes.Equal(pong, payload[:]) {
+				return nil
+			}
+
+		case <-timer.C:
+			return errHeartbeatTimeout
+
+		case <-m.done:
+			return m.failed()
+		}
+	}
+}
+
+// fail tears down the connection and makes every stream on it return err.
+func (m *muxSession) fail(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+
+	m.err = err
+	streams := m.streams
+	m.streams = map[uint32]*muxStream{}
+	m.mu.Unlock()
+
+	close(m.done)
+
+	m.sock.conn.Close()
+
+	for _, st := range streams {
+		st.remoteClose(fmt.Errorf("connection lost: %w", err))
+	}
+}
+
+func (m *muxSession) failed() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+func (m *muxSession) sendMessage(ctx context.Context, h frameHeader, msg *transport.Message) error {
+	if err := m.failed(); err != nil {
+		return fmt.Errorf("connection lost: %w", err)
+	}
+
+	return m.sock.sendMessage(ctx, h, msg)
+}
+
+func (m *muxSession) sendChunk(ctx context.Context, h frameHeader, chunk []byte) error {
+	if err := m.failed(); err != nil {
+		return fmt.Errorf("connection lost: %w", err)
+	}
+
+	return m.sock.sendChunk(ctx, h, chunk)
+}
+
+func (m *muxSession) sendControl(h frameHeader, payload []byte) error {
+	if err := m.failed(); err != nil {
+		return fmt.Errorf("connection lost: %w", err)
+	}
+
+	return m.sock.sendControl(h, payload)
+}
+
+// muxStream is a logical socket on top of a multiplexed connection.
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mu     sync.Mutex
+	queue  []muxMessage
+	notify chan struct{}
+	err    error
+	closed bool
+
+	// in is the body being received, if any.
+	in *muxBody
+
+	// sendMu is held while a body is being sent, keeping other messages out of it.
+	sendMu sync.Mutex
+
+	// credit is how many body bytes may be sent before the peer grants more, window is
+	// signalled when it does.
+	credit int
+	window chan struct{}
+}
+
+// muxMessage is a message received on a stream, along with its body if it was streamed.
+type muxMessage struct {
+	msg  *transport.Message
+	body *muxBody
+}
+
+var _ transport.Socket = (*muxStream)(nil)
+
+func newMuxStream(id uint32, sess *muxSession) *muxStream {
+	return &muxStream{
+		id:     id,
+		sess:   sess,
+		notify: make(chan struct{}, 1),
+		credit: streamWindow,
+		window: make(chan struct{}, 1),
+	}
+}
+
+// RemoteAddr returns the address of the peer of the connection the stream is on.
+func (s *muxStream) RemoteAddr() net.Addr {
+	return s.sess.sock.RemoteAddr()
+}
+
+func (s *muxStream) deliver(msg *transport.Message, streamed bool) error {
+	s.mu.Lock()
+	if s.in != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: message on stream %d before the end of the previous body", ErrMalformedFrame, s.id)
+	}
+
+	in := muxMessage{msg: msg}
+	if streamed {
+		in.body = newMuxBody(s)
+		s.in = in.body
+	}
+
+	s.queue = append(s.queue, in)
+	s.mu.Unlock()
+
+	s.signal()
+	return nil
+}
+
+// receiveChunk adds a piece to the body being received.
+func (s *muxStream) receiveChunk(flags byte, chunk []byte) error {
+	s.mu.Lock()
+	body := s.in
+	if flags&(flagEndStream|flagAbort) != 0 {
+		s.in = nil
+	}
+	s.mu.Unlock()
+
+	if body == nil {
+		return fmt.Errorf("%w: chunk outside of a body on stream %d", ErrMalformedFrame, s.id)
+	}
+
+	if flags&flagAbort != 0 {
+		body.end(fmt.Errorf("%w: %s", ErrBodyAborted, chunk))
+		return nil
+	}
+
+	if err := body.push(chunk); err != nil {
+		return err
+	}
+	if flags&flagEndStream != 0 {
+		body.end(io.EOF)
+	}
+
+	return nil
+}
+
+// addCredit lets more of a body be sent after the peer has read some of it.
+func (s *muxStream) addCredit(n int) {
+	s.mu.Lock()
+	s.credit += n
+	s.mu.Unlock()
+
+	select {
+	case s.window <- struct{}{}:
+	default:
+	}
+}
+
+// grant lets the peer send n more body bytes.
+func (s *muxStream) grant(n int) {
+	var payload [4]byte
+	binary.LittleEndian.PutUint32(payload[:], uint32(n))
+
+	// Failures take the whole session down, which the stream finds out about anyway
+	s.sess.sendControl(frameHeader{typ: frameWindow, stream: s.id}, payload[:])
+}
+
+// remoteClose stops the stream from receiving any more messages. Messages that have already
+// arrived can still be read, after which Receive returns err.
+func (s *muxStream) remoteClose(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	body := s.in
+	s.in = nil
+	s.mu.Unlock()
+
+	if body != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		body.end(err)
+	}
+
+	s.signal()
+	s.addCredit(0)
+}
+
+func (s *muxStream) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *muxStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	s.queue = nil
+	body := s.in
+	s.in = nil
+	s.mu.Unlock()
+
+	if body != nil {
+		body.end(ErrStreamClosed)
+	}
+
+	s.sess.remove(s.id)
+
+	if s.sess.failed() != nil {
+		return nil
+	}
+
+	return s.sess.sendControl(frameHeader{typ: frameClose, stream: s.id}, nil)
+}
+
+// Send writes a message to the stream. Since all streams share the connection, one that
+// expires while its message is being written takes the whole connection down.
+func (s *muxStream) Send(ctx context.Context, msg *transport.Message) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	return s.send(ctx, frameHeader{typ: frameData, stream: s.id}, msg)
+}
+
+func (s *muxStream) send(ctx context.Context, h frameHeader, msg *transport.Message) error {
+	if err := s.sendable(); err != nil {
+		return err
+	}
+
+	return s.sess.sendMessage(ctx, h, msg)
+}
+
+// sendable returns why nothing can be sent on the stream anymore, if that's the case.
+func (s *muxStream) sendable() error {
+	s.mu.Lock()
+	closed, err := s.closed, s.err
+	s.mu.Unlock()
+
+	if closed || errors.Is(err, io.EOF) {
+		return ErrStreamClosed
+	}
+
+	return err
+}
+
+// SendStream implements StreamSocket. A body can only get streamWindow bytes ahead of the
+// peer reading it.
+func (s *muxStream) SendStream(ctx context.Context, msg *transport.Message) (BodyWriter, error) {
+	if !s.sess.sock.proto.features.has(featureStreaming) {
+		return nil, ErrStreamingUnsupported
+	}
+
+	s.sendMu.Lock()
+
+	err := s.send(ctx, frameHeader{typ: frameData, flags: flagStream, stream: s.id}, &transport.Message{MessageHeaders: msg.MessageHeaders})
+	if err != nil {
+		s.sendMu.Unlock()
+		return nil, err
+	}
+
+	return startBody(ctx, msg.Data, s.sendChunk, s.sendMu.Unlock)
+}
+
+// sendChunk sends a piece of a body, splitting it up as the peer grants more credit.
+func (s *muxStream) sendChunk(ctx context.Context, flags byte, chunk []byte) error {
+	h := frameHeader{typ: frameChunk, flags: flags, stream: s.id}
+
+	// The reason a body was aborted for isn't part of it
+	if flags&flagAbort != 0 {
+		if err := s.sendable(); err != nil {
+			return err
+		}
+
+		return s.sess.sendChunk(ctx, h, chunk)
+	}
+
+	for {
+		n, err := s.takeCredit(ctx, len(chunk))
+		if err != nil {
+			return err
+		}
+
+		h.flags = 0
+		if n == len(chunk) {
+			h.flags = flags
+		}
+
+		if err := s.sess.sendChunk(ctx, h, chunk[:n]); err != nil {
+			return err
+		}
+
+		chunk = chunk[n:]
+		if len(chunk) == 0 {
+			return nil
+		}
+	}
+}
+
+// takeCredit waits until some body bytes can be sent, returning how many of the wanted ones.
+func (s *muxStream) takeCredit(ctx context.Context, want int) (int, error) {
+	for {
+		if err := s.sendable(); err != nil {
+			return 0, err
+		}
+
+		s.mu.Lock()
+		n := min(want, s.credit)
+		if n > 0 || want == 0 {
+			s.credit -= n
+			s.mu.Unlock()
+
+			return n, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.window:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// Receive reads the next message from the stream. Streamed bodies are read whole, up to the
+// maximum message size.
+func (s *muxStream) Receive(ctx context.Context, msg *transport.Message) error {
+	in, err := s.next(ctx)
+	if err != nil {
+		return err
+	}
+
+	*msg = *in.msg
+
+	if in.body != nil {
+		in.body.ctx = ctx
+		return readBody(in.body, msg, s.sess.sock.maxMessage)
+	}
+
+	return nil
+}
+
+// ReceiveStream implements StreamSocket.
+func (s *muxStream) ReceiveStream(ctx context.Context, msg *transport.Message) (io.ReadCloser, error) {
+	in, err := s.next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	*msg = *in.msg
+
+	if in.body == nil {
+		data := msg.Data
+		msg.Data = nil
+
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	msg.Data = nil
+	in.body.ctx = ctx
+	return in.body, nil
+}
+
+// next waits for the next message to arrive on the stream.
+func (s *muxStream) next(ctx context.Context) (muxMessage, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return muxMessage{}, ErrStreamClosed
+		}
+
+		if len(s.queue) > 0 {
+			in := s.queue[0]
+			s.queue[0] = muxMessage{}
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+
+			return in, nil
+		}
+
+		err := s.err
+		s.mu.Unlock()
+
+		if err != nil {
+			return muxMessage{}, err
+		}
+
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return muxMessage{}, ctx.Err()
+		}
+	}
+}
+
+// muxBody is a streamed body received on a multiplexed stream. Its chunks are buffered until
+// they're read, the stream's window keeping the peer from sending more than fits.
+type muxBody struct {
+	st  *muxStream
+	ctx context.Context
+
+	mu       sync.Mutex
+	chunks   [][]byte
+	buffered int
+	err      error
+	closed   bool
+	notify   chan struct{}
+
+	// consumed counts the bytes that were read since the peer was last granted more credit.
+	consumed int
+}
+
+func newMuxBody(st *muxStream) *muxBody {
+	return &muxBody{
+		st:     st,
+		ctx:    context.Background(),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push adds a chunk sent by the peer.
+func (b *muxBody) push(chunk []byte) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+
+		// Nobody is going to read it, let the peer carry on
+		if len(chunk) > 0 {
+			b.st.grant(len(chunk))
+		}
+		return nil
+	}
+
+	if b.buffered+len(chunk) > streamWindow {
+		b.mu.Unlock()
+		return fmt.Errorf("%w: stream %d sent more than its window", ErrMalformedFrame, b.st.id)
+	}
+
+	if len(chunk) > 0 {
+		b.chunks = append(b.chunks, chunk)
+		b.buffered += len(chunk)
+	}
+	b.mu.Unlock()
+
+	b.signal()
+	return nil
+}
+
+// end stops the body once the chunks that have arrived are read, after which reads return err.
+func (b *muxBody) end(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+
+	b.signal()
+}
+
+func (b *muxBody) signal() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (b *muxBody) Read(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+
+		if len(b.chunks) > 0 {
+			n := copy(p, b.chunks[0])
+			b.chunks[0] = b.chunks[0][n:]
+			if len(b.chunks[0]) == 0 {
+				b.chunks[0] = nil
+				b.chunks = b.chunks[1:]
+			}
+
+			b.buffered -= n
+			b.consumed += n
+
+			// Hand out credit in batches, and whatever is left once the body is done
+			grant := 0
+			if b.consumed >= streamWindow/2 || (b.err != nil && b.buffered == 0) {
+				grant, b.consumed = b.consumed, 0
+			}
+			b.mu.Unlock()
+
+			if grant > 0 {
+				b.st.grant(grant)
+			}
+
+			return n, nil
+		}
+
+		err := b.err
+		grant := 0
+		if err != nil {
+			grant, b.consumed = b.consumed, 0
+		}
+		b.mu.Unlock()
+
+		if err != nil {
+			if grant > 0 {
+				b.st.grant(grant)
+			}
+
+			return 0, err
+		}
+
+		select {
+		case <-b.notify:
+		case <-b.ctx.Done():
+			return 0, b.ctx.Err()
+		}
+	}
+}
+
+// Close discards the rest of the body. Unlike on plain connections, the stream can still be
+// used afterwards.
+func (b *muxBody) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+
+	b.closed = true
+	grant := b.consumed + b.buffered
+	b.chunks = nil
+	b.buffered, b.consumed = 0, 0
+	b.mu.Unlock()
+
+	if grant > 0 {
+		b.st.grant(grant)
+	}
+
+	return nil
+}
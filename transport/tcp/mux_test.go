@@ -0,0 +1,496 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenMux starts a listener whose connections are all counted, calling fn with every socket.
+func listenMux(t *testing.T, fn func(transport.Socket)) (addr string, conns *int32, stop func()) {
+	server := newTestTransport(&tcpOptions{})
+
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+
+	var n int32
+	var mu sync.Mutex
+	seen := map[*muxSession]bool{}
+
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		if st, ok := s.(*muxStream); ok {
+			mu.Lock()
+			if !seen[st.sess] {
+				seen[st.sess] = true
+				n++
+			}
+			mu.Unlock()
+		}
+
+		fn(s)
+	})
+
+	return l.(*tcpListener).Addr().String(), &n, func() { l.Close() }
+}
+
+func echo(s transport.Socket) {
+	defer s.Close()
+
+	var msg transport.Message
+	if err := s.Receive(context.Background(), &msg); err != nil {
+		return
+	}
+	s.Send(context.Background(), &msg)
+}
+
+func TestMultiplexing(t *testing.T) {
+	addr, conns, stop := listenMux(t, echo)
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			s, err := client.Dial(context.Background(), addr)
+			require.Nil(t, err)
+			defer s.Close()
+
+			data := fmt.Sprintf("message %d", i)
+			require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte(data)}))
+
+			var rec transport.Message
+			require.Nil(t, s.Receive(context.Background(), &rec))
+			assert.Equal(t, data, string(rec.Data))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 1, *conns)
+	assert.Len(t, client.sessions, 1)
+}
+
+func TestMultiplexing_StreamClosedByPeer(t *testing.T) {
+	addr, _, stop := listenMux(t, func(s transport.Socket) {
+		var msg transport.Message
+		s.Receive(context.Background(), &msg)
+		s.Close()
+	})
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hi")}))
+
+	var rec transport.Message
+	assert.Equal(t, io.EOF, s.Receive(context.Background(), &rec))
+	assert.Equal(t, ErrStreamClosed, s.Send(context.Background(), &transport.Message{}))
+
+	// Other streams on the same connection are unaffected
+	s2, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	assert.Nil(t, s2.Send(context.Background(), &transport.Message{Data: []byte("hi")}))
+	s2.Close()
+}
+
+func TestMultiplexing_SendAfterServerClose(t *testing.T) {
+	closed := make(chan struct{})
+
+	addr, _, stop := listenMux(t, func(s transport.Socket) {
+		s.Close()
+		close(closed)
+	})
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("first")}))
+	<-closed
+
+	// The server answers messages for a stream it has already closed with a reset
+	s.Send(context.Background(), &transport.Message{Data: []byte("second")})
+
+	var rec transport.Message
+	err = s.Receive(context.Background(), &rec)
+	assert.NotNil(t, err)
+}
+
+func TestMultiplexing_Reset(t *testing.T) {
+	addr, _, stop := listenMux(t, func(s transport.Socket) {
+		st := s.(*muxStream)
+		st.sess.sendControl(frameHeader{typ: frameReset, stream: st.id}, []byte("nope"))
+	})
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+
+	var rec transport.Message
+	err = s.Receive(context.Background(), &rec)
+	assert.Equal(t, &StreamError{Reason: "nope"}, err)
+	assert.Equal(t, err, s.Send(context.Background(), &transport.Message{}))
+}
+
+func TestMultiplexing_ConnectionLost(t *testing.T) {
+	addr, _, stop := listenMux(t, func(s transport.Socket) {
+		s.(*muxStream).sess.sock.conn.Close()
+	})
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+
+	var rec transport.Message
+	assert.NotNil(t, s.Receive(context.Background(), &rec))
+
+	// A new connection is made for the next stream
+	s2, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s2.Close()
+
+	assert.NotEqual(t, s.(*muxStream).sess, s2.(*muxStream).sess)
+}
+
+func TestMultiplexing_ReceiveCancelled(t *testing.T) {
+	addr, _, stop := listenMux(t, func(s transport.Socket) {})
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var rec transport.Message
+	assert.Equal(t, context.DeadlineExceeded, s.Receive(ctx, &rec))
+}
+
+func TestMultiplexing_GoAway(t *testing.T) {
+	received := make(chan struct{})
+
+	server := newTestTransport(&tcpOptions{DrainTimeout: 5 * time.Second})
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		defer s.Close()
+
+		var msg transport.Message
+		s.Receive(context.Background(), &msg)
+		close(received)
+
+		time.Sleep(100 * time.Millisecond)
+		s.Send(context.Background(), &msg)
+	})
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	s, err := client.Dial(context.Background(), l.(*tcpListener).Addr().String())
+	require.Nil(t, err)
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+	<-received
+
+	closed := make(chan error)
+	go func() {
+		closed <- l.Close()
+	}()
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+	assert.Equal(t, "hello", string(rec.Data))
+
+	sess := s.(*muxStream).sess
+	assert.False(t, sess.usable())
+
+	// The client closes the connection once its last stream is done
+	s.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("listener didn't close after the stream was done")
+	}
+
+	assert.ErrorIs(t, sess.failed(), errGoingAway)
+}
+
+func TestMultiplexing_Heartbeat(t *testing.T) {
+	addr, _, stop := listenMux(t, echo)
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{
+		UseMultiplexing:   true,
+		HeartbeatInterval: 10 * time.Millisecond,
+		HeartbeatTimeout:  time.Second,
+	})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+	assert.Equal(t, "hello", string(rec.Data))
+}
+
+func TestMultiplexing_HeartbeatTimeout(t *testing.T) {
+	addr, stop := listenUnresponsive(t, featureMultiplex|featureHeartbeat)
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{
+		UseMultiplexing:   true,
+		HeartbeatInterval: 10 * time.Millisecond,
+		HeartbeatTimeout:  20 * time.Millisecond,
+	})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var rec transport.Message
+	assert.ErrorIs(t, s.Receive(ctx, &rec), errHeartbeatTimeout)
+}
+
+func TestMultiplexing_RefusedAfterGoAway(t *testing.T) {
+	received := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	server := newTestTransport(&tcpOptions{DrainTimeout: 5 * time.Second})
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		defer s.Close()
+
+		var msg transport.Message
+		s.Receive(context.Background(), &msg)
+		received <- struct{}{}
+
+		<-release
+		s.Send(context.Background(), &msg)
+	})
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	s, err := client.Dial(context.Background(), l.(*tcpListener).Addr().String())
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+	<-received
+
+	go l.Close()
+
+	sess := s.(*muxStream).sess
+	require.Eventually(t, func() bool { return !sess.usable() }, time.Second, 5*time.Millisecond)
+
+	// A client that didn't get the GOAWAY in time opens a stream anyway
+	sess.mu.Lock()
+	late := newMuxStream(sess.nextID, sess)
+	sess.streams[late.id] = late
+	sess.mu.Unlock()
+	defer late.Close()
+
+	require.Nil(t, late.Send(context.Background(), &transport.Message{Data: []byte("late")}))
+
+	var rec transport.Message
+	err = late.Receive(context.Background(), &rec)
+	assert.Equal(t, &StreamError{Reason: errGoingAway.Error()}, err)
+	assert.Len(t, received, 0)
+
+	// The stream that was open is still answered
+	close(release)
+	require.Nil(t, s.Receive(context.Background(), &rec))
+	assert.Equal(t, "hello", string(rec.Data))
+}
+
+func TestMultiplexing_MaxConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	server := newTestTransport(&tcpOptions{MaxConcurrentStreams: 2})
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		<-release
+		echo(s)
+	})
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+	addr := l.(*tcpListener).Addr().String()
+
+	for i := 0; i < 2; i++ {
+		s, err := client.Dial(context.Background(), addr)
+		require.Nil(t, err)
+		defer s.Close()
+
+		require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+	}
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+
+	var rec transport.Message
+	assert.Equal(t, &StreamError{Reason: errTooManyStreams.Error()}, s.Receive(context.Background(), &rec))
+}
+
+func TestMultiplexing_FirstMessagesOutOfOrder(t *testing.T) {
+	sessions := make(chan *muxSession, 3)
+
+	addr, conns, stop := listenMux(t, func(s transport.Socket) {
+		sessions <- s.(*muxStream).sess
+		echo(s)
+	})
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	var socks []transport.Socket
+	for i := 0; i < 3; i++ {
+		s, err := client.Dial(context.Background(), addr)
+		require.Nil(t, err)
+		defer s.Close()
+
+		socks = append(socks, s)
+	}
+
+	// The stream opened last sends first, the first one is closed without sending anything
+	for _, i := range []int{2, 1} {
+		data := fmt.Sprintf("message %d", i)
+		require.Nil(t, socks[i].Send(context.Background(), &transport.Message{Data: []byte(data)}))
+
+		var rec transport.Message
+		require.Nil(t, socks[i].Receive(context.Background(), &rec))
+		assert.Equal(t, data, string(rec.Data))
+	}
+	require.Nil(t, socks[0].Close())
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(conns))
+
+	// The server doesn't keep waiting for the stream that was closed
+	sess := <-sessions
+	require.Eventually(t, func() bool {
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+
+		return len(sess.skipped) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestMultiplexing_ForgetsClosedSessions(t *testing.T) {
+	addr, _, stop := listenMux(t, echo)
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+	require.Nil(t, s.Close())
+
+	stop()
+
+	require.Eventually(t, func() bool {
+		client.dialMutex.Lock()
+		defer client.dialMutex.Unlock()
+
+		return len(client.sessions) == 0 && len(client.dialing) == 0
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+// blockingDialer never finishes connecting to blocked, and dials other addresses directly.
+type blockingDialer struct {
+	blocked string
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if address == d.blocked {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, address)
+}
+
+func TestMultiplexing_SlowDialDoesntBlockOthers(t *testing.T) {
+	addr, _, stop := listenMux(t, echo)
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{
+		UseMultiplexing: true,
+		Dialer:          &blockingDialer{blocked: "192.0.2.1:1"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go client.Dial(ctx, "192.0.2.1:1")
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		s, err := client.Dial(context.Background(), addr)
+		if err == nil {
+			s.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("dial held up by another address")
+	}
+}
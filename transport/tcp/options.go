@@ -1,14 +1,62 @@
 package tcp
 
-import "time"
+import (
+	"crypto/tls"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/MouseHatGames/mice-plugins/transport/dialer"
+)
 
 type Option func(opts *tcpOptions)
 
 type tcpOptions struct {
 	UseConnectionPooling  bool
 	ConnectionIdleTimeout time.Duration
+	ServerTLS             *tls.Config
+	ClientTLS             *tls.Config
+	ProtocolVersion       uint8
+	UseMultiplexing       bool
+	MaxConcurrentStreams  int
+	UnixSocketMode        os.FileMode
+	Compression           Compression
+	CompressionThreshold  int
+	MaxMessageSize        int
+	MaxHeaderSize         int
+	ReuseReceiveBuffers   bool
+	DialTimeout           time.Duration
+	DrainTimeout          time.Duration
+	MaxIdleConnections    int
+	MaxActiveConnections  int
+	PoolEvictAfter        time.Duration
+	HeartbeatInterval     time.Duration
+	HeartbeatTimeout      time.Duration
+	ValidateOnBorrow      bool
+	ProxyProtocol         bool
+	TrustedProxies        []netip.Prefix
+	Dialer                dialer.Dialer
+	SharedPort            bool
+	Acceptors             int
+	Dispatcher            Dispatcher
 }
 
+// Limits applied to incoming messages unless set otherwise.
+const (
+	DefaultMaxMessageSize = 64 << 20
+	DefaultMaxHeaderSize  = 1 << 20
+
+	DefaultMaxConcurrentStreams = 1000
+)
+
+// Timeouts used unless set otherwise.
+const (
+	DefaultDialTimeout  = 10 * time.Second
+	DefaultDrainTimeout = 10 * time.Second
+
+	DefaultHeartbeatTimeout = 5 * time.Second
+)
+
 func ConnectionPooling(enabled bool) Option {
 	return func(opts *tcpOptions) {
 		opts.UseConnectionPooling = enabled
@@ -19,3 +67,231 @@ func IdleTimeout(dur time.Duration) Option {
 		opts.ConnectionIdleTimeout = dur
 	}
 }
+
+// TLS makes both the listener and the dialer use TLS with the given configuration.
+// Use ServerTLS and ClientTLS if each side needs a different configuration, e.g. for mutual TLS.
+func TLS(cfg *tls.Config) Option {
+	return func(opts *tcpOptions) {
+		opts.ServerTLS = cfg
+		opts.ClientTLS = cfg
+	}
+}
+
+// ServerTLS makes the listener accept TLS connections only. Set ClientAuth and ClientCAs on
+// the configuration to require client certificates.
+func ServerTLS(cfg *tls.Config) Option {
+	return func(opts *tcpOptions) {
+		opts.ServerTLS = cfg
+	}
+}
+
+// ClientTLS makes outgoing connections use TLS. Set Certificates or GetClientCertificate on
+// the configuration to present a client certificate, and RootCAs to trust a custom CA.
+func ClientTLS(cfg *tls.Config) Option {
+	return func(opts *tcpOptions) {
+		opts.ClientTLS = cfg
+	}
+}
+
+// ProtocolVersion sets the protocol version proposed to servers when connecting. Defaults to
+// ProtocolV0, which every server understands. Listeners always accept all versions.
+func ProtocolVersion(version uint8) Option {
+	return func(opts *tcpOptions) {
+		opts.ProtocolVersion = version
+	}
+}
+
+// Multiplexing makes all sockets dialed to the same address share a single connection, each
+// one being a separate stream on it. This takes precedence over connection pooling and
+// requires protocol v1, which is proposed regardless of ProtocolVersion.
+func Multiplexing(enabled bool) Option {
+	return func(opts *tcpOptions) {
+		opts.UseMultiplexing = enabled
+	}
+}
+
+// MaxConcurrentStreams limits how many streams a client may have open at once on a multiplexed
+// connection to the listener. Streams opened past it are reset. Zero means no limit. Defaults
+// to DefaultMaxConcurrentStreams.
+func MaxConcurrentStreams(n int) Option {
+	return func(opts *tcpOptions) {
+		opts.MaxConcurrentStreams = n
+	}
+}
+
+// UnixSocketMode sets the permissions of the socket file created when listening on a
+// "unix://" address, e.g. 0660 to only let processes in the same group connect. The socket
+// already has these permissions when it appears at its path.
+func UnixSocketMode(mode os.FileMode) Option {
+	return func(opts *tcpOptions) {
+		opts.UnixSocketMode = mode
+	}
+}
+
+// Compress asks servers to let both sides compress messages with the given algorithm. Servers
+// that don't support it, or clients that don't ask, keep exchanging uncompressed messages.
+// Requires protocol v1, which is proposed regardless of ProtocolVersion.
+func Compress(c Compression) Option {
+	return func(opts *tcpOptions) {
+		opts.Compression = c
+	}
+}
+
+// CompressionThreshold sets the smallest payload, in bytes, that gets compressed on connections
+// that negotiated compression. Defaults to DefaultCompressionThreshold.
+func CompressionThreshold(size int) Option {
+	return func(opts *tcpOptions) {
+		opts.CompressionThreshold = size
+	}
+}
+
+// MaxMessageSize sets the largest message, in bytes, accepted from a peer. Peers announcing a
+// larger one get disconnected before anything is allocated. Defaults to DefaultMaxMessageSize.
+func MaxMessageSize(size int) Option {
+	return func(opts *tcpOptions) {
+		opts.MaxMessageSize = size
+	}
+}
+
+// MaxHeaderSize sets the largest encoded message header, in bytes, accepted from a peer.
+// Defaults to DefaultMaxHeaderSize.
+func MaxHeaderSize(size int) Option {
+	return func(opts *tcpOptions) {
+		opts.MaxHeaderSize = size
+	}
+}
+
+// ReuseReceiveBuffers makes every socket read the messages it receives into a pooled buffer,
+// which is reused for the next one instead of allocating a new one every time. The Data of a
+// received message is then only valid until the next message is received on the same socket,
+// or the socket is closed, and must be copied to be kept longer. Headers are always copied.
+// Doesn't apply to multiplexed streams, whose messages are queued as they arrive.
+func ReuseReceiveBuffers(enabled bool) Option {
+	return func(opts *tcpOptions) {
+		opts.ReuseReceiveBuffers = enabled
+	}
+}
+
+// DialTimeout limits how long connecting to a server may take, including the TLS and protocol
+// handshakes. A zero duration only leaves the limit to the context passed to Dial. Defaults
+// to DefaultDialTimeout.
+func DialTimeout(dur time.Duration) Option {
+	return func(opts *tcpOptions) {
+		opts.DialTimeout = dur
+	}
+}
+
+// DrainTimeout sets how long a closing listener waits for its connections to finish the
+// exchanges they're in the middle of before closing them anyway. Idle connections are closed
+// right away. Defaults to DefaultDrainTimeout.
+func DrainTimeout(dur time.Duration) Option {
+	return func(opts *tcpOptions) {
+		opts.DrainTimeout = dur
+	}
+}
+
+// MaxIdleConnections sets how many idle connections are kept in the pool of each address.
+// Defaults to pool.DefaultMaxIdle.
+func MaxIdleConnections(n int) Option {
+	return func(opts *tcpOptions) {
+		opts.MaxIdleConnections = n
+	}
+}
+
+// MaxActiveConnections limits how many pooled connections may be open to each address. Dial
+// waits for one to be returned once it's reached, zero means no limit. Defaults to
+// pool.DefaultMaxActive.
+func MaxActiveConnections(n int) Option {
+	return func(opts *tcpOptions) {
+		opts.MaxActiveConnections = n
+	}
+}
+
+// EvictPoolsAfter drops the connection pool of an address that hasn't been dialed for this
+// long, e.g. because the service behind it went away. Defaults to pool.DefaultEvictAfter.
+func EvictPoolsAfter(dur time.Duration) Option {
+	return func(opts *tcpOptions) {
+		opts.PoolEvictAfter = dur
+	}
+}
+
+// HeartbeatInterval makes the client check its connections by sending a ping frame every
+// interval and waiting for the server to answer. Idle pooled connections and multiplexed
+// connections that don't get an answer within the heartbeat timeout are closed, so that dead
+// peers are noticed before a request is sent to them. Zero disables heartbeats, which is the
+// default. Requires protocol v1, which is proposed regardless of ProtocolVersion. Servers that
+// don't support heartbeats get their connections checked for being closed instead.
+func HeartbeatInterval(dur time.Duration) Option {
+	return func(opts *tcpOptions) {
+		opts.HeartbeatInterval = dur
+	}
+}
+
+// HeartbeatTimeout sets how long the server has to answer a ping frame before the connection
+// is considered dead. Defaults to DefaultHeartbeatTimeout.
+func HeartbeatTimeout(dur time.Duration) Option {
+	return func(opts *tcpOptions) {
+		opts.HeartbeatTimeout = dur
+	}
+}
+
+// ValidateOnBorrow makes Dial exchange a ping frame with the server before handing out a pooled
+// connection, instead of only checking that the server didn't close it. This costs a round
+// trip on every Dial but catches servers that went away without closing their connections.
+// Requires protocol v1, which is proposed regardless of ProtocolVersion.
+func ValidateOnBorrow(enabled bool) Option {
+	return func(opts *tcpOptions) {
+		opts.ValidateOnBorrow = enabled
+	}
+}
+
+// ProxyProtocol makes the listener accept connections starting with a PROXY protocol v1 or v2
+// header, as sent by load balancers. The sockets passed to Accept then report the client
+// address from the header through their RemoteAddr method. Only connections coming from the
+// trusted addresses may send a header, the others get closed if they do. Connections without
+// a header are served as usual.
+func ProxyProtocol(trusted ...netip.Prefix) Option {
+	return func(opts *tcpOptions) {
+		opts.ProxyProtocol = true
+		opts.TrustedProxies = trusted
+	}
+}
+
+// Dialer sets how connections to servers are opened, e.g. through a proxy created with
+// dialer.SOCKS5 or dialer.HTTPConnect. TLS, if enabled, runs on top of the connections it
+// opens. Proxies can only reach TCP addresses. Defaults to dialer.Direct.
+func Dialer(d dialer.Dialer) Option {
+	return func(opts *tcpOptions) {
+		opts.Dialer = d
+	}
+}
+
+// SharedPort lets the listener share its port with other transports in the same process, such
+// as the grpc one with its own SharedPort option, or with an HTTP server listening through
+// portmux.Listen. Connections are told apart by their first bytes, those that aren't gRPC or
+// HTTP go to this listener. Can't be combined with TLS on more than one of them. Connections
+// starting with a PROXY protocol header always go to this listener too, so gRPC and HTTP
+// clients behind a load balancer that sends one can't reach the other listeners.
+func SharedPort(enabled bool) Option {
+	return func(opts *tcpOptions) {
+		opts.SharedPort = enabled
+	}
+}
+
+// Acceptors opens n listeners on the same address with SO_REUSEPORT, each accepting
+// connections on its own goroutine, so that a storm of new connections is spread over them by
+// the kernel. Only works with tcp addresses on Linux and the BSDs, and not along with
+// SharedPort. Defaults to a single listener.
+func Acceptors(n int) Option {
+	return func(opts *tcpOptions) {
+		opts.Acceptors = n
+	}
+}
+
+// Dispatch sets how the function given to Accept is run for each new connection, e.g. with
+// LimitHandlers. Defaults to running it on a new goroutine every time.
+func Dispatch(d Dispatcher) Option {
+	return func(opts *tcpOptions) {
+		opts.Dispatcher = d
+	}
+}
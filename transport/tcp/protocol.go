@@ -0,0 +1,245 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Protocol versions understood by the transport.
+//
+// Listeners accept every version, so a fleet can be upgraded by first rolling out the new
+// release everywhere and then enabling ProtocolVersion(ProtocolV1) on the clients.
+const (
+	// ProtocolV0 is the original framing: a bare length followed by the payload, with no handshake.
+	ProtocolV0 = 0
+
+	// ProtocolV1 starts each connection with a handshake and sends typed frames.
+	ProtocolV1 = 1
+
+	maxProtocolVersion = ProtocolV1
+)
+
+// protocolMagic is sent at the start of a connection by every client that speaks v1 or later.
+// Read as a v0 length it would announce a message over 1 GiB, so listeners can tell both
+// kinds of clients apart by peeking at the first bytes.
+var protocolMagic = [4]byte{'M', 'I', 'C', 'E'}
+
+// handshakeSize is the size of the preamble: magic, version and feature flags.
+const handshakeSize = len(protocolMagic) + 1 + 4
+
+// feature is a set of optional protocol extensions, negotiated during the handshake.
+type feature uint32
+
+const (
+	// featureMultiplex carries many streams over one connection, tagging each frame with a stream ID.
+	featureMultiplex feature = 1 << iota
+
+	// The peer may send frames compressed with one of these algorithms.
+	featureGzip
+	featureZstd
+	featureSnappy
+
+	// featureHeartbeat lets the client send ping frames, which the server answers.
+	featureHeartbeat
+
+	// featureExtendedHeaders encodes headers with varint lengths, lifting the limits on their
+	// count and size, see headers.go.
+	featureExtendedHeaders
+
+	// featureStreaming lets messages carry bodies that are sent in chunks, see body.go.
+	featureStreaming
+)
+
+func (f feature) has(o feature) bool {
+	return f&o == o
+}
+
+// protocol holds what has been agreed on with the peer of a connection.
+type protocol struct {
+	version  uint8
+	features feature
+}
+
+var ErrBadHandshake = errors.New("bad protocol handshake")
+
+func writeHandshake(w io.Writer, version uint8, features feature) error {
+	var buf [handshakeSize]byte
+
+	copy(buf[:], protocolMagic[:])
+	buf[len(protocolMagic)] = version
+	binary.LittleEndian.PutUint32(buf[len(protocolMagic)+1:], uint32(features))
+
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readHandshake(r io.Reader) (uint8, feature, error) {
+	var buf [handshakeSize]byte
+
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(buf[:len(protocolMagic)], protocolMagic[:]) {
+		return 0, 0, fmt.Errorf("%w: wrong magic", ErrBadHandshake)
+	}
+
+	version := buf[len(protocolMagic)]
+	features := feature(binary.LittleEndian.Uint32(buf[len(protocolMagic)+1:]))
+
+	if version == ProtocolV0 {
+		return 0, 0, fmt.Errorf("%w: version 0 has no handshake", ErrBadHandshake)
+	}
+
+	return version, features, nil
+}
+
+// clientHandshake proposes a version and a set of features to the server and stores the
+// ones it picked.
+func (s *tcpSocket) clientHandshake(version uint8, features feature) error {
+	if version == ProtocolV0 {
+		s.proto = protocol{version: ProtocolV0}
+		return nil
+	}
+
+	if err := writeHandshake(s.conn, version, features); err != nil {
+		return fmt.Errorf("write handshake: %w", err)
+	}
+
+	gotVersion, gotFeatures, err := readHandshake(s.r)
+	if err != nil {
+		return fmt.Errorf("read handshake: %w", err)
+	}
+	if gotVersion > version {
+		return fmt.Errorf("%w: server picked version %d", ErrBadHandshake, gotVersion)
+	}
+	if !features.has(gotFeatures) {
+		return fmt.Errorf("%w: server picked unknown features %#x", ErrBadHandshake, gotFeatures)
+	}
+
+	s.proto = protocol{version: gotVersion, features: gotFeatures}
+	return nil
+}
+
+// serverHandshake detects the version the client speaks and, for v1 and up, answers its
+// handshake with the highest version and the features both sides support.
+func (s *tcpSocket) serverHandshake(features feature) error {
+	pre, err := s.r.Peek(len(protocolMagic))
+	if err != nil {
+		return fmt.Errorf("read preamble: %w", err)
+	}
+
+	if !bytes.Equal(pre, protocolMagic[:]) {
+		// Legacy client, the peeked bytes are the length of its first message
+		s.proto = protocol{version: ProtocolV0}
+		return nil
+	}
+
+	version, wanted, err := readHandshake(s.r)
+	if err != nil {
+		return fmt.Errorf("read handshake: %w", err)
+	}
+	if version > maxProtocolVersion {
+		version = maxProtocolVersion
+	}
+
+	s.proto = protocol{version: version, features: wanted & features}
+
+	if err := writeHandshake(s.conn, s.proto.version, s.proto.features); err != nil {
+		return fmt.Errorf("write handshake: %w", err)
+	}
+
+	return nil
+}
+
+// Frame types of protocol v1.
+const (
+	frameData byte = iota
+
+	// frameClose ends a multiplexed stream. The sender won't send on it anymore.
+	frameClose
+
+	// frameReset aborts a multiplexed stream, its payload is the reason.
+	frameReset
+
+	// frameGoAway asks the peer to stop opening streams on the connection and to close it once
+	// the open ones are done.
+	frameGoAway
+
+	// framePing asks the peer to send its payload back in a framePong, showing that the
+	// connection still works end to end. Only sent if featureHeartbeat was negotiated.
+	framePing
+	framePong
+
+	// frameChunk carries a piece of the body of a message sent with flagStream.
+	frameChunk
+
+	// frameWindow lets a multiplexed stream send as many more body bytes as its payload says.
+	frameWindow
+)
+
+// frameHeaderSize is the size of a v1 frame header: type, flags and payload length.
+// Connections that multiplex streams follow it with the stream ID.
+const frameHeaderSize = 1 + 1 + 4
+
+type frameHeader struct {
+	typ    byte
+	flags  byte
+	length uint32
+	stream uint32
+}
+
+func (p protocol) frameHeaderSize() int {
+	if p.features.has(featureMultiplex) {
+		return frameHeaderSize + 4
+	}
+
+	return frameHeaderSize
+}
+
+func (p protocol) writeFrameHeader(w io.Writer, h frameHeader) error {
+	var buf [frameHeaderSize + 4]byte
+
+	_, err := w.Write(p.appendFrameHeader(buf[:0], h))
+	return err
+}
+
+// appendFrameHeader encodes h at the end of b.
+func (p protocol) appendFrameHeader(b []byte, h frameHeader) []byte {
+	b = append(b, h.typ, h.flags)
+	b = binary.LittleEndian.AppendUint32(b, h.length)
+
+	if p.features.has(featureMultiplex) {
+		b = binary.LittleEndian.AppendUint32(b, h.stream)
+	}
+
+	return b
+}
+
+func (p protocol) readFrameHeader(r io.Reader) (frameHeader, error) {
+	var buf [frameHeaderSize + 4]byte
+
+	if _, err := io.ReadFull(r, buf[:p.frameHeaderSize()]); err != nil {
+		return frameHeader{}, err
+	}
+
+	return p.parseFrameHeader(buf[:]), nil
+}
+
+// parseFrameHeader decodes a frame header from the start of b, which must be at least
+// p.frameHeaderSize() bytes long.
+func (p protocol) parseFrameHeader(b []byte) frameHeader {
+	h := frameHeader{
+		typ:    b[0],
+		flags:  b[1],
+		length: binary.LittleEndian.Uint32(b[2:]),
+	}
+
+	if p.features.has(featureMultiplex) {
+		h.stream = binary.LittleEndian.Uint32(b[frameHeaderSize:])
+	}
+
+	return h
+}
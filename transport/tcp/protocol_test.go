@@ -0,0 +1,119 @@
+package tcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolVersions(t *testing.T) {
+	server := newTestTransport(&tcpOptions{})
+
+	for _, v := range []uint8{ProtocolV0, ProtocolV1, maxProtocolVersion + 1} {
+		client := newTestTransport(&tcpOptions{ProtocolVersion: v})
+
+		rec, err := exchange(client, server)
+
+		require.Nil(t, err, "version %d", v)
+		assert.Equal(t, "hello", string(rec.Data))
+		assert.Equal(t, "1", rec.MessageHeaders["a"])
+	}
+}
+
+func TestServerHandshake(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	srv := newSocket(c2)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.serverHandshake(0x1)
+	}()
+
+	require.Nil(t, writeHandshake(c1, 42, 0x3))
+
+	version, features, err := readHandshake(c1)
+	require.Nil(t, err)
+	require.Nil(t, <-done)
+
+	assert.EqualValues(t, maxProtocolVersion, version)
+	assert.EqualValues(t, 0x1, features)
+	assert.Equal(t, protocol{version: maxProtocolVersion, features: 0x1}, srv.proto)
+}
+
+func TestServerHandshake_Legacy(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	srv := newSocket(c2)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.serverHandshake(0)
+	}()
+
+	// The length of a v0 message must still be readable once the handshake is over
+	go c1.Write([]byte{5, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'})
+
+	require.Nil(t, <-done)
+	assert.EqualValues(t, ProtocolV0, srv.proto.version)
+
+	h, payload, err := srv.readFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, frameData, h.typ)
+	assert.Equal(t, "hello", string(payload))
+}
+
+func TestClientHandshake_BadResponse(t *testing.T) {
+	responses := map[string][]byte{
+		"wrong magic":     {'N', 'O', 'P', 'E', 1, 0, 0, 0, 0},
+		"version 0":       {'M', 'I', 'C', 'E', 0, 0, 0, 0, 0},
+		"higher version":  {'M', 'I', 'C', 'E', 2, 0, 0, 0, 0},
+		"unknown feature": {'M', 'I', 'C', 'E', 1, 4, 0, 0, 0},
+	}
+
+	for name, resp := range responses {
+		c1, c2 := net.Pipe()
+
+		go func(resp []byte) {
+			readHandshake(c2)
+			c2.Write(resp)
+		}(resp)
+
+		err := newSocket(c1).clientHandshake(ProtocolV1, 0x3)
+		assert.ErrorIs(t, err, ErrBadHandshake, name)
+
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestFrameHeader(t *testing.T) {
+	h := frameHeader{typ: frameData, flags: 0x2, length: 1234}
+	p := protocol{version: ProtocolV1}
+	b := &bytes.Buffer{}
+
+	require.Nil(t, p.writeFrameHeader(b, h))
+	assert.Equal(t, frameHeaderSize, b.Len())
+
+	ret, err := p.readFrameHeader(b)
+	assert.Nil(t, err)
+	assert.Equal(t, h, ret)
+}
+
+func TestFrameHeader_Multiplexed(t *testing.T) {
+	h := frameHeader{typ: frameClose, length: 0, stream: 77}
+	p := protocol{version: ProtocolV1, features: featureMultiplex}
+	b := &bytes.Buffer{}
+
+	require.Nil(t, p.writeFrameHeader(b, h))
+	assert.Equal(t, frameHeaderSize+4, b.Len())
+
+	ret, err := p.readFrameHeader(b)
+	assert.Nil(t, err)
+	assert.Equal(t, h, ret)
+}
@@ -0,0 +1,257 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrProxyHeader    = errors.New("malformed PROXY protocol header")
+	ErrUntrustedProxy = errors.New("PROXY protocol header from untrusted source")
+)
+
+// Both versions of the PROXY protocol start with a fixed prefix, which can't be mistaken for
+// the protocol magic or for the length of a v0 message within the size limits.
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// proxyV1MaxLength is the longest v1 header allowed by the specification, CRLF included.
+	proxyV1MaxLength = 107
+
+	// proxyV2HeaderSize is the size of the fixed part of a v2 header.
+	proxyV2HeaderSize = 16
+)
+
+// proxyListener accepts connections that may start with a PROXY protocol header, e.g. because
+// they come through a load balancer.
+type proxyListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyConn{
+		Conn:    c,
+		r:       bufio.NewReaderSize(c, proxyV1MaxLength),
+		trusted: l.isTrusted(c.RemoteAddr()),
+	}, nil
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, p := range l.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyConn reads the PROXY protocol header, if any, before anything else is read from the
+// connection. RemoteAddr returns the client address it carries.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	trusted bool
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		addr, found, err := readProxyHeader(c.r)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if found && !c.trusted {
+			c.err = fmt.Errorf("%w: %s", ErrUntrustedProxy, c.Conn.RemoteAddr())
+			return
+		}
+
+		c.remote = addr
+	})
+
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+
+	// Skip the buffer once the bytes read along with the header are gone
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client address sent by the proxy, or the address of the peer if
+// there's none. It waits for the header to be read.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header if the connection starts with one.
+// The returned address is nil if the header doesn't carry the client's, e.g. for health checks
+// made by the proxy itself.
+func readProxyHeader(r *bufio.Reader) (addr net.Addr, found bool, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		pre, err := r.Peek(len(proxyV1Prefix))
+		if err != nil || !bytes.Equal(pre, proxyV1Prefix) {
+			return nil, false, nil
+		}
+
+		addr, err := readProxyV1(r)
+		return addr, true, err
+
+	case proxyV2Signature[0]:
+		pre, err := r.Peek(len(proxyV2Signature))
+		if err != nil || !bytes.Equal(pre, proxyV2Signature) {
+			return nil, false, nil
+		}
+
+		addr, err := readProxyV2(r)
+		return addr, true, err
+	}
+
+	return nil, false, nil
+}
+
+// readProxyV1 reads a header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("%w: v1 header too long", ErrProxyHeader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header doesn't end with CRLF", ErrProxyHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%w: missing protocol", ErrProxyHeader)
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unknown protocol %q", ErrProxyHeader, fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: expected 6 fields, got %d", ErrProxyHeader, len(fields))
+	}
+
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: bad source address %q", ErrProxyHeader, fields[2])
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad source port %q", ErrProxyHeader, fields[4])
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// Commands and address families of v2 headers.
+const (
+	proxyV2Local = 0x0
+	proxyV2Proxy = 0x1
+
+	proxyV2Inet  = 0x1
+	proxyV2Inet6 = 0x2
+)
+
+// readProxyV2 reads a binary header: the signature, the version and command, the address
+// family and transport protocol, the length of the rest and then the addresses.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [proxyV2HeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if version := hdr[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrProxyHeader, version)
+	}
+
+	cmd, family := hdr[12]&0xf, hdr[13]>>4
+
+	// Addresses may be followed by TLVs, which are skipped
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case proxyV2Local:
+		return nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, fmt.Errorf("%w: unknown command %d", ErrProxyHeader, cmd)
+	}
+
+	var size int
+	switch family {
+	case proxyV2Inet:
+		size = 4
+	case proxyV2Inet6:
+		size = 16
+	default:
+		// Unix sockets and unspecified families have no address worth reporting
+		return nil, nil
+	}
+
+	if len(body) < 2*size+4 {
+		return nil, fmt.Errorf("%w: addresses don't fit in %d bytes", ErrProxyHeader, len(body))
+	}
+
+	ip, _ := netip.AddrFromSlice(body[:size])
+	port := binary.BigEndian.Uint16(body[2*size:])
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
@@ -0,0 +1,164 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, 0x20|cmd, family<<4|0x1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := append(append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...), 0xdc, 0x04, 0x01, 0xbb)
+
+	tests := []struct {
+		name  string
+		input []byte
+		addr  string
+		found bool
+		err   bool
+	}{
+		{"no header", []byte("MICE\x01"), "", false, false},
+		{"v0 length", []byte("PRO\x00\x00"), "", false, false},
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324", true, false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", true, false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", true, false},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"), "", true, true},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n"), "", true, true},
+		{"v1 no crlf", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), "", true, true},
+		{"v1 too long", []byte("PROXY " + strings.Repeat("A", 200) + "\r\n"), "", true, true},
+		{"v2 inet", proxyV2Header(proxyV2Proxy, proxyV2Inet, v4), "192.0.2.1:56324", true, false},
+		{"v2 inet6", proxyV2Header(proxyV2Proxy, proxyV2Inet6, v6), "[2001:db8::1]:56324", true, false},
+		{"v2 tlvs", proxyV2Header(proxyV2Proxy, proxyV2Inet, append(v4, 0x04, 0x00, 0x01, 0xff)), "192.0.2.1:56324", true, false},
+		{"v2 local", proxyV2Header(proxyV2Local, 0, nil), "", true, false},
+		{"v2 short", proxyV2Header(proxyV2Proxy, proxyV2Inet6, v4), "", true, true},
+	}
+
+	for _, tt := range tests {
+		r := bufio.NewReaderSize(bytes.NewReader(append(tt.input, "MICE"...)), proxyV1MaxLength)
+
+		addr, found, err := readProxyHeader(r)
+
+		assert.Equal(t, tt.found, found, tt.name)
+		if tt.err {
+			assert.ErrorIs(t, err, ErrProxyHeader, tt.name)
+			continue
+		}
+
+		require.Nil(t, err, tt.name)
+		if tt.addr == "" {
+			assert.Nil(t, addr, tt.name)
+		} else if assert.NotNil(t, addr, tt.name) {
+			assert.Equal(t, tt.addr, addr.String(), tt.name)
+		}
+
+		// Whatever follows the header must be left alone
+		rest, _ := r.Peek(4)
+		if found {
+			assert.Equal(t, "MICE", string(rest), tt.name)
+		}
+	}
+}
+
+// listenProxy starts a listener accepting PROXY protocol headers from the given sources,
+// returning the remote address of every socket it serves.
+func listenProxy(t *testing.T, trusted ...netip.Prefix) (addr string, remotes chan net.Addr, stop func()) {
+	server := newTestTransport(&tcpOptions{ProxyProtocol: true, TrustedProxies: trusted, DrainTimeout: time.Second})
+
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+
+	remotes = make(chan net.Addr, 1)
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		remotes <- s.(interface{ RemoteAddr() net.Addr }).RemoteAddr()
+		echo(s)
+	})
+
+	return l.(*tcpListener).Addr().String(), remotes, func() { l.Close() }
+}
+
+// dialProxy connects to addr, sends header and then a v0 message, returning the reply.
+func dialProxy(addr string, header []byte) (*transport.Message, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.Write(header); err != nil {
+		return nil, err
+	}
+
+	s := newSocket(c)
+	defer s.Close()
+
+	if err := s.Send(context.Background(), &transport.Message{Data: []byte("hello")}); err != nil {
+		return nil, err
+	}
+
+	var rec transport.Message
+	if err := s.Receive(context.Background(), &rec); err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+func TestProxyProtocol(t *testing.T) {
+	addr, remotes, stop := listenProxy(t, netip.MustParsePrefix("127.0.0.0/8"))
+	defer stop()
+
+	rec, err := dialProxy(addr, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	require.Nil(t, err)
+
+	assert.Equal(t, "hello", string(rec.Data))
+	assert.Equal(t, "192.0.2.1:56324", (<-remotes).String())
+}
+
+func TestProxyProtocol_NoHeader(t *testing.T) {
+	addr, remotes, stop := listenProxy(t, netip.MustParsePrefix("127.0.0.0/8"))
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{ProtocolVersion: ProtocolV1})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+
+	assert.Equal(t, "hello", string(rec.Data))
+	assert.Equal(t, "127.0.0.1", (<-remotes).(*net.TCPAddr).IP.String())
+}
+
+func TestProxyProtocol_Untrusted(t *testing.T) {
+	addr, remotes, stop := listenProxy(t, netip.MustParsePrefix("10.0.0.0/8"))
+	defer stop()
+
+	_, err := dialProxy(addr, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	assert.NotNil(t, err)
+
+	select {
+	case <-remotes:
+		t.Fatal("connection from untrusted proxy shouldn't be served")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
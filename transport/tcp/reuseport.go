@@ -0,0 +1,41 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var ErrReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+// listenReusePort opens n listeners on the same address with SO_REUSEPORT, so that the kernel
+// spreads new connections over them.
+func listenReusePort(network, address string, n int) ([]net.Listener, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("several acceptors need a tcp address, not %s", network)
+	}
+
+	lc := net.ListenConfig{Control: reusePort}
+
+	ls := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), network, address)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+
+			return nil, err
+		}
+
+		// The others must end up on the same port as the first one if it was picked by the kernel
+		if i == 0 {
+			address = l.Addr().String()
+		}
+
+		ls = append(ls, l)
+	}
+
+	return ls, nil
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package tcp
+
+import "syscall"
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return ErrReusePortUnsupported
+}
@@ -0,0 +1,602 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MouseHatGames/mice-plugins/transport/pool"
+	"github.com/MouseHatGames/mice/transport"
+)
+
+type tcpSocket struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	pool   *pool.Pool
+	proto  protocol
+	ms, mr sync.Mutex
+
+	// mb is held while a streamed body is being sent, keeping other messages out of it.
+	mb sync.Mutex
+
+	// compressMin is the smallest payload that gets compressed, if compression was negotiated.
+	compressMin int
+
+	maxMessage, maxHeader int
+
+	// broken is set once the connection can't be trusted to be at a frame boundary anymore,
+	// so that it's closed instead of going back to the pool.
+	broken int32
+
+	// pings counts the ping frames sent, each one carrying its number.
+	pings uint64
+
+	// reuseRecv makes payloads be read into rbuf, which is reused by every message received.
+	reuseRecv bool
+	rbuf      *[]byte
+
+	// iov and bufs are used to write frames with writev.
+	iov  [2][]byte
+	bufs net.Buffers
+
+	// state tells whether the socket is waiting for the peer to start a new message, in which
+	// case a draining listener can close it without interrupting an exchange.
+	state    int32
+	draining int32
+}
+
+var (
+	errBrokenConn     = errors.New("connection is broken")
+	errUnexpectedData = errors.New("unexpected data on idle connection")
+	errWrongPong      = errors.New("pong doesn't match ping")
+)
+
+const (
+	stateIdle int32 = iota
+	stateActive
+	stateClosed
+)
+
+func newSocket(conn net.Conn) *tcpSocket {
+	return &tcpSocket{
+		conn:       conn,
+		r:          bufio.NewReader(conn),
+		maxMessage: DefaultMaxMessageSize,
+		maxHeader:  DefaultMaxHeaderSize,
+	}
+}
+
+// configure applies the settings that are relevant to a single connection.
+func (s *tcpSocket) configure(opts *tcpOptions) {
+	s.compressMin = opts.CompressionThreshold
+	s.reuseRecv = opts.ReuseReceiveBuffers
+
+	if opts.MaxMessageSize > 0 {
+		s.maxMessage = opts.MaxMessageSize
+	}
+	if opts.MaxHeaderSize > 0 {
+		s.maxHeader = opts.MaxHeaderSize
+	}
+}
+
+func (s *tcpSocket) Close() error {
+	// A broken connection has already been closed, the pool only needs to forget about it
+	broken := atomic.LoadInt32(&s.broken) != 0
+
+	if s.pool != nil {
+		if broken {
+			s.pool.Discard(s)
+			return nil
+		}
+
+		return s.pool.Put(s)
+	}
+	if broken {
+		s.releaseBuffer()
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.releaseBuffer()
+
+	return err
+}
+
+// releaseBuffer gives the receive buffer back to the pool once the connection is closed.
+func (s *tcpSocket) releaseBuffer() {
+	s.mr.Lock()
+	defer s.mr.Unlock()
+
+	if s.rbuf != nil {
+		putBuffer(s.rbuf)
+		s.rbuf = nil
+	}
+}
+
+// RemoteAddr returns the address of the peer. On listeners with the PROXY protocol enabled,
+// this is the address of the client behind the proxy.
+func (s *tcpSocket) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// drain closes the connection as soon as it isn't in the middle of an exchange.
+func (s *tcpSocket) drain() {
+	atomic.StoreInt32(&s.draining, 1)
+
+	if atomic.CompareAndSwapInt32(&s.state, stateIdle, stateClosed) {
+		s.breakConn()
+	}
+}
+
+// alive checks that an idle connection hasn't been closed by the peer in the meantime.
+func (s *tcpSocket) alive() error {
+	if atomic.LoadInt32(&s.broken) != 0 {
+		return errBrokenConn
+	}
+	if s.r.Buffered() > 0 {
+		return errUnexpectedData
+	}
+
+	return connCheck(s.conn)
+}
+
+// ping sends a ping frame to the peer and waits up to timeout for its pong. If heartbeats
+// weren't negotiated, it only checks that the peer didn't close the connection. Must only be
+// called on idle client connections.
+func (s *tcpSocket) ping(timeout time.Duration) error {
+	if !s.proto.features.has(featureHeartbeat) {
+		return s.alive()
+	}
+	if err := s.alive(); err != nil {
+		return err
+	}
+
+	s.mr.Lock()
+	defer s.mr.Unlock()
+
+	s.pings++
+
+	var payload [8]byte
+	binary.LittleEndian.PutUint64(payload[:], s.pings)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := withContext(ctx, s.conn, net.Conn.SetDeadline)
+
+	err := s.sendControl(frameHeader{typ: framePing}, payload[:])
+	if err == nil {
+		var h frameHeader
+		var pong []byte
+
+		h, pong, err = s.readFrame()
+		if err == nil && (h.typ != framePong || !bytes.Equal(pong, payload[:])) {
+			err = errWrongPong
+		}
+	}
+
+	if err = done(err); err != nil {
+		s.breakConn()
+		return fmt.Errorf("heartbeat: %w", err)
+	}
+
+	return nil
+}
+
+// breakConn closes the underlying connection after an error that left it in an unknown state.
+func (s *tcpSocket) breakConn() {
+	if atomic.CompareAndSwapInt32(&s.broken, 0, 1) {
+		s.conn.Close()
+	}
+}
+
+// aLongTimeAgo is a deadline in the past, used to unblock pending I/O on a connection.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// withContext makes the I/O on conn follow ctx's deadline and cancellation, where setDeadline
+// is one of net.Conn's SetDeadline methods. The returned function must be called with the
+// outcome of the I/O, and returns ctx's error if that's what stopped it.
+func withContext(ctx context.Context, conn net.Conn, setDeadline func(net.Conn, time.Time) error) func(error) error {
+	if ctx.Done() == nil {
+		return func(err error) error { return err }
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	setDeadline(conn, deadline)
+
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		setDeadline(conn, aLongTimeAgo)
+		close(cancelled)
+	})
+
+	return func(err error) error {
+		if !stop() {
+			<-cancelled
+		}
+		setDeadline(conn, time.Time{})
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if hasDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+				return context.DeadlineExceeded
+			}
+		}
+
+		return err
+	}
+}
+
+// Send writes a message to the connection. If ctx expires halfway through, the connection is
+// closed since the peer can't make sense of it anymore.
+func (s *tcpSocket) Send(ctx context.Context, msg *transport.Message) error {
+	s.mb.Lock()
+	defer s.mb.Unlock()
+
+	return s.sendMessage(ctx, frameHeader{typ: frameData}, msg)
+}
+
+// Receive reads the next message from the connection. If ctx expires before the message is
+// complete, the connection is closed since it can't be reused without reading the rest.
+// Streamed bodies are read whole, up to the maximum message size.
+func (s *tcpSocket) Receive(ctx context.Context, msg *transport.Message) error {
+	s.mr.Lock()
+	defer s.mr.Unlock()
+
+	h, err := s.receive(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	if h.flags&flagStream != 0 {
+		return readBody(&socketBody{s: s, ctx: ctx}, msg, s.maxMessage)
+	}
+
+	return nil
+}
+
+// receive reads the next data frame into msg. Must be called with mr held.
+func (s *tcpSocket) receive(ctx context.Context, msg *transport.Message) (frameHeader, error) {
+	done := withContext(ctx, s.conn, net.Conn.SetReadDeadline)
+
+	h, payload, err := s.readAnsweringPings(s.nextFrame)
+	if err = done(err); err != nil {
+		s.breakConn()
+		return h, err
+	}
+	if h.typ != frameData {
+		s.breakConn()
+		return h, fmt.Errorf("%w: unexpected frame type %d", ErrMalformedFrame, h.typ)
+	}
+	if h.flags&flagStream != 0 && !s.proto.features.has(featureStreaming) {
+		s.breakConn()
+		return h, fmt.Errorf("%w: streamed body without streaming", ErrMalformedFrame)
+	}
+
+	if err := s.decode(payload, msg); err != nil {
+		s.breakConn()
+		return h, err
+	}
+
+	return h, nil
+}
+
+// readAnsweringPings reads frames with read, answering the pings sent by the peer in the
+// meantime, until it gets a different one.
+func (s *tcpSocket) readAnsweringPings(read func() (frameHeader, []byte, error)) (frameHeader, []byte, error) {
+	h, payload, err := read()
+	for err == nil && h.typ == framePing && s.proto.features.has(featureHeartbeat) {
+		if err = s.sendControl(frameHeader{typ: framePong}, payload); err == nil {
+			h, payload, err = read()
+		}
+	}
+
+	return h, payload, err
+}
+
+// decode reads a message from the payload of a data frame.
+func (s *tcpSocket) decode(payload []byte, msg *transport.Message) error {
+	if s.reuseRecv {
+		return s.decodeReused(payload, msg)
+	}
+
+	if err := s.proto.decodePayload(payload, msg); err != nil {
+		return fmt.Errorf("decode payload: %w", err)
+	}
+
+	if size := len(payload) - len(msg.Data); size > s.maxHeader {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrHeaderTooLarge, size, s.maxHeader)
+	}
+
+	return nil
+}
+
+// decodeReused reads a message from a payload in the receive buffer. Only the data points into
+// it, the headers are decoded from a copy since they're kept around.
+func (s *tcpSocket) decodeReused(payload []byte, msg *transport.Message) error {
+	n, err := s.proto.headerSize(payload)
+	if err != nil {
+		return fmt.Errorf("decode payload: %w", err)
+	}
+	if n > s.maxHeader {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrHeaderTooLarge, n, s.maxHeader)
+	}
+
+	if err := s.proto.decodePayload(append([]byte(nil), payload[:n]...), msg); err != nil {
+		return fmt.Errorf("decode payload: %w", err)
+	}
+	msg.Data = payload[n:]
+
+	return nil
+}
+
+// sendMessage writes a frame with a message as its payload. The frame's length is filled in.
+func (s *tcpSocket) sendMessage(ctx context.Context, h frameHeader, msg *transport.Message) error {
+	// Check this before anything hits the wire so that the connection stays usable
+	if err := s.proto.checkHeaders(msg.MessageHeaders); err != nil {
+		return err
+	}
+
+	s.ms.Lock()
+	defer s.ms.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := withContext(ctx, s.conn, net.Conn.SetWriteDeadline)
+
+	err := done(s.writeMessage(h, msg))
+	if err != nil {
+		s.breakConn()
+	}
+
+	return err
+}
+
+func (s *tcpSocket) writeMessage(h frameHeader, msg *transport.Message) error {
+	size := s.proto.messageSize(msg)
+
+	if c := s.proto.compression(); c != NoCompression && size >= s.compressMin {
+		return s.writeCompressed(h, c, msg, size)
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	b := *buf
+	if s.proto.version == ProtocolV0 {
+		b = binary.LittleEndian.AppendUint32(b, uint32(size))
+	} else {
+		h.length = uint32(size)
+		b = s.proto.appendFrameHeader(b, h)
+	}
+	b = s.proto.appendHeaders(b, msg.MessageHeaders)
+
+	if err := s.writeFrame(buf, b, msg.Data); err != nil {
+		return fmt.Errorf("write frame: %w", err)
+	}
+
+	return nil
+}
+
+// maxCoalesceSize is the largest payload that gets copied after the frame header so that the
+// whole frame goes out in a single write. Larger ones are written along with the header using
+// writev instead.
+const maxCoalesceSize = 16 << 10
+
+// writeFrame writes the encoded frame header in head followed by data. head must be in buf,
+// which is updated if head needs to grow.
+func (s *tcpSocket) writeFrame(buf *[]byte, head, data []byte) error {
+	if len(data) <= maxCoalesceSize {
+		head = append(head, data...)
+		*buf = head
+
+		_, err := s.conn.Write(head)
+		return err
+	}
+
+	*buf = head
+
+	// The slices are kept on the socket so that this doesn't allocate
+	s.iov = [2][]byte{head, data}
+	s.bufs = s.iov[:]
+	_, err := s.bufs.WriteTo(s.conn)
+	s.iov = [2][]byte{}
+
+	return err
+}
+
+// zeroHeader is used to reserve room for a frame header in a buffer before its length is known.
+var zeroHeader [frameHeaderSize + 4]byte
+
+// writeCompressed writes a message frame, compressing its payload if that makes it smaller.
+func (s *tcpSocket) writeCompressed(h frameHeader, c Compression, msg *transport.Message, size int) error {
+	hs := s.proto.frameHeaderSize()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	frame := append(slices.Grow(*buf, hs+size), zeroHeader[:hs]...)
+	frame = s.proto.appendHeaders(frame, msg.MessageHeaders)
+	frame = append(frame, msg.Data...)
+	*buf = frame
+
+	out := getBuffer()
+	defer putBuffer(out)
+
+	compressed, err := compress(c, append(*out, zeroHeader[:hs]...), frame[hs:])
+	*out = compressed
+	if err != nil {
+		return fmt.Errorf("compress payload: %w", err)
+	}
+
+	if len(compressed) < len(frame) {
+		frame = compressed
+		h.flags |= flagCompressed
+	}
+
+	h.length = uint32(len(frame) - hs)
+	s.proto.appendFrameHeader(frame[:0], h)
+
+	if _, err := s.conn.Write(frame); err != nil {
+		return fmt.Errorf("write frame: %w", err)
+	}
+
+	return nil
+}
+
+// sendControl writes a frame with an opaque payload, only available from protocol v1 onwards.
+func (s *tcpSocket) sendControl(h frameHeader, payload []byte) error {
+	s.ms.Lock()
+	defer s.ms.Unlock()
+
+	h.length = uint32(len(payload))
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := s.writeFrame(buf, s.proto.appendFrameHeader(*buf, h), payload); err != nil {
+		s.breakConn()
+		return fmt.Errorf("write frame: %w", err)
+	}
+
+	return nil
+}
+
+// nextFrame waits for the peer to start sending a frame and reads it. The socket is idle
+// while waiting.
+func (s *tcpSocket) nextFrame() (frameHeader, []byte, error) {
+	atomic.StoreInt32(&s.state, stateIdle)
+	if atomic.LoadInt32(&s.draining) != 0 {
+		return frameHeader{}, nil, ErrListenerClosed
+	}
+
+	// Errors are returned again by readFrame
+	s.r.Peek(1)
+
+	if !atomic.CompareAndSwapInt32(&s.state, stateIdle, stateActive) {
+		return frameHeader{}, nil, ErrListenerClosed
+	}
+
+	return s.readFrame()
+}
+
+// peek returns the next n bytes without consuming them. Like io.ReadFull, it fails with
+// io.ErrUnexpectedEOF if the connection is closed after only some of them.
+func (s *tcpSocket) peek(n int) ([]byte, error) {
+	b, err := s.r.Peek(n)
+	if err == io.EOF && len(b) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return b, err
+}
+
+// readFrame reads the next frame from the connection. v0 messages are returned as data frames.
+func (s *tcpSocket) readFrame() (frameHeader, []byte, error) {
+	var h frameHeader
+
+	if s.proto.version == ProtocolV0 {
+		b, err := s.peek(4)
+		if err != nil {
+			return h, nil, fmt.Errorf("read length: %w", err)
+		}
+
+		len := int32(binary.LittleEndian.Uint32(b))
+		s.r.Discard(4)
+
+		if len < 0 {
+			return h, nil, fmt.Errorf("%w: negative length %d", ErrMalformedFrame, len)
+		}
+
+		h = frameHeader{typ: frameData, length: uint32(len)}
+	} else {
+		n := s.proto.frameHeaderSize()
+
+		b, err := s.peek(n)
+		if err != nil {
+			return h, nil, fmt.Errorf("read frame header: %w", err)
+		}
+
+		h = s.proto.parseFrameHeader(b)
+		s.r.Discard(n)
+	}
+
+	if int64(h.length) > int64(s.maxMessage) {
+		return h, nil, fmt.Errorf("%w: %d bytes, limit is %d", ErrMessageTooLarge, h.length, s.maxMessage)
+	}
+
+	if h.flags&flagCompressed != 0 {
+		payload, err := s.readCompressed(h.length)
+		if err != nil {
+			return h, nil, err
+		}
+
+		h.flags &^= flagCompressed
+		h.length = uint32(len(payload))
+
+		return h, payload, nil
+	}
+
+	payload := s.payloadBuffer(int(h.length))
+
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return h, nil, fmt.Errorf("read payload: %w", err)
+	}
+
+	return h, payload, nil
+}
+
+// payloadBuffer returns n bytes to read a payload into. Sockets that reuse their receive
+// buffer return the same one every time, unless the payload is too large to be pooled.
+func (s *tcpSocket) payloadBuffer(n int) []byte {
+	if !s.reuseRecv || n > maxPooledBuffer {
+		return make([]byte, n)
+	}
+
+	if s.rbuf == nil {
+		s.rbuf = getBuffer()
+	}
+	*s.rbuf = slices.Grow((*s.rbuf)[:0], n)[:n]
+
+	return *s.rbuf
+}
+
+// readCompressed reads a compressed payload of the given length and decompresses it. Only
+// the decompressed payload is allocated.
+func (s *tcpSocket) readCompressed(length uint32) ([]byte, error) {
+	c := s.proto.compression()
+	if c == NoCompression {
+		return nil, fmt.Errorf("%w: compressed frame on a connection without compression", ErrMalformedFrame)
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	compressed := slices.Grow(*buf, int(length))[:length]
+	*buf = compressed
+
+	if _, err := io.ReadFull(s.r, compressed); err != nil {
+		return nil, fmt.Errorf("read payload: %w", err)
+	}
+
+	payload, err := decompress(c, compressed, s.maxMessage)
+	if err != nil {
+		return nil, fmt.Errorf("decompress payload: %w", err)
+	}
+
+	return payload, nil
+}
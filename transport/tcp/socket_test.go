@@ -0,0 +1,373 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/MouseHatGames/mice/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveRaw makes a socket speaking p receive whatever bytes are written by the peer.
+func receiveRaw(p protocol, raw []byte) (peer net.Conn, err error) {
+	c1, c2 := net.Pipe()
+
+	s := newSocket(c2)
+	s.proto = p
+
+	go c1.Write(raw)
+
+	var msg transport.Message
+	return c1, s.Receive(context.Background(), &msg)
+}
+
+func assertClosed(t *testing.T, peer net.Conn) {
+	_, err := peer.Write([]byte{0})
+	assert.NotNil(t, err, "connection should have been closed")
+}
+
+func TestReceive_NegativeLength(t *testing.T) {
+	peer, err := receiveRaw(protocol{}, []byte{0xff, 0xff, 0xff, 0xff})
+
+	assert.ErrorIs(t, err, ErrMalformedFrame)
+	assertClosed(t, peer)
+}
+
+func TestReceive_MessageTooLarge(t *testing.T) {
+	raw := make([]byte, 4)
+	binary.LittleEndian.PutUint32(raw, DefaultMaxMessageSize+1)
+
+	peer, err := receiveRaw(protocol{}, raw)
+
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	assertClosed(t, peer)
+}
+
+func TestReceive_HeaderTooLarge(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	sender, receiver := newSocket(c1), newSocket(c2)
+	receiver.configure(&tcpOptions{MaxHeaderSize: 10})
+
+	go sender.Send(context.Background(), &transport.Message{
+		MessageHeaders: map[string]string{"key": "a value that's too long"},
+	})
+
+	var msg transport.Message
+	err := receiver.Receive(context.Background(), &msg)
+
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+	assertClosed(t, c1)
+}
+
+func TestReceive_ReuseBuffers(t *testing.T) {
+	for _, p := range []protocol{{}, {version: ProtocolV1, features: featureExtendedHeaders}} {
+		encoded := &bufferConn{}
+		encoder := newSocket(encoded)
+		encoder.proto = p
+
+		for _, v := range []string{"first", "other"} {
+			require.Nil(t, encoder.Send(context.Background(), &transport.Message{
+				MessageHeaders: map[string]string{"key": v},
+				Data:           []byte(v),
+			}))
+		}
+
+		s := newSocket(&replayConn{data: encoded.buf.Bytes()})
+		s.proto = p
+		s.configure(&tcpOptions{ReuseReceiveBuffers: true})
+
+		var first, second transport.Message
+		require.Nil(t, s.Receive(context.Background(), &first))
+		assert.Equal(t, "first", string(first.Data))
+
+		require.Nil(t, s.Receive(context.Background(), &second))
+		assert.Equal(t, "other", string(second.Data))
+
+		// The data is read into the same buffer every time, but the headers are kept
+		assert.Same(t, &first.Data[0], &second.Data[0])
+		assert.Equal(t, map[string]string{"key": "first"}, first.MessageHeaders)
+		assert.Equal(t, map[string]string{"key": "other"}, second.MessageHeaders)
+
+		// It goes back to the pool once the socket is closed
+		s.releaseBuffer()
+		assert.Nil(t, s.rbuf)
+	}
+}
+
+func TestReuseReceiveBuffers_Exchange(t *testing.T) {
+	opts := &tcpOptions{ReuseReceiveBuffers: true, UseConnectionPooling: true}
+
+	rec, err := exchange(newTestTransport(opts), newTestTransport(opts))
+
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(rec.Data))
+	assert.Equal(t, "1", rec.MessageHeaders["a"])
+}
+
+func TestReceive_UnknownFrameType(t *testing.T) {
+	b := &bytes.Buffer{}
+	p := protocol{version: ProtocolV1}
+	p.writeFrameHeader(b, frameHeader{typ: 200})
+
+	peer, err := receiveRaw(p, b.Bytes())
+
+	assert.ErrorIs(t, err, ErrMalformedFrame)
+	assertClosed(t, peer)
+}
+
+func TestSend_TooManyHeadersKeepsConnection(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	s := newSocket(c1)
+	headers := map[string]string{}
+	for i := 0; i <= maxHeaderCount; i++ {
+		headers[string(rune(i+'0'))+"k"] = ""
+	}
+
+	err := s.Send(context.Background(), &transport.Message{MessageHeaders: headers})
+
+	assert.Equal(t, transport.ErrTooManyHeaders, err)
+	assert.Zero(t, s.broken)
+}
+
+func TestReceive_DeadlineExceeded(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	s := newSocket(c2)
+
+	// Only part of the message arrives in time
+	go c1.Write([]byte{10, 0, 0, 0, 0})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var msg transport.Message
+	err := s.Receive(ctx, &msg)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.NotZero(t, s.broken)
+	assertClosed(t, c1)
+}
+
+func TestReceive_Cancelled(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	s := newSocket(c2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	var msg transport.Message
+	err := s.Receive(ctx, &msg)
+
+	assert.Equal(t, context.Canceled, err)
+	assertClosed(t, c1)
+}
+
+func TestSend_Cancelled(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// Nobody reads from the other end, so the write blocks
+	s := newSocket(c1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	err := s.Send(ctx, &transport.Message{Data: []byte("hello")})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.NotZero(t, s.broken)
+
+	err = s.Send(context.Background(), &transport.Message{})
+	assert.NotNil(t, err)
+}
+
+func TestSendReceive_DeadlineCleared(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	sender, receiver := newSocket(c1), newSocket(c2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	go sender.Send(ctx, &transport.Message{Data: []byte("first")})
+
+	var msg transport.Message
+	require.Nil(t, receiver.Receive(ctx, &msg))
+	cancel()
+
+	// Deadlines from a previous context must not affect later calls
+	time.Sleep(10 * time.Millisecond)
+	go sender.Send(context.Background(), &transport.Message{Data: []byte("second")})
+
+	require.Nil(t, receiver.Receive(context.Background(), &msg))
+	assert.Equal(t, "second", string(msg.Data))
+	assert.Zero(t, receiver.broken)
+}
+
+func TestDecompress_Bomb(t *testing.T) {
+	data := make([]byte, 1<<20)
+
+	for _, c := range compressions {
+		compressed, err := compress(c, nil, data)
+		require.Nil(t, err)
+
+		_, err = decompress(c, compressed, 1024)
+		assert.ErrorIs(t, err, ErrMessageTooLarge, "%s", c)
+
+		out, err := decompress(c, compressed, len(data))
+		assert.Nil(t, err, "%s", c)
+		assert.Len(t, out, len(data))
+	}
+}
+
+func TestDecompress_Garbage(t *testing.T) {
+	for _, c := range compressions {
+		_, err := decompress(c, []byte("definitely not compressed"), 1024)
+		assert.ErrorIs(t, err, ErrMalformedFrame, "%s", c)
+	}
+}
+
+// discardConn swallows everything written to it, counting the calls to Write.
+type discardConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *discardConn) Write(p []byte) (int, error) {
+	c.writes++
+	return len(p), nil
+}
+
+// replayConn returns the same bytes over and over again.
+type replayConn struct {
+	net.Conn
+	data []byte
+	off  int
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	n := copy(p, c.data[c.off:])
+	c.off = (c.off + n) % len(c.data)
+	return n, nil
+}
+
+var benchMessages = []struct {
+	name string
+	msg  *transport.Message
+}{
+	{"small", &transport.Message{
+		MessageHeaders: map[string]string{"path": "lobby.Join", "request-id": "0123456789", "x-trace": "abcdef"},
+		Data:           batchPayload(64),
+	}},
+	{"4KB", &transport.Message{
+		MessageHeaders: map[string]string{"path": "lobby.Join", "request-id": "0123456789", "x-trace": "abcdef"},
+		Data:           batchPayload(4 << 10),
+	}},
+	{"256KB", &transport.Message{
+		MessageHeaders: map[string]string{"path": "lobby.Join"},
+		Data:           batchPayload(256 << 10),
+	}},
+}
+
+var raceEnabled bool
+
+func TestSend_NoAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations aren't reliable with the race detector")
+	}
+
+	for _, v := range []uint8{ProtocolV0, ProtocolV1} {
+		for _, bm := range benchMessages {
+			s := newSocket(&discardConn{})
+			s.proto.version = v
+
+			allocs := testing.AllocsPerRun(100, func() {
+				s.Send(context.Background(), bm.msg)
+			})
+			assert.Zero(t, allocs, "v%d/%s", v, bm.name)
+		}
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	for _, v := range []uint8{ProtocolV0, ProtocolV1} {
+		for _, bm := range benchMessages {
+			msg := bm.msg
+
+			b.Run(fmt.Sprintf("v%d/%s", v, bm.name), func(b *testing.B) {
+				conn := &discardConn{}
+				s := newSocket(conn)
+				s.proto.version = v
+
+				b.ReportAllocs()
+				b.SetBytes(int64(messageSize(msg)))
+
+				for i := 0; i < b.N; i++ {
+					s.Send(context.Background(), msg)
+				}
+
+				b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+			})
+		}
+	}
+}
+
+func BenchmarkReceive(b *testing.B) {
+	for _, reuse := range []bool{false, true} {
+		for _, v := range []uint8{ProtocolV0, ProtocolV1} {
+			for _, bm := range benchMessages {
+				msg := bm.msg
+
+				b.Run(fmt.Sprintf("reuse=%v/v%d/%s", reuse, v, bm.name), func(b *testing.B) {
+					benchmarkReceive(b, v, reuse, msg)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkReceive(b *testing.B, version uint8, reuse bool, msg *transport.Message) {
+	encoded := &bufferConn{}
+	encoder := newSocket(encoded)
+	encoder.proto.version = version
+	encoder.Send(context.Background(), msg)
+
+	s := newSocket(&replayConn{data: encoded.buf.Bytes()})
+	s.proto.version = version
+	s.reuseRecv = reuse
+
+	var rec transport.Message
+
+	b.ReportAllocs()
+	b.SetBytes(int64(messageSize(msg)))
+
+	for i := 0; i < b.N; i++ {
+		if err := s.Receive(context.Background(), &rec); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// bufferConn keeps everything written to it.
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
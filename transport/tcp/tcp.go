@@ -2,31 +2,60 @@ package tcp
 
 import (
 	"context"
-	"encoding/binary"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/MouseHatGames/mice-plugins/transport/dialer"
+	"github.com/MouseHatGames/mice-plugins/transport/pool"
 	"github.com/MouseHatGames/mice/logger"
 	"github.com/MouseHatGames/mice/options"
 	"github.com/MouseHatGames/mice/transport"
-	"github.com/pipe01/pool"
 )
 
+// ErrListenerClosed is returned by Accept once the listener has been closed, and by Receive
+// on server sockets that were closed while idle because the listener was closed.
+var ErrListenerClosed = errors.New("listener closed")
+
 type tcpTransport struct {
-	l     logger.Logger
-	pools map[string]pool.Pool
-	opts  *tcpOptions
+	l        logger.Logger
+	pools    *pool.Pools
+	sessions map[string]*muxSession
+	opts     *tcpOptions
 
+	// dialMutex guards sessions and dialing, which holds a lock per address so that a slow
+	// connection to one doesn't hold up the others. Both only hold the addresses in use.
 	dialMutex sync.Mutex
+	dialing   map[string]*addrLock
+}
+
+// addrLock is the lock of an address, along with the number of callers holding or waiting
+// for it.
+type addrLock struct {
+	sync.Mutex
+	refs int
 }
 
+var _ pool.Observable = (*tcpTransport)(nil)
+
 func Transport(opts ...Option) options.Option {
 	tcpOpts := &tcpOptions{
 		UseConnectionPooling:  true,
-		ConnectionIdleTimeout: 1 * time.Minute,
+		ConnectionIdleTimeout: pool.DefaultIdleTimeout,
+		MaxIdleConnections:    pool.DefaultMaxIdle,
+		MaxActiveConnections:  pool.DefaultMaxActive,
+		PoolEvictAfter:        pool.DefaultEvictAfter,
+		CompressionThreshold:  DefaultCompressionThreshold,
+		MaxMessageSize:        DefaultMaxMessageSize,
+		MaxHeaderSize:         DefaultMaxHeaderSize,
+		MaxConcurrentStreams:  DefaultMaxConcurrentStreams,
+		DialTimeout:           DefaultDialTimeout,
+		DrainTimeout:          DefaultDrainTimeout,
+		HeartbeatTimeout:      DefaultHeartbeatTimeout,
 	}
 
 	for _, o := range opts {
@@ -34,176 +63,543 @@ func Transport(opts ...Option) options.Option {
 	}
 
 	return func(o *options.Options) {
-		o.Transport = &tcpTransport{
-			l:     o.Logger.GetLogger("tcp"),
-			pools: map[string]pool.Pool{},
-			opts:  tcpOpts,
+		t := &tcpTransport{
+			l:        o.Logger.GetLogger("tcp"),
+			sessions: map[string]*muxSession{},
+			opts:     tcpOpts,
 		}
+		t.pools = t.newPools()
+
+		o.Transport = t
 	}
 }
 
 func (t *tcpTransport) Listen(ctx context.Context, addr string) (transport.Listener, error) {
-	l, err := net.Listen("tcp", addr)
+	ls, err := t.listen(addr)
 	if err != nil {
-		return nil, fmt.Errorf("listen tcp: %w", err)
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	for i, l := range ls {
+		// The header comes before the TLS handshake
+		if t.opts.ProxyProtocol {
+			l = &proxyListener{Listener: l, trusted: t.opts.TrustedProxies}
+		}
+		if t.opts.ServerTLS != nil {
+			l = tls.NewListener(l, t.opts.ServerTLS)
+		}
+
+		ls[i] = l
 	}
 
-	t.l.Infof("listening on %s", l.Addr().String())
-	return &tcpListener{l, t.l}, nil
+	switch {
+	case len(ls) > 1:
+		t.l.Infof("listening on %s with %d acceptors", ls[0].Addr().String(), len(ls))
+	case t.opts.ServerTLS != nil:
+		t.l.Infof("listening on %s with tls", ls[0].Addr().String())
+	default:
+		t.l.Infof("listening on %s", ls[0].Addr().String())
+	}
+
+	dispatch := t.opts.Dispatcher
+	if dispatch == nil {
+		dispatch = goDispatch
+	}
+
+	return &tcpListener{
+		ls:       ls,
+		log:      t.l,
+		opts:     t.opts,
+		dispatch: dispatch,
+		conns:    map[*trackedConn]func(){},
+	}, nil
 }
 
-func (t *tcpTransport) getPooledSocket(addr string) (*tcpSocket, error) {
-	p, ok := t.pools[addr]
-	if !ok {
-		pl, err := pool.NewChannelPool(&pool.Config{
-			InitialCap:  5,
-			MaxIdle:     10,
-			MaxCap:      20,
-			IdleTimeout: t.opts.ConnectionIdleTimeout,
-			Factory: func(p pool.Pool) (interface{}, error) {
-				t.l.Debugf("creating connection to %s", addr)
-
-				c, err := net.Dial("tcp", addr)
-				if err != nil {
-					return nil, err
-				}
-
-				return &tcpSocket{
-					conn: c,
-					pool: p,
-				}, nil
-			},
-			Close: func(c interface{}) error {
-				t.l.Debugf("closing connection to %s", addr)
-
-				return c.(*tcpSocket).conn.Close()
-			},
-		})
-		if err != nil {
-			return nil, fmt.Errorf("create pool: %w", err)
-		}
+func (t *tcpTransport) dial(ctx context.Context, addr string) (net.Conn, error) {
+	network, address := splitAddr(addr)
 
-		p = pl
-		t.pools[addr] = pl
+	d := t.opts.Dialer
+	if d == nil {
+		d = dialer.Direct
 	}
 
-	s, err := p.Get()
+	c, err := d.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.(*tcpSocket), nil
+	if t.opts.ClientTLS == nil {
+		return c, nil
+	}
+
+	cfg := t.opts.ClientTLS
+	if cfg.ServerName == "" {
+		// Like tls.Dialer, verify the certificate against the host being dialed
+		cfg = cfg.Clone()
+		cfg.ServerName = hostname(address)
+	}
+
+	tc := tls.Client(c, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return tc, nil
 }
 
-func (t *tcpTransport) Dial(ctx context.Context, addr string) (transport.Socket, error) {
+// hostname strips the port from addr, if any.
+func hostname(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+// connect opens a new connection to addr and performs the protocol handshake.
+func (t *tcpTransport) connect(ctx context.Context, addr string) (*tcpSocket, error) {
+	if t.opts.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.opts.DialTimeout)
+		defer cancel()
+	}
+
+	c, err := t.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	version, features := t.opts.ProtocolVersion, feature(0)
+	if t.opts.UseMultiplexing {
+		features |= featureMultiplex
+	}
+	if t.opts.HeartbeatInterval > 0 || t.opts.ValidateOnBorrow {
+		features |= featureHeartbeat
+	}
+	features |= t.opts.Compression.feature()
+	if features != 0 && version < ProtocolV1 {
+		version = ProtocolV1
+	}
+	if version >= ProtocolV1 {
+		features |= featureExtendedHeaders | featureStreaming
+	}
+
+	s := newSocket(c)
+	s.configure(t.opts)
+
+	done := withContext(ctx, c, net.Conn.SetDeadline)
+	if err := done(s.clientHandshake(version, features)); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// newPools creates the pools of connections used when pooling is enabled.
+func (t *tcpTransport) newPools() *pool.Pools {
+	timeout := t.opts.HeartbeatTimeout
+
+	return pool.New(pool.Config{
+		MaxIdle:           t.opts.MaxIdleConnections,
+		MaxActive:         t.opts.MaxActiveConnections,
+		IdleTimeout:       t.opts.ConnectionIdleTimeout,
+		EvictAfter:        t.opts.PoolEvictAfter,
+		KeepAliveInterval: t.opts.HeartbeatInterval,
+		Dial: func(ctx context.Context, addr string) (interface{}, error) {
+			t.l.Debugf("creating connection to %s", addr)
+
+			return t.connect(ctx, addr)
+		},
+		Close: func(c interface{}) error {
+			s := c.(*tcpSocket)
+			t.l.Debugf("closing connection to %s", s.conn.RemoteAddr())
+
+			err := s.conn.Close()
+			s.releaseBuffer()
+
+			return err
+		},
+		Ping: func(c interface{}) error {
+			if t.opts.ValidateOnBorrow {
+				return c.(*tcpSocket).ping(timeout)
+			}
+
+			return c.(*tcpSocket).alive()
+		},
+		KeepAlive: func(c interface{}) error {
+			s := c.(*tcpSocket)
+
+			if err := s.ping(timeout); err != nil {
+				t.l.Debugf("connection to %s failed heartbeat: %s", s.conn.RemoteAddr(), err)
+				return err
+			}
+
+			return nil
+		},
+	})
+}
+
+// getPooledSocket takes an idle connection to addr from the pool, connecting if there's none.
+func (t *tcpTransport) getPooledSocket(ctx context.Context, addr string) (*tcpSocket, error) {
+	p := t.pools.Pool(addr)
+
+	c, err := p.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := c.(*tcpSocket)
+	s.pool = p
+
+	return s, nil
+}
+
+// PoolStats returns the stats of the connection pool of every address that has been dialed.
+func (t *tcpTransport) PoolStats() map[string]pool.Stats {
+	return t.pools.Stats()
+}
+
+// getStream opens a stream on the multiplexed connection to addr, connecting if there's none.
+func (t *tcpTransport) getStream(ctx context.Context, addr string) (*muxStream, error) {
+	// Dials to the same address wait for the connection being made to share it
+	unlock := t.lockAddr(addr)
+	defer unlock()
+
 	t.dialMutex.Lock()
-	defer t.dialMutex.Unlock()
+	sess, ok := t.sessions[addr]
+	t.dialMutex.Unlock()
+
+	if ok {
+		st, err := sess.open()
+		if err == nil {
+			return st, nil
+		}
+	}
+
+	t.l.Debugf("creating multiplexed connection to %s", addr)
+
+	s, err := t.connect(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !s.proto.features.has(featureMultiplex) {
+		s.conn.Close()
+		return nil, ErrMultiplexingUnsupported
+	}
+
+	sess = newMuxSession(s, t.l, nil)
+	go sess.run()
+
+	if t.opts.HeartbeatInterval > 0 && s.proto.features.has(featureHeartbeat) {
+		go sess.heartbeat(t.opts.HeartbeatInterval, t.opts.HeartbeatTimeout)
+	}
+
+	t.dialMutex.Lock()
+	t.sessions[addr] = sess
+	t.dialMutex.Unlock()
+
+	go t.forgetSession(addr, sess)
+
+	return sess.open()
+}
+
+// forgetSession removes sess from the sessions once it fails, unless it has been replaced.
+func (t *tcpTransport) forgetSession(addr string, sess *muxSession) {
+	<-sess.done
+
+	t.dialMutex.Lock()
+	if t.sessions[addr] == sess {
+		delete(t.sessions, addr)
+	}
+	t.dialMutex.Unlock()
+}
+
+// lockAddr holds the lock of addr while connecting to it, returning the function that
+// releases it.
+func (t *tcpTransport) lockAddr(addr string) (unlock func()) {
+	t.dialMutex.Lock()
+	if t.dialing == nil {
+		t.dialing = map[string]*addrLock{}
+	}
+
+	l, ok := t.dialing[addr]
+	if !ok {
+		l = &addrLock{}
+		t.dialing[addr] = l
+	}
+	l.refs++
+	t.dialMutex.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		t.dialMutex.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(t.dialing, addr)
+		}
+		t.dialMutex.Unlock()
+	}
+}
+
+func (t *tcpTransport) Dial(ctx context.Context, addr string) (transport.Socket, error) {
+	if t.opts.UseMultiplexing {
+		st, err := t.getStream(ctx, addr)
+		if err != nil {
+			return nil, fmt.Errorf("open stream: %w", err)
+		}
+
+		return st, nil
+	}
 
 	var c *tcpSocket
 
 	if t.opts.UseConnectionPooling {
-		soc, err := t.getPooledSocket(addr)
+		soc, err := t.getPooledSocket(ctx, addr)
 		if err != nil {
 			return nil, fmt.Errorf("get pooled socket: %w", err)
 		}
 
 		c = soc
 	} else {
-		conn, err := net.Dial("tcp", addr)
+		soc, err := t.connect(ctx, addr)
 		if err != nil {
 			return nil, fmt.Errorf("dial: %w", err)
 		}
 
-		c = &tcpSocket{conn: conn}
+		c = soc
 	}
 
 	return c, nil
 }
 
 type tcpListener struct {
-	l   net.Listener
-	log logger.Logger
+	ls       []net.Listener
+	log      logger.Logger
+	opts     *tcpOptions
+	dispatch Dispatcher
+
+	// conns holds every open connection along with the function that drains it.
+	mu      sync.Mutex
+	conns   map[*trackedConn]func()
+	closing bool
+	wg      sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
-func (t *tcpListener) Close() error {
-	t.log.Debugf("closing listener")
-	return t.l.Close()
+// trackedConn is a connection accepted by a listener, which stops tracking it once closed.
+type trackedConn struct {
+	net.Conn
+	l    *tcpListener
+	once sync.Once
 }
 
-func (t *tcpListener) Addr() net.Addr {
-	return t.l.Addr()
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.l.mu.Lock()
+		delete(c.l.conns, c)
+		c.l.mu.Unlock()
+
+		c.l.wg.Done()
+	})
+
+	return c.Conn.Close()
 }
 
-func (t *tcpListener) Accept(ctx context.Context, fn func(transport.Socket)) error {
-	t.log.Debugf("accepting connections")
+// track starts tracking a new connection, returning false if the listener is closing.
+func (t *tcpListener) track(c *trackedConn, drain func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	for {
-		conn, err := t.l.Accept()
-		if err != nil {
-			return fmt.Errorf("accept connection: %w", err)
-		}
+	if t.closing {
+		return false
+	}
+
+	t.conns[c] = drain
+	t.wg.Add(1)
+
+	return true
+}
 
-		t.log.Debugf("connection from %s", conn.RemoteAddr())
-		fn(&tcpSocket{conn: conn})
+// setDrain changes how a connection is drained, draining it right away if the listener is
+// already closing.
+func (t *tcpListener) setDrain(c *trackedConn, drain func()) {
+	t.mu.Lock()
+	_, ok := t.conns[c]
+	if ok {
+		t.conns[c] = drain
+	}
+	closing := t.closing
+	t.mu.Unlock()
+
+	if ok && closing {
+		drain()
 	}
 }
 
-type tcpSocket struct {
-	conn   net.Conn
-	pool   pool.Pool
-	ms, mr sync.Mutex
+// Close stops accepting connections and closes the idle ones. Connections in the middle of an
+// exchange are given until the drain timeout to finish it, and are closed once they do.
+func (t *tcpListener) Close() error {
+	t.closeOnce.Do(func() {
+		t.closeErr = t.shutdown()
+	})
+
+	return t.closeErr
 }
 
-func (s *tcpSocket) Close() error {
-	if s.pool != nil {
-		return s.pool.Put(s)
+func (t *tcpListener) shutdown() error {
+	t.log.Debugf("closing listener")
+
+	t.mu.Lock()
+	t.closing = true
+	drains := make([]func(), 0, len(t.conns))
+	for _, drain := range t.conns {
+		drains = append(drains, drain)
+	}
+	t.mu.Unlock()
+
+	var err error
+	for _, l := range t.ls {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	for _, drain := range drains {
+		go drain()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(t.opts.DrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		return err
+	case <-timer.C:
+	}
+
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	t.log.Infof("closing %d connections that didn't drain in time", len(conns))
+
+	for _, c := range conns {
+		c.Close()
 	}
 
-	return s.conn.Close()
+	return err
 }
 
-func (s *tcpSocket) Send(_ context.Context, msg *transport.Message) error {
-	s.ms.Lock()
-	defer s.ms.Unlock()
+func (t *tcpListener) isClosing() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.closing
+}
 
-	// Write message size
-	binary.Write(s.conn, binary.LittleEndian, int32(messageSize(msg)))
+func (t *tcpListener) Addr() net.Addr {
+	return t.ls[0].Addr()
+}
 
-	// Write headers
-	if err := writeMap(s.conn, msg.MessageHeaders); err != nil {
-		return fmt.Errorf("write headers: %w", err)
+// Accept serves connections until the listener is closed or ctx is done, in which case the
+// listener is closed. Either way, it returns once the connections have been drained.
+func (t *tcpListener) Accept(ctx context.Context, fn func(transport.Socket)) error {
+	t.log.Debugf("accepting connections")
+
+	stop := context.AfterFunc(ctx, func() { t.Close() })
+	defer stop()
+
+	errs := make(chan error, len(t.ls))
+	for _, l := range t.ls {
+		go func(l net.Listener) {
+			errs <- t.acceptLoop(l, fn)
+		}(l)
 	}
 
-	// Write data
-	if _, err := s.conn.Write(msg.Data); err != nil {
-		return fmt.Errorf("write data: %w", err)
+	// The other acceptors stop once the listener is closed
+	err := <-errs
+	t.Close()
+
+	for i := 1; i < len(t.ls); i++ {
+		<-errs
 	}
 
-	return nil
+	if err == ErrListenerClosed && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
-func (s *tcpSocket) Receive(_ context.Context, msg *transport.Message) error {
-	s.mr.Lock()
-	defer s.mr.Unlock()
+// acceptLoop hands the connections accepted on l to serve until it fails.
+func (t *tcpListener) acceptLoop(l net.Listener, fn func(transport.Socket)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !t.isClosing() {
+				return fmt.Errorf("accept connection: %w", err)
+			}
+
+			return ErrListenerClosed
+		}
 
-	var len int32
-	if err := binary.Read(s.conn, binary.LittleEndian, &len); err != nil {
-		return fmt.Errorf("read length: %w", err)
+		tc := &trackedConn{Conn: conn, l: t}
+		s := newSocket(tc)
+
+		if !t.track(tc, s.drain) {
+			conn.Close()
+			continue
+		}
+
+		if err := t.dispatch(func() { t.serve(tc, s, fn) }); err != nil {
+			t.log.Errorf("dropping new connection: %s", err)
+			tc.Close()
+		}
 	}
+}
 
-	payload := make([]byte, len)
+// serve negotiates the protocol with a new client before handing its socket over to fn.
+// This runs on its own goroutine since legacy clients may not send anything for a while.
+func (t *tcpListener) serve(conn *trackedConn, s *tcpSocket, fn func(transport.Socket)) {
+	// This waits for the PROXY protocol header if there's one
+	t.log.Debugf("connection from %s", conn.RemoteAddr())
 
-	read, err := io.ReadFull(s.conn, payload)
-	if err != nil {
-		return fmt.Errorf("read payload: %w", err)
+	s.configure(t.opts)
+
+	if err := s.serverHandshake(featureMultiplex | featureHeartbeat | featureExtendedHeaders | featureStreaming | compressionFeatures); err != nil {
+		t.log.Errorf("handshake with %s failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
 	}
-	if int32(read) != len {
-		return fmt.Errorf("wanted %d bytes, read %d", len, read)
+
+	if s.proto.features.has(featureMultiplex) {
+		sess := newMuxSession(s, t.log, fn)
+		sess.maxStreams = t.opts.MaxConcurrentStreams
+		t.setDrain(conn, sess.goAway)
+
+		sess.run()
+		return
 	}
 
-	if err := decodePayload(payload, msg); err != nil {
-		return fmt.Errorf("decode payload: %w", err)
+	// The socket is idle again once the handler waits for the next message
+	if !atomic.CompareAndSwapInt32(&s.state, stateIdle, stateActive) {
+		return
 	}
 
-	return nil
+	fn(s)
 }
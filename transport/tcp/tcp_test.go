@@ -2,13 +2,20 @@ package tcp
 
 import (
 	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/MouseHatGames/mice-plugins/transport/pool"
+	"github.com/MouseHatGames/mice-plugins/transport/portmux"
 	"github.com/MouseHatGames/mice/logger"
 	"github.com/MouseHatGames/mice/transport"
-	"github.com/pipe01/pool"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAll(t *testing.T) {
@@ -22,9 +29,8 @@ func TestAll(t *testing.T) {
 
 	const addr = ":45678"
 	tr := &tcpTransport{
-		l:     logger.NewStdoutLogger(),
-		pools: map[string]pool.Pool{},
-		opts:  &tcpOptions{},
+		l:    logger.NewStdoutLogger(),
+		opts: &tcpOptions{},
 	}
 	l, err := tr.Listen(context.Background(), addr)
 	a.Nil(err, "listen")
@@ -62,3 +68,608 @@ func TestAll(t *testing.T) {
 	a.Nil(err, "client receive")
 	a.Equal(dummyData, string(rec.Data))
 }
+
+func newTestTransport(opts *tcpOptions) *tcpTransport {
+	t := &tcpTransport{
+		l:        logger.NewStdoutLogger(),
+		sessions: map[string]*muxSession{},
+		opts:     opts,
+	}
+	t.pools = t.newPools()
+
+	return t
+}
+
+// exchange sends a message from a client to an echo server and returns the reply.
+func exchange(client, server *tcpTransport) (*transport.Message, error) {
+	return exchangeOn(client, server, "127.0.0.1:0")
+}
+
+func exchangeOn(client, server *tcpTransport, addr string) (*transport.Message, error) {
+	l, err := server.Listen(context.Background(), addr)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	if !strings.HasPrefix(addr, unixScheme) {
+		addr = l.(*tcpListener).Addr().String()
+	}
+
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		defer s.Close()
+
+		var msg transport.Message
+		if err := s.Receive(context.Background(), &msg); err != nil {
+			return
+		}
+		s.Send(context.Background(), &msg)
+	})
+
+	s, err := client.Dial(context.Background(), addr)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	err = s.Send(context.Background(), &transport.Message{
+		MessageHeaders: map[string]string{"a": "1"},
+		Data:           []byte("hello"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rec transport.Message
+	if err := s.Receive(context.Background(), &rec); err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+// listenSilent accepts connections without ever answering on them.
+func listenSilent(t *testing.T) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestDial_HandshakeTimeout(t *testing.T) {
+	addr, stop := listenSilent(t)
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{ProtocolVersion: ProtocolV1, DialTimeout: 50 * time.Millisecond})
+
+	_, err := client.Dial(context.Background(), addr)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDial_ContextDeadline(t *testing.T) {
+	addr, stop := listenSilent(t)
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{UseMultiplexing: true, DialTimeout: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.Dial(ctx, addr)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// recordingDialer dials directly, keeping track of the addresses it was asked for.
+type recordingDialer struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, network+" "+address)
+	d.mu.Unlock()
+
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, address)
+}
+
+func TestDial_CustomDialer(t *testing.T) {
+	d := &recordingDialer{}
+
+	server := newTestTransport(&tcpOptions{})
+	client := newTestTransport(&tcpOptions{Dialer: d})
+
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	go l.Accept(context.Background(), echo)
+
+	addr := l.(*tcpListener).Addr().String()
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+
+	assert.Equal(t, "hello", string(rec.Data))
+	assert.Equal(t, []string{"tcp " + addr}, d.addrs)
+}
+
+func TestPooledSocket_DiscardedAfterTimeout(t *testing.T) {
+	addr, _, stop := listenMux(t, func(s transport.Socket) {})
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{UseConnectionPooling: true, MaxIdleConnections: 10})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var rec transport.Message
+	assert.Equal(t, context.DeadlineExceeded, s.Receive(ctx, &rec))
+
+	require.Nil(t, s.Close())
+
+	assert.Equal(t, pool.Stats{}, client.PoolStats()[addr], "socket shouldn't go back to the pool")
+}
+
+func TestPooledSocket_Reused(t *testing.T) {
+	addr, _, stop := listenMux(t, echo)
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{UseConnectionPooling: true, MaxIdleConnections: 10})
+
+	s1, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	require.Nil(t, s1.Close())
+
+	s2, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s2.Close()
+
+	assert.Same(t, s1, s2)
+	assert.Equal(t, pool.Stats{Active: 1}, client.PoolStats()[addr])
+}
+
+func TestPooledSocket_ClosedByPeer(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	go func() {
+		c, _ := l.Accept()
+		conns <- c
+	}()
+
+	client := newTestTransport(&tcpOptions{UseConnectionPooling: true, MaxIdleConnections: 10})
+	addr := l.Addr().String()
+
+	s1, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	require.Nil(t, s1.Close())
+
+	// The server goes away while the connection is idle, so it's replaced on the next dial
+	(<-conns).Close()
+	time.Sleep(20 * time.Millisecond)
+
+	go func() {
+		c, _ := l.Accept()
+		conns <- c
+	}()
+
+	s2, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s2.Close()
+
+	assert.NotSame(t, s1, s2)
+	(<-conns).Close()
+}
+
+// listenUnresponsive accepts connections and completes the v1 handshake with the given
+// features, but never reads anything after that.
+func listenUnresponsive(t *testing.T, features feature) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+
+			go func() {
+				if _, _, err := readHandshake(c); err == nil {
+					writeHandshake(c, ProtocolV1, features)
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// echoAll echoes every message it receives until the connection is closed.
+func echoAll(s transport.Socket) {
+	defer s.Close()
+
+	for {
+		var msg transport.Message
+		if err := s.Receive(context.Background(), &msg); err != nil {
+			return
+		}
+		s.Send(context.Background(), &msg)
+	}
+}
+
+func TestHeartbeat_KeepsPooledSocket(t *testing.T) {
+	addr, _, stop := listenMux(t, echoAll)
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{
+		UseConnectionPooling: true,
+		MaxIdleConnections:   10,
+		HeartbeatInterval:    10 * time.Millisecond,
+		HeartbeatTimeout:     time.Second,
+	})
+
+	s1, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	require.Nil(t, s1.Close())
+
+	time.Sleep(100 * time.Millisecond)
+
+	s2, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s2.Close()
+
+	assert.Same(t, s1, s2)
+	assert.NotZero(t, s2.(*tcpSocket).pings)
+
+	require.Nil(t, s2.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+
+	var rec transport.Message
+	require.Nil(t, s2.Receive(context.Background(), &rec))
+	assert.Equal(t, "hello", string(rec.Data))
+}
+
+func TestHeartbeat_EvictsDeadPooledSocket(t *testing.T) {
+	addr, stop := listenUnresponsive(t, featureHeartbeat)
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{
+		UseConnectionPooling: true,
+		MaxIdleConnections:   10,
+		HeartbeatInterval:    10 * time.Millisecond,
+		HeartbeatTimeout:     20 * time.Millisecond,
+	})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+	assert.Equal(t, pool.Stats{Idle: 1}, client.PoolStats()[addr])
+
+	time.Sleep(150 * time.Millisecond)
+
+	assert.Equal(t, pool.Stats{}, client.PoolStats()[addr])
+	assert.NotZero(t, s.(*tcpSocket).broken)
+}
+
+func TestValidateOnBorrow(t *testing.T) {
+	addr, stop := listenUnresponsive(t, featureHeartbeat)
+	defer stop()
+
+	client := newTestTransport(&tcpOptions{
+		UseConnectionPooling: true,
+		MaxIdleConnections:   10,
+		HeartbeatTimeout:     20 * time.Millisecond,
+		ValidateOnBorrow:     true,
+	})
+
+	s1, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	require.Nil(t, s1.Close())
+
+	s2, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s2.Close()
+
+	assert.NotSame(t, s1, s2)
+	assert.Equal(t, pool.Stats{Active: 1}, client.PoolStats()[addr])
+}
+
+func TestSharedPort(t *testing.T) {
+	server := newTestTransport(&tcpOptions{SharedPort: true})
+
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	addr := l.(*tcpListener).Addr().String()
+	go l.Accept(context.Background(), echo)
+
+	hl, err := portmux.Listen("tcp", addr, portmux.HTTP)
+	require.Nil(t, err)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go srv.Serve(hl)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + addr + "/health")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, v := range []uint8{ProtocolV0, ProtocolV1} {
+		client := newTestTransport(&tcpOptions{ProtocolVersion: v})
+
+		s, err := client.Dial(context.Background(), addr)
+		require.Nil(t, err)
+
+		require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+
+		var rec transport.Message
+		require.Nil(t, s.Receive(context.Background(), &rec))
+		assert.Equal(t, "hello", string(rec.Data))
+
+		s.Close()
+	}
+}
+
+func TestAcceptors(t *testing.T) {
+	server := newTestTransport(&tcpOptions{Acceptors: 4})
+
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	if errors.Is(err, ErrReusePortUnsupported) {
+		t.Skip(err)
+	}
+	require.Nil(t, err)
+
+	tl := l.(*tcpListener)
+	require.Len(t, tl.ls, 4)
+	for _, l := range tl.ls {
+		assert.Equal(t, tl.Addr().String(), l.Addr().String())
+	}
+
+	accepted := make(chan error, 1)
+	go func() { accepted <- l.Accept(context.Background(), echoAll) }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rec, err := exchangeWith(newTestTransport(&tcpOptions{}), tl.Addr().String())
+			if assert.Nil(t, err) {
+				assert.Equal(t, "hello", string(rec.Data))
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Nil(t, l.Close())
+	assert.Equal(t, ErrListenerClosed, <-accepted)
+}
+
+// exchangeWith sends a message to an echo server at addr and returns the reply.
+func exchangeWith(client *tcpTransport, addr string) (*transport.Message, error) {
+	s, err := client.Dial(context.Background(), addr)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	if err := s.Send(context.Background(), &transport.Message{Data: []byte("hello")}); err != nil {
+		return nil, err
+	}
+
+	var rec transport.Message
+	if err := s.Receive(context.Background(), &rec); err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+func TestLimitHandlers(t *testing.T) {
+	busy, release := make(chan struct{}), make(chan struct{})
+
+	server := newTestTransport(&tcpOptions{Dispatcher: LimitHandlers(1)})
+
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	addr := l.(*tcpListener).Addr().String()
+	go l.Accept(context.Background(), func(s transport.Socket) {
+		var msg transport.Message
+		if err := s.Receive(context.Background(), &msg); err == nil && string(msg.Data) == "block" {
+			close(busy)
+			<-release
+		}
+
+		s.Send(context.Background(), &msg)
+		echoAll(s)
+	})
+
+	client := newTestTransport(&tcpOptions{})
+
+	blocked, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer blocked.Close()
+
+	require.Nil(t, blocked.Send(context.Background(), &transport.Message{Data: []byte("block")}))
+	<-busy
+
+	// The only handler is busy, so the next connection is dropped
+	_, err = exchangeWith(client, addr)
+	assert.NotNil(t, err)
+
+	close(release)
+
+	var rec transport.Message
+	require.Nil(t, blocked.Receive(context.Background(), &rec))
+	blocked.Close()
+
+	// The slot is freed once the handler returns
+	require.Eventually(t, func() bool {
+		_, err := exchangeWith(client, addr)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+// listenDrain starts a listener with the given drain timeout, returning its address.
+func listenDrain(t *testing.T, timeout time.Duration, fn func(transport.Socket)) (*tcpListener, string) {
+	server := newTestTransport(&tcpOptions{DrainTimeout: timeout})
+
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+
+	go l.Accept(context.Background(), fn)
+
+	return l.(*tcpListener), l.(*tcpListener).Addr().String()
+}
+
+func TestListener_DrainWaitsForExchange(t *testing.T) {
+	received := make(chan struct{})
+
+	l, addr := listenDrain(t, 5*time.Second, func(s transport.Socket) {
+		defer s.Close()
+
+		var msg transport.Message
+		for s.Receive(context.Background(), &msg) == nil {
+			close(received)
+			time.Sleep(100 * time.Millisecond)
+			s.Send(context.Background(), &msg)
+		}
+	})
+
+	client := newTestTransport(&tcpOptions{})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{Data: []byte("hello")}))
+	<-received
+
+	closed := make(chan error)
+	go func() {
+		closed <- l.Close()
+	}()
+
+	var rec transport.Message
+	require.Nil(t, s.Receive(context.Background(), &rec))
+	assert.Equal(t, "hello", string(rec.Data))
+
+	// The connection is closed once the server goes back to waiting for a message
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("listener didn't close after the exchange was done")
+	}
+
+	assert.NotNil(t, s.Receive(context.Background(), &rec))
+}
+
+func TestListener_DrainClosesIdle(t *testing.T) {
+	receiveErr := make(chan error, 1)
+
+	l, addr := listenDrain(t, 5*time.Second, func(s transport.Socket) {
+		var msg transport.Message
+		for {
+			if err := s.Receive(context.Background(), &msg); err != nil {
+				receiveErr <- err
+				return
+			}
+			s.Send(context.Background(), &msg)
+		}
+	})
+
+	client := newTestTransport(&tcpOptions{})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	var rec transport.Message
+	require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+	require.Nil(t, s.Receive(context.Background(), &rec))
+
+	// An idle legacy client that never finished connecting is closed as well
+	idle, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer idle.Close()
+
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	assert.Nil(t, l.Close())
+	assert.Less(t, time.Since(start), time.Second)
+
+	assert.ErrorIs(t, <-receiveErr, ErrListenerClosed)
+}
+
+func TestListener_DrainTimeout(t *testing.T) {
+	received := make(chan struct{})
+
+	l, addr := listenDrain(t, 50*time.Millisecond, func(s transport.Socket) {
+		var msg transport.Message
+		s.Receive(context.Background(), &msg)
+		close(received)
+
+		// Never replies
+		select {}
+	})
+
+	client := newTestTransport(&tcpOptions{})
+
+	s, err := client.Dial(context.Background(), addr)
+	require.Nil(t, err)
+	defer s.Close()
+
+	require.Nil(t, s.Send(context.Background(), &transport.Message{}))
+	<-received
+
+	start := time.Now()
+	assert.Nil(t, l.Close())
+	assert.Less(t, time.Since(start), time.Second)
+
+	var rec transport.Message
+	assert.NotNil(t, s.Receive(context.Background(), &rec))
+}
+
+func TestListener_AcceptContext(t *testing.T) {
+	server := newTestTransport(&tcpOptions{})
+
+	l, err := server.Listen(context.Background(), "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	assert.Equal(t, context.Canceled, l.Accept(ctx, echo))
+	assert.Equal(t, ErrListenerClosed, l.Accept(context.Background(), echo))
+}
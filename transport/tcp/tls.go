@@ -0,0 +1,141 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertCheckInterval is how often a CertReloader looks at its files for changes.
+const CertCheckInterval = 5 * time.Second
+
+// CertReloader serves a certificate loaded from a pair of PEM files, reloading it whenever
+// either file changes on disk so that certificates can be rotated without a restart. The files
+// are checked at most once every CertCheckInterval, during handshakes.
+//
+// Plug it into a tls.Config through GetCertificate on the server side and GetClientCertificate
+// on the client side.
+type CertReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+
+	// checked is when the files were last checked, in Unix nanoseconds.
+	checked int64
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads the certificate and key at the given paths.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: CertCheckInterval,
+		checked:  time.Now().UnixNano(),
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the certificate and key from disk. The previous certificate is kept if the
+// new one cannot be loaded.
+func (r *CertReloader) Reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	return nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+// GetClientCertificate can be used as tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+func (r *CertReloader) current() *tls.Certificate {
+	r.mu.RLock()
+	cert, loaded := r.cert, r.modTime
+	r.mu.RUnlock()
+
+	// Only one handshake per interval looks at the files, the others keep the current certificate
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&r.checked)
+	if now-last < int64(r.interval) || !atomic.CompareAndSwapInt64(&r.checked, last, now) {
+		return cert
+	}
+
+	if modTime, err := r.lastModified(); err == nil && modTime.After(loaded) {
+		// Files may be halfway through being replaced, keep serving the old certificate until
+		// both of them are readable again
+		if r.Reload() == nil {
+			r.mu.RLock()
+			cert = r.cert
+			r.mu.RUnlock()
+		}
+	}
+
+	return cert
+}
+
+func (r *CertReloader) lastModified() (time.Time, error) {
+	var last time.Time
+
+	for _, f := range []string{r.certFile, r.keyFile} {
+		st, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if st.ModTime().After(last) {
+			last = st.ModTime()
+		}
+	}
+
+	return last, nil
+}
+
+// LoadCertPool creates a certificate pool from one or more PEM files, to be used as
+// tls.Config.RootCAs on clients or tls.Config.ClientCAs on servers.
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+
+	for _, f := range files {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + f)
+		}
+	}
+
+	return pool, nil
+}
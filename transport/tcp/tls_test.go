@@ -0,0 +1,208 @@
+package tcp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (c *testCert) tls() tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	srv := newTestCert(t, "server", ca)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	server := newTestTransport(&tcpOptions{
+		ServerTLS: &tls.Config{Certificates: []tls.Certificate{srv.tls()}},
+	})
+	client := newTestTransport(&tcpOptions{
+		ClientTLS: &tls.Config{RootCAs: roots},
+	})
+
+	rec, err := exchange(client, server)
+
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(rec.Data))
+	assert.Equal(t, "1", rec.MessageHeaders["a"])
+}
+
+func TestTLS_UntrustedServer(t *testing.T) {
+	srv := newTestCert(t, "server", newTestCert(t, "ca", nil))
+
+	server := newTestTransport(&tcpOptions{
+		ServerTLS: &tls.Config{Certificates: []tls.Certificate{srv.tls()}},
+	})
+	client := newTestTransport(&tcpOptions{
+		ClientTLS: &tls.Config{RootCAs: x509.NewCertPool()},
+	})
+
+	_, err := exchange(client, server)
+
+	assert.NotNil(t, err)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	srv := newTestCert(t, "server", ca)
+	cli := newTestCert(t, "client", ca)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	server := newTestTransport(&tcpOptions{
+		ServerTLS: &tls.Config{
+			Certificates: []tls.Certificate{srv.tls()},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	})
+
+	t.Run("with client certificate", func(t *testing.T) {
+		client := newTestTransport(&tcpOptions{
+			ClientTLS: &tls.Config{
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{cli.tls()},
+			},
+		})
+
+		rec, err := exchange(client, server)
+
+		require.Nil(t, err)
+		assert.Equal(t, "hello", string(rec.Data))
+	})
+
+	t.Run("without client certificate", func(t *testing.T) {
+		client := newTestTransport(&tcpOptions{
+			ClientTLS: &tls.Config{RootCAs: pool},
+		})
+
+		_, err := exchange(client, server)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	ca := newTestCert(t, "ca", nil)
+	write := func(c *testCert, modTime time.Time) {
+		require.Nil(t, os.WriteFile(certFile, c.certPEM, 0600))
+		require.Nil(t, os.WriteFile(keyFile, c.keyPEM, 0600))
+		require.Nil(t, os.Chtimes(certFile, modTime, modTime))
+		require.Nil(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+
+	first := newTestCert(t, "first", ca)
+	write(first, time.Now().Add(-time.Minute))
+
+	r, err := NewCertReloader(certFile, keyFile)
+	require.Nil(t, err)
+
+	cert, err := r.GetCertificate(nil)
+	require.Nil(t, err)
+	assert.Equal(t, first.certPEM, pemOf(cert))
+
+	second := newTestCert(t, "second", ca)
+	write(second, time.Now())
+
+	// Changes are only seen once the interval has passed since the last check
+	cert, err = r.GetCertificate(nil)
+	require.Nil(t, err)
+	assert.Equal(t, first.certPEM, pemOf(cert))
+
+	r.interval = 0
+
+	cert, err = r.GetClientCertificate(nil)
+	require.Nil(t, err)
+	assert.Equal(t, second.certPEM, pemOf(cert))
+
+	// A broken key pair keeps the last good certificate in place
+	require.Nil(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	future := time.Now().Add(time.Minute)
+	require.Nil(t, os.Chtimes(keyFile, future, future))
+
+	cert, err = r.GetCertificate(nil)
+	require.Nil(t, err)
+	assert.Equal(t, second.certPEM, pemOf(cert))
+	assert.NotNil(t, r.Reload())
+}
+
+func pemOf(c *tls.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]})
+}
@@ -0,0 +1,142 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/MouseHatGames/mice-plugins/transport/portmux"
+)
+
+// unixScheme prefixes addresses of Unix domain sockets, e.g. "unix:///run/svc.sock". On Linux,
+// names starting with "@" such as "unix://@svc" live in the abstract namespace and have no file.
+const unixScheme = "unix://"
+
+// splitAddr returns the network and the address within it for an address given to Listen or Dial.
+func splitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixScheme) {
+		return "unix", strings.TrimPrefix(addr, unixScheme)
+	}
+
+	return "tcp", addr
+}
+
+func isAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+func (t *tcpTransport) listen(addr string) ([]net.Listener, error) {
+	network, address := splitAddr(addr)
+	if t.opts.Acceptors > 1 {
+		if t.opts.SharedPort {
+			return nil, errors.New("several acceptors can't share a port")
+		}
+
+		return listenReusePort(network, address, t.opts.Acceptors)
+	}
+
+	l, err := t.listenOne(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return []net.Listener{l}, nil
+}
+
+func (t *tcpTransport) listenOne(network, address string) (net.Listener, error) {
+	if t.opts.SharedPort {
+		return portmux.Listen(network, address, portmux.TCP)
+	}
+	if network != "unix" || isAbstract(address) {
+		return net.Listen(network, address)
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+
+	if t.opts.UnixSocketMode == 0 {
+		return net.Listen(network, address)
+	}
+
+	return listenWithMode(address, t.opts.UnixSocketMode)
+}
+
+// listenWithMode listens on a socket at path that has the given permissions from the start.
+// The socket is created in a directory only the owner can access, where it gets its
+// permissions, and is then linked into place. The umask is left alone since it applies to the
+// whole process.
+func listenWithMode(path string, mode os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".mice-sock-")
+	if err != nil {
+		return nil, fmt.Errorf("create socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	// The file at tmp goes away with the directory, the one at path is removed by
+	// unixListener.Close instead
+	l.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("set socket permissions: %w", err)
+	}
+	// Unlike a rename, linking fails if something was created at path in the meantime
+	if err := os.Link(tmp, path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("link socket into place: %w", err)
+	}
+
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// unixListener is a listener whose socket file was linked to path after it was created.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+
+	return err
+}
+
+// removeStaleSocket deletes the socket file at path if it was left behind by a process that
+// didn't shut down cleanly. Files that aren't sockets or that are still being listened on
+// are left alone.
+func removeStaleSocket(path string) error {
+	st, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if st.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,86 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd || solaris || illumos
+
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixSocket_ModeWiderThanUmask(t *testing.T) {
+	path := tempSocket(t)
+
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+
+	tr := newTestTransport(&tcpOptions{UnixSocketMode: 0666})
+
+	l, err := tr.Listen(context.Background(), unixScheme+path)
+	require.Nil(t, err)
+	defer l.Close()
+
+	st, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0666), st.Mode().Perm())
+
+	// Nothing is left next to the socket
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	assert.Equal(t, 022, syscall.Umask(022))
+}
+
+func TestUnixSocket_ModeDoesntAffectOtherFiles(t *testing.T) {
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+
+	dir := t.TempDir()
+
+	stop := make(chan struct{})
+	created := make(chan []string)
+
+	// Files are created by another goroutine the whole time sockets are being set up
+	go func() {
+		var names []string
+		defer func() { created <- names }()
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			name := filepath.Join(dir, fmt.Sprintf("file%d", i))
+			if err := os.WriteFile(name, nil, 0666); err != nil {
+				return
+			}
+			names = append(names, name)
+		}
+	}()
+
+	tr := newTestTransport(&tcpOptions{UnixSocketMode: 0600})
+	for i := 0; i < 50; i++ {
+		l, err := tr.Listen(context.Background(), unixScheme+tempSocket(t))
+		require.Nil(t, err)
+		l.Close()
+	}
+
+	close(stop)
+	names := <-created
+	require.NotEmpty(t, names)
+
+	for _, name := range names {
+		st, err := os.Stat(name)
+		require.Nil(t, err)
+		require.Equal(t, os.FileMode(0644), st.Mode().Perm(), name)
+	}
+}
@@ -0,0 +1,111 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempSocket(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "test.sock")
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := tempSocket(t)
+
+	for _, opts := range []*tcpOptions{{}, {UseConnectionPooling: true}, {UseMultiplexing: true}} {
+		client := newTestTransport(opts)
+
+		rec, err := exchangeOn(client, newTestTransport(&tcpOptions{}), unixScheme+path)
+
+		require.Nil(t, err)
+		assert.Equal(t, "hello", string(rec.Data))
+
+		// The socket file is removed when the listener is closed
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestUnixSocket_Abstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are only available on linux")
+	}
+
+	addr := fmt.Sprintf("%s@mice-test-%d", unixScheme, time.Now().UnixNano())
+
+	rec, err := exchangeOn(newTestTransport(&tcpOptions{}), newTestTransport(&tcpOptions{}), addr)
+
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(rec.Data))
+}
+
+func TestUnixSocket_Mode(t *testing.T) {
+	path := tempSocket(t)
+
+	tr := newTestTransport(&tcpOptions{UnixSocketMode: 0600})
+
+	l, err := tr.Listen(context.Background(), unixScheme+path)
+	require.Nil(t, err)
+
+	st, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), st.Mode().Perm())
+	assert.Equal(t, path, l.(*tcpListener).Addr().String())
+
+	// The socket file is still removed when the listener is closed
+	require.Nil(t, l.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnixSocket_Stale(t *testing.T) {
+	path := tempSocket(t)
+
+	// Leave a socket file behind, as a crashed process would
+	old, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.Nil(t, err)
+	old.SetUnlinkOnClose(false)
+	old.Close()
+
+	_, err = os.Stat(path)
+	require.Nil(t, err)
+
+	l, err := newTestTransport(&tcpOptions{}).Listen(context.Background(), unixScheme+path)
+	require.Nil(t, err)
+	l.Close()
+}
+
+func TestUnixSocket_InUse(t *testing.T) {
+	path := tempSocket(t)
+
+	tr := newTestTransport(&tcpOptions{})
+
+	l, err := tr.Listen(context.Background(), unixScheme+path)
+	require.Nil(t, err)
+	defer l.Close()
+
+	_, err = tr.Listen(context.Background(), unixScheme+path)
+	assert.NotNil(t, err)
+}
+
+func TestUnixSocket_NotASocket(t *testing.T) {
+	path := tempSocket(t)
+
+	require.Nil(t, os.WriteFile(path, []byte("important"), 0600))
+
+	_, err := newTestTransport(&tcpOptions{}).Listen(context.Background(), unixScheme+path)
+	assert.NotNil(t, err)
+
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "important", string(data))
+}
@@ -1,9 +1,8 @@
 package tcp
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"unsafe"
@@ -13,49 +12,52 @@ import (
 
 const maxHeaderCount = 255
 
-func writeByte(w io.Writer, b byte) error {
-	var buf [1]byte
-	buf[0] = b
+var (
+	// ErrMessageTooLarge is returned when a peer announces a message larger than MaxMessageSize.
+	ErrMessageTooLarge = errors.New("message too large")
 
-	_, err := w.Write(buf[:])
-	return err
-}
+	// ErrHeaderTooLarge is returned when the headers of a message are larger than MaxHeaderSize.
+	ErrHeaderTooLarge = errors.New("message header too large")
+
+	// ErrMalformedFrame is returned when a peer sends data that can't be decoded.
+	ErrMalformedFrame = errors.New("malformed frame")
+)
 
 func writeMap(w io.Writer, m map[string]string) error {
 	if len(m) > maxHeaderCount {
 		return transport.ErrTooManyHeaders
 	}
 
-	if err := writeByte(w, byte(len(m))); err != nil {
-		return err
-	}
+	_, err := w.Write(appendMap(nil, m))
+	return err
+}
+
+func writeString(w io.Writer, s string) error {
+	_, err := w.Write(appendString(nil, s))
+	return err
+}
+
+// appendMap encodes m at the end of b. The caller must check that it doesn't have more than
+// maxHeaderCount entries.
+func appendMap(b []byte, m map[string]string) []byte {
+	b = append(b, byte(len(m)))
 
 	for k, v := range m {
-		if err := writeString(w, k); err != nil {
-			return err
-		}
-		if err := writeString(w, v); err != nil {
-			return err
-		}
+		b = appendString(b, k)
+		b = appendString(b, v)
 	}
 
-	return nil
+	return b
 }
 
-func writeString(w io.Writer, s string) error {
-	if err := binary.Write(w, binary.LittleEndian, int16(len(s))); err != nil {
-		return err
-	}
-	if _, err := w.Write([]byte(s)); err != nil {
-		return err
-	}
-
-	return nil
+func appendString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
 }
 
 func readByte(r io.Reader) (byte, error) {
 	var buf [1]byte
-	_, err := r.Read(buf[:])
+	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
 		return 0, err
 	}
@@ -93,9 +95,12 @@ func readString(r io.Reader) (string, error) {
 	if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
 		return "", err
 	}
+	if l < 0 {
+		return "", fmt.Errorf("%w: negative string length %d", ErrMalformedFrame, l)
+	}
 
 	buf := make([]byte, l)
-	if _, err := r.Read(buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return "", err
 	}
 
@@ -117,17 +122,69 @@ func messageSize(msg *transport.Message) int {
 }
 
 func decodePayload(p []byte, msg *transport.Message) error {
-	r := bufio.NewReader(bytes.NewReader(p))
 	msg.Data = nil
 
-	header, err := readMap(r)
+	header, n, err := decodeMap(p)
 	if err != nil {
 		return fmt.Errorf("read header: %w", err)
 	}
 	msg.MessageHeaders = header
 
-	dataStart := messageSize(msg)
-	msg.Data = p[dataStart:]
+	// Duplicate keys make the header map smaller than what was read, so go by the number of
+	// bytes that were decoded instead of the size of the map
+	msg.Data = p[n:]
 
 	return nil
 }
+
+var errHeaderOverrun = fmt.Errorf("%w: header runs past the end of the payload", ErrMalformedFrame)
+
+// decodeMap decodes a map from the start of p, returning how many bytes it took up. The
+// strings in the map point into p instead of being copied.
+func decodeMap(p []byte) (map[string]string, int, error) {
+	if len(p) < 1 {
+		return nil, 0, errHeaderOverrun
+	}
+
+	count := int(p[0])
+	off := 1
+
+	m := make(map[string]string, count)
+
+	for i := 0; i < count; i++ {
+		k, n, err := decodeString(p[off:])
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+
+		v, n, err := decodeString(p[off:])
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+
+		m[k] = v
+	}
+
+	return m, off, nil
+}
+
+func decodeString(p []byte) (string, int, error) {
+	if len(p) < 2 {
+		return "", 0, errHeaderOverrun
+	}
+
+	l := int16(binary.LittleEndian.Uint16(p))
+	if l < 0 {
+		return "", 0, fmt.Errorf("%w: negative string length %d", ErrMalformedFrame, l)
+	}
+	if len(p)-2 < int(l) {
+		return "", 0, errHeaderOverrun
+	}
+
+	buf := p[2 : 2+int(l)]
+	str := *(*string)(unsafe.Pointer(&buf))
+
+	return str, 2 + int(l), nil
+}
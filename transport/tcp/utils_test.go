@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"strconv"
 	"testing"
+	"testing/iotest"
 
 	"github.com/MouseHatGames/mice/transport"
 	"github.com/stretchr/testify/assert"
@@ -154,3 +155,113 @@ func TestDecodePayload(t *testing.T) {
 	assert.Nil(t, err)
 	assert.ElementsMatch(t, data, msg.Data)
 }
+
+func TestReadString_Negative(t *testing.T) {
+	b := bytes.NewBuffer([]byte{0xff, 0xff, 'a'})
+
+	_, err := readString(b)
+
+	assert.ErrorIs(t, err, ErrMalformedFrame)
+}
+
+func TestReadString_ShortReads(t *testing.T) {
+	data := []byte{5, 0, 'h', 'e', 'l', 'l', 'o'}
+
+	ret, err := readString(iotest.OneByteReader(bytes.NewReader(data)))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", ret)
+}
+
+func TestReadString_Truncated(t *testing.T) {
+	data := []byte{5, 0, 'h', 'e'}
+
+	_, err := readString(bytes.NewReader(data))
+
+	assert.NotNil(t, err)
+}
+
+func TestDecodePayload_DuplicateKeys(t *testing.T) {
+	payload := []byte{
+		2, //Map length
+		1, 0, 'a',
+		1, 0, '1',
+		1, 0, 'a',
+		1, 0, '2',
+		9, 9,
+	}
+
+	var msg transport.Message
+	err := decodePayload(payload, &msg)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{9, 9}, msg.Data)
+}
+
+func TestDecodePayload_Truncated(t *testing.T) {
+	var msg transport.Message
+
+	for _, payload := range [][]byte{{}, {1}, {1, 5, 0, 'a'}, {1, 1, 0, 'a', 3, 0}} {
+		err := decodePayload(payload, &msg)
+
+		assert.ErrorIs(t, err, ErrMalformedFrame, "%v", payload)
+	}
+}
+
+func FuzzDecodePayload(f *testing.F) {
+	f.Add([]byte{1, 1, 0, 'a', 1, 0, '1', 1, 2, 3})
+	f.Add([]byte{0})
+	f.Add([]byte{255, 0xff, 0x7f})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		var msg transport.Message
+		if err := decodePayload(payload, &msg); err != nil {
+			return
+		}
+
+		// Whatever was decoded must have come from the payload
+		if len(msg.Data) > len(payload) || !bytes.HasSuffix(payload, msg.Data) {
+			t.Fatalf("data %v is not a suffix of %v", msg.Data, payload)
+		}
+		if len(msg.MessageHeaders) > int(payload[0]) {
+			t.Fatalf("decoded %d headers, payload announced %d", len(msg.MessageHeaders), payload[0])
+		}
+	})
+}
+
+func FuzzReadMap(f *testing.F) {
+	f.Add([]byte{2, 1, 0, 'a', 1, 0, '1', 2, 0, 'b', 'b', 2, 0, '2', '2'})
+	f.Add([]byte{1, 0x00, 0x80})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := readMap(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		// A map that was read successfully must encode to at most as many bytes
+		b := &bytes.Buffer{}
+		if err := writeMap(b, m); err != nil {
+			t.Fatal(err)
+		}
+		if b.Len() > len(data) {
+			t.Fatalf("re-encoded map is %d bytes, input was %d", b.Len(), len(data))
+		}
+	})
+}
+
+func FuzzReadString(f *testing.F) {
+	f.Add([]byte{5, 0, 'h', 'e', 'l', 'l', 'o'})
+	f.Add([]byte{0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := readString(iotest.OneByteReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+
+		if len(s)+2 > len(data) || s != string(data[2:2+len(s)]) {
+			t.Fatalf("read %q from %v", s, data)
+		}
+	})
+}